@@ -0,0 +1,200 @@
+// rag-eval measures the quality of the retrieval on an evaluation set, to compare configurations
+// (chunking, search mode, threshold, selection...) objectively.
+//
+// The evaluation set is a JSONL file, one question per line:
+//
+//	{"question": "How do I declare a constant?", "expected_sources": ["golang-course.md"], "expected_substrings": ["const Pi"]}
+//
+// The documents are indexed in memory with the given configuration, every question is searched,
+// and recall@k, the mean reciprocal rank (MRR) and nDCG@k are reported.
+// By default the embeddings are computed locally by a deterministic hashing embedder (no model needed, for CI);
+// use -embedder openai to evaluate with the model of MODEL_RUNNER_BASE_URL and EMBEDDING_MODEL,
+// or record its embeddings once (-embedder record -fixtures file.json) and replay them offline (-embedder replay).
+//
+//	go run ./cmd/rag-eval -questions eval/questions.jsonl -documents markdown -chunk-method code
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/openai/openai-go/v2"
+	"github.com/openai/openai-go/v2/option"
+
+	"mcp-rag-server/helpers"
+	"mcp-rag-server/rag"
+)
+
+func main() {
+	questionsPath := flag.String("questions", "", "JSONL file of the questions (required)")
+	documentsPath := flag.String("documents", "", "directory of the documents to index (required)")
+	extensions := flag.String("extensions", ".md", "extensions of the documents to index, separated by commas")
+	k := flag.Int("k", 5, "number of results per question")
+	embedderKind := flag.String("embedder", rag.EmbedderHash, "embeddings: 'hash' (local and deterministic), 'openai' (MODEL_RUNNER_BASE_URL and EMBEDDING_MODEL), 'replay' or 'record' (fixtures file)")
+	fixturesPath := flag.String("fixtures", "", "embeddings recorded by the 'record' embedder and replayed by the 'replay' embedder")
+	dimension := flag.Int("dimension", rag.DefaultHashEmbeddingDimension, "dimension of the hash embeddings")
+	chunkMethod := flag.String("chunk-method", rag.ChunkMethodText, "chunk method: 'text', 'tokens' or 'code'")
+	chunkSize := flag.Int("chunk-size", 1024, "chunk size in runes (text method)")
+	chunkOverlap := flag.Int("chunk-overlap", 256, "chunk overlap in runes (text method)")
+	chunkMaxTokens := flag.Int("chunk-max-tokens", 512, "token budget of a chunk (tokens and code methods)")
+	chunkOverlapTokens := flag.Int("chunk-overlap-tokens", 64, "chunk overlap in tokens (tokens method)")
+	vectorIndex := flag.String("index", "flat", "vector index: 'flat' or 'hnsw'")
+	searchMode := flag.String("search-mode", rag.SearchModeVector, "search mode: 'vector', 'keyword' or 'hybrid'")
+	vectorWeight := flag.Float64("vector-weight", 0.5, "weight of the vector ranking in the hybrid mode")
+	limit := flag.Float64("limit", -1, "minimum cosine similarity of the results")
+	selection := flag.String("selection", rag.SelectionTopN, "result selection: 'top' or 'mmr'")
+	mmrLambda := flag.Float64("mmr-lambda", rag.DefaultMMRLambda, "relevance/diversity trade-off of the mmr selection")
+	jsonOutput := flag.Bool("json", false, "print the report as JSON")
+	minRecall := flag.Float64("min-recall", 0, "exit with an error when recall@k is lower (to use in CI)")
+	flag.Parse()
+
+	if *questionsPath == "" || *documentsPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	ctx := context.Background()
+
+	questions, err := rag.LoadEvalQuestions(*questionsPath)
+	if err != nil {
+		log.Fatalln("😡 Error reading the questions:", err)
+	}
+
+	// -------------------------------------------------
+	// Embeddings
+	// -------------------------------------------------
+	embedder, err := rag.NewEmbedder(rag.EmbedderConfig{
+		Kind: *embedderKind,
+		Client: openai.NewClient(
+			option.WithBaseURL(os.Getenv("MODEL_RUNNER_BASE_URL")),
+			option.WithAPIKey(""),
+		),
+		Model:            os.Getenv("EMBEDDING_MODEL"),
+		Dimension:        *dimension,
+		FixturesFilePath: *fixturesPath,
+	})
+	if err != nil {
+		log.Fatalln("😡 Error creating the embedder:", err)
+	}
+	embed := func(texts []string) ([][]float64, error) {
+		embeddings, report := rag.CreateEmbeddings(ctx, embedder, texts, rag.DefaultEmbeddingOptions())
+		if report.Failed > 0 {
+			return nil, fmt.Errorf("%d texts could not be embedded: %v", report.Failed, report.Errors)
+		}
+		return embeddings, nil
+	}
+
+	// -------------------------------------------------
+	// Index the documents
+	// -------------------------------------------------
+	var store rag.VectorStore
+	switch *vectorIndex {
+	case "flat":
+		store = &rag.MemoryVectorStore{Records: make(map[string]rag.VectorRecord)}
+	case "hnsw":
+		store = rag.NewHNSWVectorStore(rag.DefaultHNSWOptions())
+	default:
+		log.Fatalln("😡 Unknown vector index:", *vectorIndex)
+	}
+	chunkOptions := rag.ChunkOptions{
+		Method:        *chunkMethod,
+		Size:          *chunkSize,
+		Overlap:       *chunkOverlap,
+		MaxTokens:     *chunkMaxTokens,
+		OverlapTokens: *chunkOverlapTokens,
+	}
+
+	chunks := []rag.VectorRecord{}
+	for _, extension := range strings.Split(*extensions, ",") {
+		extension = strings.TrimSpace(extension)
+		if extension == "" {
+			continue
+		}
+		paths, err := helpers.FindFiles(*documentsPath, extension)
+		if err != nil {
+			log.Fatalln("😡 Error getting the documents:", err)
+		}
+		for _, path := range paths {
+			document, err := rag.LoadDocument(path)
+			if err != nil {
+				log.Println("⚠️ Skipping a file that cannot be loaded:", err)
+				continue
+			}
+			source, err := filepath.Rel(*documentsPath, path)
+			if err != nil {
+				source = path
+			}
+			chunks = append(chunks, rag.ChunkDocument(filepath.ToSlash(source), document, chunkOptions)...)
+		}
+	}
+	texts := make([]string, len(chunks))
+	for idx, chunk := range chunks {
+		texts[idx] = chunk.Prompt
+	}
+	embeddings, err := embed(texts)
+	if err != nil {
+		log.Fatalln("😡 Error embedding the chunks:", err)
+	}
+	keywordIndex := rag.NewBM25Index()
+	for idx, chunk := range chunks {
+		chunk.Embedding = embeddings[idx]
+		saved, err := store.Save(chunk)
+		if err != nil {
+			log.Fatalln("😡 Error saving a chunk:", err)
+		}
+		keywordIndex.Add(saved.Id, saved.Prompt)
+	}
+
+	// -------------------------------------------------
+	// Evaluate
+	// -------------------------------------------------
+	report, err := rag.Evaluate(store, questions, *k, func(question string) ([]rag.VectorRecord, error) {
+		questionEmbeddings, err := embed([]string{question})
+		if err != nil {
+			return nil, err
+		}
+		return rag.HybridSearch(store, keywordIndex, question, rag.VectorRecord{Embedding: questionEmbeddings[0]}, rag.SearchOptions{
+			Mode:         *searchMode,
+			Limit:        *limit,
+			MaxResults:   *k,
+			VectorWeight: *vectorWeight,
+			Selection:    *selection,
+			MMRLambda:    *mmrLambda,
+		})
+	})
+	if err != nil {
+		log.Fatalln("😡 Error evaluating the questions:", err)
+	}
+	// -embedder record: write the embeddings of the chunks and of the questions to the fixtures file
+	if err := rag.FlushEmbedder(embedder); err != nil {
+		log.Fatalln("😡 Error saving the recorded embeddings:", err)
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		fmt.Printf("📊 %d questions, %d chunks, k=%d\n\n", len(questions), len(chunks), report.K)
+		for _, result := range report.Results {
+			status := "✅"
+			if result.Recall < 1 {
+				status = "❌"
+			}
+			fmt.Printf("%s recall %.2f  rr %.2f  ndcg %.2f  %s\n", status, result.Recall, result.ReciprocalRank, result.NDCG, result.Question)
+			if len(result.Missing) > 0 {
+				fmt.Printf("   missing: %s\n", strings.Join(result.Missing, " | "))
+			}
+		}
+		fmt.Printf("\nrecall@%d: %.3f  MRR: %.3f  nDCG@%d: %.3f\n", report.K, report.Recall, report.MRR, report.K, report.NDCG)
+	}
+
+	if report.Recall < *minRecall {
+		log.Fatalf("😡 recall@%d %.3f is lower than %.3f", report.K, report.Recall, *minRecall)
+	}
+}
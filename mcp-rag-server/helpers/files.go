@@ -2,8 +2,11 @@ package helpers
 
 
 import (
+	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // FindFiles searches for files with a specific extension in the given root directory and its subdirectories.
@@ -42,6 +45,52 @@ If there is an error during the search, it is returned.
 Otherwise, the textFiles slice and any error encountered during the search are returned.
 */
 
+// FindFilesWithGlobs searches the files of a directory and its subdirectories that match one of the include patterns
+// and none of the exclude patterns (see filepath.Match for the syntax).
+// A pattern with a "/" is matched against the path relative to the directory (ex: "go/*.md"),
+// a pattern without "/" against the name of the file (ex: "*.md", "README*").
+// A subdirectory that matches an exclude pattern is skipped.
+func FindFilesWithGlobs(dirPath string, include []string, exclude []string) ([]string, error) {
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	matchAny := func(patterns []string, relativePath string) bool {
+		for _, pattern := range patterns {
+			name := filepath.Base(relativePath)
+			if strings.Contains(pattern, "/") {
+				name = filepath.ToSlash(relativePath)
+			}
+			if matched, _ := filepath.Match(pattern, name); matched {
+				return true
+			}
+		}
+		return false
+	}
+
+	var files []string
+	err := filepath.WalkDir(dirPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(dirPath, path)
+		if err != nil || relativePath == "." {
+			return err
+		}
+		switch {
+		case matchAny(exclude, relativePath):
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+		case !entry.IsDir() && matchAny(include, relativePath):
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
 // ForEachFile iterates over all files with a specific extension in a directory and its subdirectories.
 //
 // Parameters:
@@ -3,11 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
@@ -19,8 +26,39 @@ import (
 )
 
 var client openai.Client
-var store rag.MemoryVectorStore
+var store rag.PersistentVectorStore
 var embeddingsModel string
+var embedder rag.Embedder
+var embeddingBreaker *rag.CircuitBreakerEmbedder
+var keywordIndex *rag.BM25Index
+var defaultSearchMode string
+var hybridVectorWeight float64
+var defaultLimit float64
+var defaultMaxResults int
+var maxResultsCeiling int
+var minSimilarityFloor float64
+var defaultSelection string
+var defaultMMRLambda float64
+var jsonStoreFilePath string
+var storeFilePath string // JSON_STORE_FILE_PATH (with the .bin extension in a binary format), or BOLT_STORE_FILE_PATH with VECTOR_STORE=bolt
+var documentsPath string
+var documentExtensions []string
+var chunkMethod string
+var chunkSize, chunkOverlap int
+var chunkMaxTokens, chunkOverlapTokens int
+var embeddingOptions rag.EmbeddingOptions
+var embeddingCache *rag.EmbeddingCache
+var embeddingCacheFilePath string
+var mcpServer *server.MCPServer // the document tools update its resources
+
+// storeMutex protects the store and the keyword index: the document tools modify them while searches read them
+var storeMutex sync.RWMutex
+var reranker rag.Reranker
+var rerankCandidates int
+var queryRewriter *rag.QueryRewriter
+var defaultQueryExpansion string
+var answerer *rag.Answerer
+var defaultResponseMode string
 
 func main() {
 	ctx := context.Background()
@@ -29,7 +67,11 @@ func main() {
 	s := server.NewMCPServer(
 		"mcp-rag-server",
 		"0.0.0",
+		// The documents are resources: the list changes with add_document and delete_document
+		server.WithResourceCapabilities(false, true),
+		server.WithPromptCapabilities(false),
 	)
+	mcpServer = s
 
 	// Ensure MODEL_RUNNER_BASE_URL is set in the environment
 	if os.Getenv("MODEL_RUNNER_BASE_URL") == "" {
@@ -49,23 +91,248 @@ func main() {
 
 	llmURL := os.Getenv("MODEL_RUNNER_BASE_URL")
 	embeddingsModel = os.Getenv("EMBEDDING_MODEL")
-	jsonStoreFilePath := os.Getenv("JSON_STORE_FILE_PATH")
-	documentsPath := os.Getenv("DOCUMENTS_PATH")
+	jsonStoreFilePath = os.Getenv("JSON_STORE_FILE_PATH")
+	documentsPath = os.Getenv("DOCUMENTS_PATH")
 
 	client = openai.NewClient(
 		option.WithBaseURL(llmURL),
 		option.WithAPIKey(""),
 	)
 
+	// EMBEDDER: "openai" (EMBEDDING_MODEL of MODEL_RUNNER_BASE_URL, default), "hash" (local and deterministic, no model),
+	// "replay" (embeddings recorded in EMBEDDING_FIXTURES_FILE, offline) or "record" (EMBEDDING_MODEL, recording its embeddings)
+	var err error
+	embedder, err = rag.NewEmbedder(rag.EmbedderConfig{
+		Kind:             os.Getenv("EMBEDDER"),
+		Client:           client,
+		Model:            embeddingsModel,
+		Dimension:        getIntEnv("EMBEDDING_DIMENSION", rag.DefaultHashEmbeddingDimension),
+		FixturesFilePath: os.Getenv("EMBEDDING_FIXTURES_FILE"),
+	})
+	if err != nil {
+		log.Fatalln("😡 Error creating the embedder:", err)
+	}
+	if os.Getenv("EMBEDDER") == rag.EmbedderRecord {
+		// The recorded embeddings (of the questions too) are written regularly, not after every request
+		go func() {
+			for range time.Tick(embeddingCachePersistInterval) {
+				flushEmbeddingFixtures()
+			}
+		}()
+	}
+	// EMBEDDING_BREAKER_THRESHOLD: consecutive failed embeddings requests that open the circuit (the requests then fail immediately)
+	// EMBEDDING_BREAKER_COOLDOWN: seconds before a request checks whether the model runner is back
+	embeddingBreaker = rag.NewCircuitBreakerEmbedder(embedder,
+		getIntEnv("EMBEDDING_BREAKER_THRESHOLD", 5),
+		time.Duration(getIntEnv("EMBEDDING_BREAKER_COOLDOWN", 30))*time.Second,
+	)
+	embedder = embeddingBreaker
+	// The vector store and the embedding cache record the model of the embeddings
+	embeddingsModel = embedder.ModelName()
+
+	// -------------------------------------------------
+	// Chunking and embeddings settings
+	// (used to index the documents at startup and by the add_document tool)
+	// -------------------------------------------------
+	// CHUNK_METHOD: "text" (fixed size in runes), "tokens" (token budget, paragraph and sentence aware)
+	// or "code" (token budget, never splits a fenced code block)
+	// "text" stays the default: a store is only re-indexed when it is empty (or created with another model),
+	// so another default would chunk the added documents differently from the ones already indexed
+	chunkMethod = os.Getenv("CHUNK_METHOD")
+	if chunkMethod == "" {
+		chunkMethod = rag.ChunkMethodText
+	}
+	if chunkMethod != rag.ChunkMethodText && chunkMethod != rag.ChunkMethodTokens && chunkMethod != rag.ChunkMethodCode {
+		log.Fatalln("😡 Unknown chunk method:", chunkMethod)
+	}
+	strChunkSize := os.Getenv("CHUNK_SIZE")
+	if strChunkSize == "" {
+		strChunkSize = "1024"
+	}
+	strChunkOverlap := os.Getenv("CHUNK_OVERLAP")
+	if strChunkOverlap == "" {
+		strChunkOverlap = "256"
+	}
+	chunkSize, err = strconv.Atoi(strChunkSize)
+	if err != nil {
+		log.Fatalln("😡 Error converting chunk size to int:", err)
+	}
+	chunkOverlap, err = strconv.Atoi(strChunkOverlap)
+	if err != nil {
+		log.Fatalln("😡 Error converting chunk overlap to int:", err)
+	}
+	strChunkMaxTokens := os.Getenv("CHUNK_MAX_TOKENS")
+	if strChunkMaxTokens == "" {
+		strChunkMaxTokens = "512"
+	}
+	strChunkOverlapTokens := os.Getenv("CHUNK_OVERLAP_TOKENS")
+	if strChunkOverlapTokens == "" {
+		strChunkOverlapTokens = "64"
+	}
+	chunkMaxTokens, err = strconv.Atoi(strChunkMaxTokens)
+	if err != nil {
+		log.Fatalln("😡 Error converting chunk max tokens to int:", err)
+	}
+	chunkOverlapTokens, err = strconv.Atoi(strChunkOverlapTokens)
+	if err != nil {
+		log.Fatalln("😡 Error converting chunk overlap tokens to int:", err)
+	}
+	if (chunkMethod == rag.ChunkMethodText && chunkOverlap >= chunkSize) ||
+		(chunkMethod == rag.ChunkMethodTokens && chunkOverlapTokens >= chunkMaxTokens) {
+		log.Println("⚠️ Chunk overlap must be smaller than the chunk size, the overlap will be ignored.")
+	}
+
+	// DOCUMENT_EXTENSIONS: extensions of the files of DOCUMENTS_PATH to index, each one read by its loader
+	// ex: DOCUMENT_EXTENSIONS=.md,.txt,.html,.rst,.json,.yaml,.csv,.go,.rs
+	// SOURCE_CODE_EXTENSIONS: source files to index too, chunked at function and type boundaries (ex: .go,.rs,.swift)
+	documentExtensions = []string{}
+	strExtensions := os.Getenv("DOCUMENT_EXTENSIONS")
+	if strExtensions == "" {
+		strExtensions = ".md"
+	}
+	for _, extension := range strings.Split(strExtensions+","+os.Getenv("SOURCE_CODE_EXTENSIONS"), ",") {
+		extension = strings.ToLower(strings.TrimSpace(extension))
+		if extension == "" || slices.Contains(documentExtensions, extension) {
+			continue
+		}
+		if !rag.HasLoader(extension) {
+			log.Fatalln("😡 Unsupported document extension:", extension, "- supported:", strings.Join(rag.LoaderExtensions(), " "))
+		}
+		documentExtensions = append(documentExtensions, extension)
+	}
+
+	embeddingOptions = rag.DefaultEmbeddingOptions()
+	embeddingOptions.BatchSize = getIntEnv("EMBEDDING_BATCH_SIZE", embeddingOptions.BatchSize)
+	embeddingOptions.Workers = getIntEnv("EMBEDDING_WORKERS", embeddingOptions.Workers)
+	embeddingOptions.MaxRetries = getIntEnv("EMBEDDING_MAX_RETRIES", embeddingOptions.MaxRetries)
+
+	// -------------------------------------------------
+	// Embedding cache: unchanged chunks and repeated questions are not embedded again
+	// -------------------------------------------------
+	// EMBEDDING_CACHE_MAX_ENTRIES: number of embeddings kept in the cache (0 disables the cache)
+	// EMBEDDING_CACHE_MAX_MB: size of the embeddings kept in the cache
+	if maxEntries := getIntEnv("EMBEDDING_CACHE_MAX_ENTRIES", 10000); maxEntries > 0 {
+		embeddingCache = rag.NewEmbeddingCache(maxEntries, getIntEnv("EMBEDDING_CACHE_MAX_MB", 256)*1024*1024)
+		// EMBEDDING_CACHE_FILE_PATH: where the cache is persisted (default: next to the vector store)
+		embeddingCacheFilePath = os.Getenv("EMBEDDING_CACHE_FILE_PATH")
+		if embeddingCacheFilePath == "" {
+			embeddingCacheFilePath = jsonStoreFilePath + ".embeddings-cache"
+		}
+		if err := embeddingCache.Load(embeddingCacheFilePath); err != nil && !os.IsNotExist(err) {
+			log.Println("⚠️ The embedding cache cannot be read, starting with an empty cache:", err)
+		}
+		log.Println("🗃️ Embedding cache loaded:", embeddingCache.Stats().Entries, "embeddings")
+		embeddingOptions.Cache = embeddingCache
+
+		// The questions are cached too: save the cache regularly, not only after an indexing
+		go func() {
+			for range time.Tick(embeddingCachePersistInterval) {
+				persistEmbeddingCache()
+			}
+		}()
+	}
+
 	// -------------------------------------------------
 	// Create a vector store
 	// -------------------------------------------------
-	store = rag.MemoryVectorStore{
-		Records: make(map[string]rag.VectorRecord),
+	// VECTOR_INDEX: "flat" (exact search on every record, default) or "hnsw" (approximate nearest neighbour search)
+	vectorIndex := os.Getenv("VECTOR_INDEX")
+	if vectorIndex == "" {
+		vectorIndex = "flat"
+	}
+	// STORE_FORMAT: "binary" (float32, default), "binary-int8" (quantized) or "json"
+	// An existing store file in another format is migrated when it is loaded
+	storeFormat := os.Getenv("STORE_FORMAT")
+	if storeFormat == "" {
+		storeFormat = rag.StoreFormatFloat32
+	}
+	if storeFormat != rag.StoreFormatFloat32 && storeFormat != rag.StoreFormatInt8 && storeFormat != rag.StoreFormatJSON {
+		log.Fatalln("😡 Unknown store format:", storeFormat)
+	}
+	// VECTOR_STORE: "file" (the whole store in JSON_STORE_FILE_PATH, default) or "bolt" (a bbolt database,
+	// BOLT_STORE_FILE_PATH, where only the changed records are written)
+	vectorStore := os.Getenv("VECTOR_STORE")
+	if vectorStore == "" {
+		vectorStore = "file"
+	}
+	storeFilePath = jsonStoreFilePath
+	switch {
+	case vectorStore == "bolt" && vectorIndex != "flat":
+		log.Fatalln("😡 VECTOR_STORE=bolt only supports VECTOR_INDEX=flat")
+	case vectorStore == "bolt":
+		storeFilePath = os.Getenv("BOLT_STORE_FILE_PATH")
+		if storeFilePath == "" {
+			storeFilePath = strings.TrimSuffix(jsonStoreFilePath, filepath.Ext(jsonStoreFilePath)) + ".db"
+		}
+	case vectorStore != "file":
+		log.Fatalln("😡 Unknown vector store:", vectorStore)
+	case storeFormat != rag.StoreFormatJSON && strings.EqualFold(filepath.Ext(jsonStoreFilePath), ".json"):
+		// A binary store is not written over a .json file (it may be tracked by git): it goes to a .bin file,
+		// created from the JSON file at the first start
+		storeFilePath = strings.TrimSuffix(jsonStoreFilePath, filepath.Ext(jsonStoreFilePath)) + ".bin"
+		copied, err := rag.CopyStoreFile(jsonStoreFilePath, storeFilePath, storeFormat)
+		if err != nil {
+			log.Fatalln("😡 Error converting the vector store file:", err)
+		}
+		if copied {
+			log.Println("📦 Vector store", jsonStoreFilePath, "converted to", storeFilePath)
+		}
+	}
+	switch {
+	case vectorStore == "bolt":
+		boltStore := rag.NewBoltVectorStore(embeddingsModel)
+		// The first start with the database: move the existing store file to it instead of re-indexing the documents
+		_, errDatabase := os.Stat(storeFilePath)
+		_, errFile := os.Stat(jsonStoreFilePath)
+		if os.IsNotExist(errDatabase) && errFile == nil {
+			var modelMismatch *rag.ModelMismatchError
+			err := boltStore.ImportStoreFile(jsonStoreFilePath)
+			switch {
+			case errors.As(err, &modelMismatch) && os.Getenv("ON_MODEL_MISMATCH") == "reindex":
+				log.Println("♻️", modelMismatch, "-> the store file is not imported.")
+			case err != nil:
+				log.Fatalln("😡 Error importing the vector store file into the database:", err)
+			default:
+				if err := boltStore.Persist(storeFilePath); err != nil {
+					log.Fatalln("😡 Error saving vector store:", err)
+				}
+				log.Println("📥", boltStore.Count(), "records imported from", jsonStoreFilePath, "into", storeFilePath)
+			}
+		}
+		store = boltStore
+	case vectorIndex == "flat":
+		store = &rag.MemoryVectorStore{
+			Model:   embeddingsModel,
+			Format:  storeFormat,
+			Records: make(map[string]rag.VectorRecord),
+		}
+	case vectorIndex == "hnsw":
+		hnswOptions := rag.DefaultHNSWOptions()
+		hnswOptions.M = getIntEnv("HNSW_M", hnswOptions.M)
+		hnswOptions.EfConstruction = getIntEnv("HNSW_EF_CONSTRUCTION", hnswOptions.EfConstruction)
+		hnswOptions.EfSearch = getIntEnv("HNSW_EF_SEARCH", hnswOptions.EfSearch)
+		hnswStore := rag.NewHNSWVectorStore(hnswOptions)
+		hnswStore.Model = embeddingsModel
+		hnswStore.Format = storeFormat
+		store = hnswStore
+	default:
+		log.Fatalln("😡 Unknown vector index:", vectorIndex)
 	}
 
 	// Load the vector store from a file if it exists
-	err := store.Load(jsonStoreFilePath)
+	err = store.Load(storeFilePath)
+
+	// The store was created with another embedding model: its vectors cannot be compared with the new ones
+	// ON_MODEL_MISMATCH: "refuse" (default, stop the server) or "reindex" (create a new store from the documents)
+	var modelMismatch *rag.ModelMismatchError
+	if errors.As(err, &modelMismatch) {
+		if os.Getenv("ON_MODEL_MISMATCH") != "reindex" {
+			log.Fatalln("😡", modelMismatch, "(set ON_MODEL_MISMATCH=reindex to re-create the vector store)")
+		}
+		log.Println("♻️", modelMismatch, "-> re-indexing the documents.")
+		err = os.ErrNotExist
+	}
+
 	if err != nil {
 		if os.IsNotExist(err) {
 			log.Println("🚀 No existing vector store found, starting fresh.")
@@ -73,37 +340,26 @@ func main() {
 			// =================================================
 			// CHUNKS:
 			// =================================================
-			contents, err := helpers.GetContentFiles(documentsPath, ".md")
-			if err != nil {
-				log.Fatalln("😡 Error getting content files:", err)
-			}
-			chunks := []string{}
-			fmt.Println("💡 Found", len(contents), "content files to process.")
-			//fmt.Println("📂 Processing content files...", contents)
+			// The chunks are saved with metadata: source document, format, language of the code, header level
+			chunks := []rag.VectorRecord{}
 			fmt.Println("📝 Processing(Chunking) content files...")
 
-			chunkSize := os.Getenv("CHUNK_SIZE")
-			if chunkSize == "" {
-				chunkSize = "1024"
-			}
-			chunkOverlap := os.Getenv("CHUNK_OVERLAP")
-			if chunkOverlap == "" {
-				chunkOverlap = "256"
-			}
-			chunkSizeInt, err := strconv.Atoi(chunkSize)
-			if err != nil {
-				log.Fatalln("😡 Error converting chunk size to int:", err)
-			}
-			chunkOverlapInt, err := strconv.Atoi(chunkOverlap)
-			if err != nil {
-				log.Fatalln("😡 Error converting chunk overlap to int:", err)
-			}
-
-			for _, content := range contents {
-				chunks = append(chunks, rag.ChunkText(content, chunkSizeInt, chunkOverlapInt)...)
+			for _, extension := range documentExtensions {
+				paths, err := helpers.FindFiles(documentsPath, extension)
+				if err != nil {
+					log.Fatalln("😡 Error getting content files:", err)
+				}
+				fmt.Println("💡 Found", len(paths), extension, "files to process.")
+				for _, path := range paths {
+					document, err := rag.LoadDocument(path)
+					if err != nil {
+						log.Println("⚠️ Skipping a file that cannot be loaded:", err)
+						continue
+					}
+					chunks = append(chunks, chunkDocument(sourceFromPath(path), document)...)
+				}
 				//chunks = append(chunks, rag.SplitTextWithDelimiter(content, "---")...)
 				//chunks = append(chunks, rag.ChunkWithMarkdownHierarchy(content)... )
-
 			}
 
 			// -------------------------------------------------
@@ -111,42 +367,217 @@ func main() {
 			// -------------------------------------------------
 			fmt.Println("⏳ Creating the embeddings...")
 
-			for idx, chunk := range chunks {
-				embeddingsResponse, err := client.Embeddings.New(ctx, openai.EmbeddingNewParams{
-					Input: openai.EmbeddingNewParamsInputUnion{
-						OfString: openai.String(chunk),
-					},
-					Model: embeddingsModel,
-				})
-
-				if err != nil {
-					fmt.Println(err)
-				} else {
-					_, errSave := store.Save(rag.VectorRecord{
-						Prompt:    chunk,
-						Embedding: embeddingsResponse.Data[0].Embedding,
-					})
-					if errSave != nil {
-						fmt.Println("😡:", errSave)
-					}
-					fmt.Println("✅ Chunk", idx, "saved with embedding:", len(embeddingsResponse.Data[0].Embedding))
+			report := embedChunks(ctx, chunks)
+			for _, chunk := range chunks {
+				if chunk.Embedding == nil {
+					continue
+				}
+				_, errSave := store.Save(chunk)
+				if errSave != nil {
+					fmt.Println("😡:", errSave)
+				}
+			}
+			fmt.Println("✅", report.Succeeded, "chunks embedded,", report.Cached, "of them from the cache,", report.Failed, "failed, on a total of", report.Total)
+			if report.Failed > 0 {
+				for _, errEmbedding := range report.Errors {
+					fmt.Println("😡:", errEmbedding)
+				}
+				// Do not persist a partial index: it would be loaded as is at the next start
+				if os.Getenv("ALLOW_PARTIAL_INDEX") != "true" {
+					log.Fatalln("😡", report.Failed, "chunks could not be embedded, the vector store is not saved (set ALLOW_PARTIAL_INDEX=true to keep it anyway)")
 				}
 			}
 
-			fmt.Println("✋", "Embeddings created, total of records", len(store.Records))
-			err = store.Persist(jsonStoreFilePath)
+			fmt.Println("✋", "Embeddings created, total of records", store.Count())
+			err = store.Persist(storeFilePath)
 			if err != nil {
 				log.Fatalln("😡 Error saving vector store:", err)
 			}
-			fmt.Println("✅ Vector store saved to", jsonStoreFilePath)
-			fmt.Println("💾 Vector store initialized with", len(store.Records), "records.")
+			fmt.Println("✅ Vector store saved to", storeFilePath)
+			persistEmbeddingCache()
+			flushEmbeddingFixtures()
+			fmt.Println("💾 Vector store initialized with", store.Count(), "records.")
 			fmt.Println()
 
 		} else {
 			log.Fatalln("Error loading vector store:", err)
 		}
 	} else {
-		log.Println("Vector store loaded successfully, total records:", len(store.Records))
+		log.Println("Vector store loaded successfully, total records:", store.Count())
+
+		// Stores created before the metadata were recorded: extract what can be read from the chunks
+		updated, err := rag.BackfillMetadata(store)
+		if err != nil {
+			log.Fatalln("😡 Error adding metadata to the vector store:", err)
+		}
+		if updated > 0 {
+			if err := store.Persist(storeFilePath); err != nil {
+				log.Fatalln("😡 Error saving vector store:", err)
+			}
+			log.Println("🏷️ Metadata added to", updated, "records.")
+		}
+	}
+
+	// JSON_EXPORT_FILE_PATH: write a JSON copy of the vector store (to debug it)
+	if jsonExportFilePath := os.Getenv("JSON_EXPORT_FILE_PATH"); jsonExportFilePath != "" {
+		if err := store.ExportJSON(jsonExportFilePath); err != nil {
+			log.Fatalln("😡 Error exporting the vector store to JSON:", err)
+		}
+		log.Println("📤 Vector store exported to", jsonExportFilePath)
+	}
+
+	// HNSW_RECALL_SAMPLES: compare the approximate search with the exact search on N records at startup
+	if hnswStore, ok := store.(*rag.HNSWVectorStore); ok {
+		if samples := getIntEnv("HNSW_RECALL_SAMPLES", 0); samples > 0 {
+			log.Printf("🕸️ HNSW index recall@10 estimated on %d records: %.3f", samples, hnswStore.EstimateRecall(samples, 10))
+		}
+	}
+
+	// -------------------------------------------------
+	// Create the keyword index (BM25) next to the vector store
+	// -------------------------------------------------
+	keywordIndex = rag.NewBM25Index()
+	allRecords, err := store.GetAll()
+	if err != nil {
+		log.Fatalln("😡 Error reading the vector store:", err)
+	}
+	for _, record := range allRecords {
+		keywordIndex.Add(record.Id, record.Prompt)
+	}
+	log.Println("🔑 Keyword index created, total of documents:", keywordIndex.Count())
+
+	// SEARCH_MODE: "vector" (default), "keyword" or "hybrid"
+	defaultSearchMode = os.Getenv("SEARCH_MODE")
+	if defaultSearchMode == "" {
+		defaultSearchMode = rag.SearchModeVector
+	}
+	if defaultSearchMode != rag.SearchModeVector && defaultSearchMode != rag.SearchModeKeyword && defaultSearchMode != rag.SearchModeHybrid {
+		log.Fatalln("😡 Unknown search mode:", defaultSearchMode)
+	}
+	// HYBRID_VECTOR_WEIGHT: weight of the vector ranking in the hybrid mode (the keyword ranking weighs 1 - weight)
+	hybridVectorWeight = 0.5
+	if strWeight := os.Getenv("HYBRID_VECTOR_WEIGHT"); strWeight != "" {
+		hybridVectorWeight, err = strconv.ParseFloat(strWeight, 64)
+		if err != nil || hybridVectorWeight < 0 || hybridVectorWeight > 1 {
+			log.Fatalln("😡 HYBRID_VECTOR_WEIGHT must be a number between 0 and 1:", strWeight)
+		}
+	}
+
+	// -------------------------------------------------
+	// Retrieval parameters (the tool arguments can override them, within the bounds)
+	// -------------------------------------------------
+	// LIMIT: default minimum cosine similarity of the results
+	defaultLimit = getFloatEnv("LIMIT", 0.6)
+	// MIN_SIMILARITY_FLOOR: lowest min_similarity a caller can ask for
+	minSimilarityFloor = getFloatEnv("MIN_SIMILARITY_FLOOR", 0)
+	if minSimilarityFloor < -1 || minSimilarityFloor > 1 || defaultLimit < minSimilarityFloor || defaultLimit > 1 {
+		log.Fatalln("😡 LIMIT and MIN_SIMILARITY_FLOOR must be between -1 and 1, with MIN_SIMILARITY_FLOOR <= LIMIT")
+	}
+	// MAX_RESULTS: default number of results
+	defaultMaxResults = getIntEnv("MAX_RESULTS", 2)
+	// MAX_RESULTS_CEILING: highest max_results a caller can ask for
+	maxResultsCeiling = getIntEnv("MAX_RESULTS_CEILING", max(20, defaultMaxResults))
+	if defaultMaxResults < 1 || maxResultsCeiling < defaultMaxResults {
+		log.Fatalln("😡 MAX_RESULTS must be at least 1 and MAX_RESULTS_CEILING at least MAX_RESULTS")
+	}
+
+	// RESULT_SELECTION: "top" (the most relevant results, default) or "mmr" (maximal marginal relevance, no near duplicates)
+	defaultSelection = os.Getenv("RESULT_SELECTION")
+	if defaultSelection == "" {
+		defaultSelection = rag.SelectionTopN
+	}
+	if defaultSelection != rag.SelectionTopN && defaultSelection != rag.SelectionMMR {
+		log.Fatalln("😡 Unknown result selection:", defaultSelection)
+	}
+	// MMR_LAMBDA: trade-off between relevance (1) and diversity (0) of the "mmr" selection
+	defaultMMRLambda = rag.DefaultMMRLambda
+	if strLambda := os.Getenv("MMR_LAMBDA"); strLambda != "" {
+		defaultMMRLambda, err = strconv.ParseFloat(strLambda, 64)
+		if err != nil || defaultMMRLambda < 0 || defaultMMRLambda > 1 {
+			log.Fatalln("😡 MMR_LAMBDA must be a number between 0 and 1:", strLambda)
+		}
+	}
+
+	// -------------------------------------------------
+	// Reranking stage (optional)
+	// -------------------------------------------------
+	// RERANKER: "none" (default), "endpoint" (cross-encoder behind a /rerank endpoint) or "llm" (grades from a chat model)
+	rerankModel := os.Getenv("RERANK_MODEL")
+	switch rerankerKind := os.Getenv("RERANKER"); rerankerKind {
+	case "", "none":
+	case "endpoint":
+		rerankBaseURL := os.Getenv("RERANK_BASE_URL")
+		if rerankBaseURL == "" {
+			rerankBaseURL = llmURL
+		}
+		// RERANK_FORMAT: "openai" (llama.cpp, vLLM, Jina, Cohere; default) or "tei" (Text Embeddings Inference)
+		reranker = &rag.EndpointReranker{
+			BaseURL: rerankBaseURL,
+			Model:   rerankModel,
+			Format:  os.Getenv("RERANK_FORMAT"),
+		}
+	case "llm":
+		if rerankModel == "" {
+			log.Fatalln("😡 RERANK_MODEL (a chat model) is required with RERANKER=llm")
+		}
+		reranker = &rag.LLMReranker{
+			Client: client,
+			Model:  rerankModel,
+		}
+	default:
+		log.Fatalln("😡 Unknown reranker:", rerankerKind)
+	}
+	// RERANK_CANDIDATES: number of search results given to the reranker (the best MAX_RESULTS are kept)
+	rerankCandidates = getIntEnv("RERANK_CANDIDATES", 10)
+	if reranker != nil {
+		log.Println("🥇 Reranking", rerankCandidates, "candidates with", os.Getenv("RERANKER"), rerankModel)
+	}
+
+	// -------------------------------------------------
+	// Query expansion (optional)
+	// -------------------------------------------------
+	// QUERY_EXPANSION: "none" (default), "multi-query" (paraphrases of the question) or "hyde" (hypothetical answer)
+	defaultQueryExpansion = os.Getenv("QUERY_EXPANSION")
+	if defaultQueryExpansion == "" {
+		defaultQueryExpansion = rag.QueryExpansionNone
+	}
+	switch defaultQueryExpansion {
+	case rag.QueryExpansionNone, rag.QueryExpansionMultiQuery, rag.QueryExpansionHyDE:
+	default:
+		log.Fatalln("😡 Unknown query expansion:", defaultQueryExpansion)
+	}
+	// QUERY_EXPANSION_MODEL: the chat model that rewrites the questions
+	if queryExpansionModel := os.Getenv("QUERY_EXPANSION_MODEL"); queryExpansionModel != "" {
+		queryRewriter = &rag.QueryRewriter{
+			Client:      client,
+			Model:       queryExpansionModel,
+			Paraphrases: getIntEnv("QUERY_PARAPHRASES", 3),
+		}
+		log.Println("🔀 Query expansion:", defaultQueryExpansion, "with", queryExpansionModel)
+	} else if defaultQueryExpansion != rag.QueryExpansionNone {
+		log.Fatalln("😡 QUERY_EXPANSION_MODEL (a chat model) is required with QUERY_EXPANSION=" + defaultQueryExpansion)
+	}
+
+	// -------------------------------------------------
+	// Answer generation (optional)
+	// -------------------------------------------------
+	// RESPONSE_MODE: "documents" (the chunks found, default) or "answer" (an answer of a chat model citing the chunks)
+	defaultResponseMode = os.Getenv("RESPONSE_MODE")
+	if defaultResponseMode == "" {
+		defaultResponseMode = rag.ResponseModeDocuments
+	}
+	if defaultResponseMode != rag.ResponseModeDocuments && defaultResponseMode != rag.ResponseModeAnswer {
+		log.Fatalln("😡 Unknown response mode:", defaultResponseMode)
+	}
+	// ANSWER_MODEL: the chat model that answers the questions with the chunks found
+	if answerModel := os.Getenv("ANSWER_MODEL"); answerModel != "" {
+		answerer = &rag.Answerer{
+			Client: client,
+			Model:  answerModel,
+		}
+		log.Println("💬 Answers with", answerModel, "(default response mode:", defaultResponseMode+")")
+	} else if defaultResponseMode == rag.ResponseModeAnswer {
+		log.Fatalln("😡 ANSWER_MODEL (a chat model) is required with RESPONSE_MODE=" + defaultResponseMode)
 	}
 
 	// =================================================
@@ -158,9 +589,116 @@ func main() {
 			mcp.Required(),
 			mcp.Description("Search question"),
 		),
+		mcp.WithString("search_mode",
+			mcp.Description("Search mode: 'vector' (semantic similarity), 'keyword' (exact terms such as function names or error codes) or 'hybrid' (both). Defaults to the server setting."),
+			mcp.Enum(rag.SearchModeVector, rag.SearchModeKeyword, rag.SearchModeHybrid),
+		),
+		mcp.WithNumber("max_results",
+			mcp.Description("Maximum number of results (bounded by the server). Defaults to the server setting."),
+			mcp.Min(1),
+		),
+		mcp.WithNumber("min_similarity",
+			mcp.Description("Minimum cosine similarity of the results, between -1 and 1 (bounded by the server). It does not apply to the keyword matches of the 'keyword' and 'hybrid' modes. Defaults to the server setting."),
+			mcp.Max(1),
+		),
+		mcp.WithBoolean("include_scores",
+			mcp.Description("Add the score and the cosine similarity of every result to the response."),
+		),
+		mcp.WithString("selection",
+			mcp.Description("Result selection: 'top' (the most relevant results) or 'mmr' (relevant results that do not repeat each other). Defaults to the server setting."),
+			mcp.Enum(rag.SelectionTopN, rag.SelectionMMR),
+		),
+		mcp.WithNumber("mmr_lambda",
+			mcp.Description("Trade-off of the 'mmr' selection between relevance (1) and diversity (0). Defaults to the server setting."),
+			mcp.Min(0),
+			mcp.Max(1),
+		),
+		mcp.WithBoolean("rerank",
+			mcp.Description("Rerank the search results with the reranker of the server (more precise, slower). Defaults to true when a reranker is configured."),
+		),
+		mcp.WithString("query_expansion",
+			mcp.Description("Also search with rewrites of the question: 'none', 'multi-query' (paraphrases) or 'hyde' (a hypothetical answer). Requires a query expansion model on the server. Defaults to the server setting."),
+			mcp.Enum(rag.QueryExpansionNone, rag.QueryExpansionMultiQuery, rag.QueryExpansionHyDE),
+		),
+		mcp.WithString("response_mode",
+			mcp.Description("Response: 'documents' (the chunks found) or 'answer' (a short answer written from the chunks found, citing them, or 'Not found'). The answer mode requires an answer model on the server. Defaults to the server setting."),
+			mcp.Enum(rag.ResponseModeDocuments, rag.ResponseModeAnswer),
+		),
+		mcp.WithString("path_prefix",
+			mcp.Description("Only search the documents whose path (relative to the documents directory) starts with this prefix, ex: 'guides/'"),
+		),
+		mcp.WithString("filter",
+			mcp.Description("Filter on the metadata of the chunks: conditions separated by AND, ex: 'language=rust AND header_level<=2'. Keys: source, language, tags, header_level. Operators: = != ^= (starts with) ~= (tag) <= >="),
+		),
 	)
 	s.AddTool(searchInDoc, searchInDocHandler)
 
+	addDocument := mcp.NewTool("add_document",
+		mcp.WithDescription(`Add a document to the internal database, from its text or from a file of the documents directory. A document with the same source is replaced.`),
+		mcp.WithString("source",
+			mcp.Required(),
+			mcp.Description("Identifier of the document, ex: 'notes/deployment.md'. Use the extension of a source file (.go, .rs, .swift) to chunk it as code."),
+		),
+		mcp.WithString("content",
+			mcp.Description("Text of the document (markdown). Required when path is not set."),
+		),
+		mcp.WithString("path",
+			mcp.Description("Path of a file to read instead of content, relative to the documents directory."),
+		),
+		mcp.WithObject("metadata",
+			mcp.Description("Metadata added to every chunk of the document, ex: {\"tags\": \"ops,docker\"}"),
+		),
+	)
+	s.AddTool(addDocument, addDocumentHandler)
+
+	listSources := mcp.NewTool("list_sources",
+		mcp.WithDescription(`List the documents of the internal database with their number of chunks.`),
+	)
+	s.AddTool(listSources, listSourcesHandler)
+
+	deleteDocument := mcp.NewTool("delete_document",
+		mcp.WithDescription(`Remove a document (all its chunks) from the internal database.`),
+		mcp.WithString("source",
+			mcp.Required(),
+			mcp.Description("Identifier of the document, as returned by list_sources."),
+		),
+	)
+	s.AddTool(deleteDocument, deleteDocumentHandler)
+
+	// -------------------------------------------------
+	// Resources: the documents of the database, to read the whole document of a chunk
+	// -------------------------------------------------
+	s.AddResourceTemplate(mcp.NewResourceTemplate(rag.SourceURIPrefix+"{+path}", "Document",
+		mcp.WithTemplateDescription("A document of the internal database, by its source (as returned by list_sources)"),
+	), readSourceHandler)
+	sources, err := rag.ListSources(store)
+	if err != nil {
+		log.Fatalln("😡 Error reading the vector store:", err)
+	}
+	published := 0
+	for _, source := range sources {
+		if source.Source != "" {
+			s.AddResource(sourceResource(source.Source), readSourceHandler)
+			published++
+		}
+	}
+	log.Println("📚 Documents published as resources:", published)
+
+	// -------------------------------------------------
+	// Prompts: for the clients without tool calling
+	// -------------------------------------------------
+	answerWithCitations := mcp.NewPrompt("answer_with_citations",
+		mcp.WithPromptDescription("Answer a question with the documents of the knowledge base, citing them. The prompt contains the chunks found for the question."),
+		mcp.WithArgument("question",
+			mcp.RequiredArgument(),
+			mcp.ArgumentDescription("Question to answer"),
+		),
+		mcp.WithArgument("max_results",
+			mcp.ArgumentDescription("Maximum number of chunks in the prompt. Defaults to the server setting."),
+		),
+	)
+	s.AddPrompt(answerWithCitations, answerWithCitationsPromptHandler)
+
 	// Start the HTTP server
 	httpPort := os.Getenv("MCP_HTTP_PORT")
 	fmt.Println("🌍 MCP HTTP Port:", httpPort)
@@ -191,7 +729,31 @@ func main() {
 func searchInDocHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 
 	args := request.GetArguments()
-	userQuestion := args["search_question"].(string)
+	questionArg, exists := args["search_question"]
+	if !exists || questionArg == nil {
+		return mcp.NewToolResultError("Missing required parameter 'search_question'"), nil
+	}
+	userQuestion, ok := questionArg.(string)
+	if !ok {
+		return mcp.NewToolResultError("Parameter 'search_question' must be a string"), nil
+	}
+
+	// Retrieval parameters: the server defaults, within the server bounds
+	maxResults := defaultMaxResults
+	if maxArg, ok := args["max_results"].(float64); ok {
+		if maxArg < 1 || maxArg != math.Trunc(maxArg) {
+			return mcp.NewToolResultError("max_results must be a positive integer"), nil
+		}
+		maxResults = min(int(maxArg), maxResultsCeiling)
+	}
+	limit := defaultLimit
+	if similarityArg, ok := args["min_similarity"].(float64); ok {
+		if similarityArg > 1 {
+			return mcp.NewToolResultError("min_similarity must be between -1 and 1"), nil
+		}
+		limit = max(similarityArg, minSimilarityFloor)
+	}
+	includeScores, _ := args["include_scores"].(bool)
 
 	fmt.Println("🔍 Searching for question:", userQuestion)
 
@@ -201,49 +763,210 @@ func searchInDocHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.
 
 	fmt.Println("⏳ Searching for similarities...")
 
+	var err error
+
+	searchMode := defaultSearchMode
+	if modeArg, exists := args["search_mode"]; exists && modeArg != nil {
+		if mode, ok := modeArg.(string); ok && mode != "" {
+			searchMode = mode
+		}
+	}
+	if searchMode != rag.SearchModeVector && searchMode != rag.SearchModeKeyword && searchMode != rag.SearchModeHybrid {
+		return mcp.NewToolResultError(fmt.Sprintf("Unknown search mode %q (expected %s, %s or %s)", searchMode, rag.SearchModeVector, rag.SearchModeKeyword, rag.SearchModeHybrid)), nil
+	}
+
+	filter := rag.Filter{}
+	if filterArg, ok := args["filter"].(string); ok {
+		filter, err = rag.ParseFilter(filterArg)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Invalid filter: %v", err)), nil
+		}
+	}
+	if pathPrefix, ok := args["path_prefix"].(string); ok && pathPrefix != "" {
+		filter = append(filter, rag.Condition{Key: rag.MetadataSource, Operator: rag.OperatorPrefix, Value: pathPrefix})
+	}
+
+	selection := defaultSelection
+	if selectionArg, ok := args["selection"].(string); ok && selectionArg != "" {
+		if selectionArg != rag.SelectionTopN && selectionArg != rag.SelectionMMR {
+			return mcp.NewToolResultError(fmt.Sprintf("Unknown selection %q (expected %s or %s)", selectionArg, rag.SelectionTopN, rag.SelectionMMR)), nil
+		}
+		selection = selectionArg
+	}
+	mmrLambda := defaultMMRLambda
+	if lambdaArg, ok := args["mmr_lambda"].(float64); ok {
+		if lambdaArg < 0 || lambdaArg > 1 {
+			return mcp.NewToolResultError("mmr_lambda must be between 0 and 1"), nil
+		}
+		mmrLambda = lambdaArg
+	}
+
+	rerank := reranker != nil
+	if rerankArg, ok := args["rerank"].(bool); ok {
+		if rerankArg && reranker == nil {
+			return mcp.NewToolResultError("No reranker is configured on the server (see RERANKER)"), nil
+		}
+		rerank = rerankArg
+	}
+	// The reranker picks the best results among more candidates
+	searchMaxResults := maxResults
+	if rerank {
+		searchMaxResults = max(rerankCandidates, maxResults)
+	}
+
+	queryExpansion := defaultQueryExpansion
+	if expansionArg, ok := args["query_expansion"].(string); ok && expansionArg != "" {
+		switch {
+		case expansionArg != rag.QueryExpansionNone && expansionArg != rag.QueryExpansionMultiQuery && expansionArg != rag.QueryExpansionHyDE:
+			return mcp.NewToolResultError(fmt.Sprintf("Unknown query expansion %q (expected %s, %s or %s)", expansionArg, rag.QueryExpansionNone, rag.QueryExpansionMultiQuery, rag.QueryExpansionHyDE)), nil
+		case expansionArg != rag.QueryExpansionNone && queryRewriter == nil:
+			return mcp.NewToolResultError("No query expansion model is configured on the server (see QUERY_EXPANSION_MODEL)"), nil
+		}
+		queryExpansion = expansionArg
+	}
+
+	responseMode := defaultResponseMode
+	if responseArg, ok := args["response_mode"].(string); ok && responseArg != "" {
+		switch {
+		case responseArg != rag.ResponseModeDocuments && responseArg != rag.ResponseModeAnswer:
+			return mcp.NewToolResultError(fmt.Sprintf("Unknown response mode %q (expected %s or %s)", responseArg, rag.ResponseModeDocuments, rag.ResponseModeAnswer)), nil
+		case responseArg == rag.ResponseModeAnswer && answerer == nil:
+			return mcp.NewToolResultError("No answer model is configured on the server (see ANSWER_MODEL)"), nil
+		}
+		responseMode = responseArg
+	}
+
 	// -------------------------------------------------
 	// Create embedding from the user question
 	// -------------------------------------------------
-	embeddingsResponse, err := client.Embeddings.New(ctx, openai.EmbeddingNewParams{
-		Input: openai.EmbeddingNewParamsInputUnion{
-			OfString: openai.String(userQuestion),
-		},
-		Model: embeddingsModel,
-	})
-	if err != nil {
-		log.Fatal("😡:", err)
+	// (from the embedding cache when the question was already asked)
+	// The keyword mode only searches the text of the question: it does not call the embeddings model
+	var questionEmbedding []float64
+	if searchMode != rag.SearchModeKeyword {
+		questionEmbeddings, report := rag.CreateEmbeddings(ctx, embedder, []string{userQuestion}, embeddingOptions)
+		if report.Failed > 0 {
+			// The model runner may be back at the next question: report the error, do not stop the server
+			log.Println("😡 Error creating the embedding of the question:", report.Errors[0])
+			return mcp.NewToolResultError(fmt.Sprintf("The question could not be embedded, try again later: %v", report.Errors[0])), nil
+		}
+		questionEmbedding = questionEmbeddings[0]
 	}
 
 	// -------------------------------------------------
 	// Create a vector record from the user embedding
 	// -------------------------------------------------
 	embeddingFromUserQuestion := rag.VectorRecord{
-		Embedding: embeddingsResponse.Data[0].Embedding,
+		Embedding: questionEmbedding,
+	}
+
+	// -------------------------------------------------
+	// Rewrite the question (the question is always the first sub-query)
+	// -------------------------------------------------
+	subQueries := []rag.SubQuery{{Kind: "question", Query: userQuestion}}
+	subQueryEmbeddings := [][]float64{embeddingFromUserQuestion.Embedding}
+	if queryExpansion != rag.QueryExpansionNone {
+		subQueries, err = queryRewriter.Expand(ctx, queryExpansion, userQuestion)
+		if err != nil {
+			// The question alone still gives results
+			log.Println("⚠️ Query expansion failed, searching with the question only:", err)
+		}
+		rewrites := make([]string, 0, len(subQueries)-1)
+		for _, subQuery := range subQueries[1:] {
+			rewrites = append(rewrites, subQuery.Query)
+		}
+		switch {
+		case len(rewrites) > 0 && searchMode == rag.SearchModeKeyword:
+			subQueryEmbeddings = append(subQueryEmbeddings, make([][]float64, len(rewrites))...)
+		case len(rewrites) > 0:
+			rewriteEmbeddings, report := rag.CreateEmbeddings(ctx, embedder, rewrites, embeddingOptions)
+			if report.Failed > 0 {
+				log.Println("⚠️", report.Failed, "sub-queries could not be embedded and are skipped:", report.Errors)
+			}
+			subQueryEmbeddings = append(subQueryEmbeddings, rewriteEmbeddings...)
+		}
 	}
 
-	strLimit := os.Getenv("LIMIT")
-	if strLimit == "" {
-		strLimit = "0.6"
+	// -------------------------------------------------
+	// Search with every sub-query and merge the results
+	// -------------------------------------------------
+	subQueryResults := make([][]rag.VectorRecord, len(subQueries))
+	storeMutex.RLock()
+	for idx, subQuery := range subQueries {
+		// A sub-query that could not be embedded is skipped (the keyword mode does not use the embeddings)
+		if subQueryEmbeddings[idx] == nil && searchMode != rag.SearchModeKeyword {
+			continue
+		}
+		subQueryResults[idx], err = rag.HybridSearch(store, keywordIndex, subQuery.Query, rag.VectorRecord{Embedding: subQueryEmbeddings[idx]}, rag.SearchOptions{
+			Mode:         searchMode,
+			Limit:        limit,
+			MaxResults:   searchMaxResults,
+			VectorWeight: hybridVectorWeight,
+			Filter:       filter,
+			Selection:    selection,
+			MMRLambda:    mmrLambda,
+		})
+		if err != nil {
+			break
+		}
 	}
-	strMax := os.Getenv("MAX_RESULTS")
-	if strMax == "" {
-		strMax = "2"
+	storeMutex.RUnlock()
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Error searching the documents: %v", err)), nil
 	}
-	// Convert string to float64 and int
-	var limit float64
-	fmt.Sscanf(strLimit, "%f", &limit)
-	var maxResults int
-	fmt.Sscanf(strMax, "%d", &maxResults)
 
-	similarities, _ := store.SearchTopNSimilarities(embeddingFromUserQuestion, limit, maxResults)
+	similarities := subQueryResults[0]
+	var subQueryHits map[string][]int
+	if len(subQueries) > 1 {
+		similarities, subQueryHits = rag.MergeSubQueryResults(subQueryResults, searchMaxResults)
+		for idx, subQuery := range subQueries {
+			fmt.Printf("🔀 Sub-query %d (%s): %d results: %s\n", idx+1, subQuery.Kind, len(subQueryResults[idx]), subQuery.Query)
+		}
+	}
+
+	if rerank {
+		reranked, err := rag.Rerank(ctx, reranker, userQuestion, similarities, maxResults)
+		if err != nil {
+			// Better results without reranking than no result at all
+			log.Println("⚠️ Reranking failed, the search results are not reranked:", err)
+			similarities = similarities[:min(len(similarities), maxResults)]
+		} else {
+			similarities = reranked
+		}
+	}
+
+	if responseMode == rag.ResponseModeAnswer {
+		fmt.Println("💬 Answering with", len(similarities), "records...")
+		answer, err := answerer.Answer(ctx, userQuestion, similarities)
+		if err == nil {
+			fmt.Println("✅ Answer:", answer)
+			fmt.Println()
+			return mcp.NewToolResultText(formatAnswer(answer, similarities, includeScores)), nil
+		}
+		// The documents still help the client to answer
+		log.Println("⚠️ The answer could not be generated, the documents are returned:", err)
+	}
 
 	documentsContent := "Documents:\n"
 
-	for _, similarity := range similarities {
-		fmt.Println("✅ CosineSimilarity:", similarity.CosineSimilarity, "Chunk:", similarity.Prompt)
+	for idx, similarity := range similarities {
+		fmt.Println("✅ Score:", similarity.Score, "CosineSimilarity:", similarity.CosineSimilarity, "Chunk:", similarity.Prompt)
+		if includeScores {
+			documentsContent += fmt.Sprintf("\n[Document %d - score: %.4f, cosine similarity: %.4f", idx+1, similarity.Score, similarity.CosineSimilarity)
+			if subQueryHits != nil {
+				documentsContent += fmt.Sprintf(", sub-queries: %s", formatSubQueryHits(subQueryHits[similarity.Id]))
+			}
+			documentsContent += "]\n"
+		}
 		documentsContent += similarity.Prompt
 	}
 	documentsContent += "\n"
+	if includeScores && subQueryHits != nil {
+		// Which rewrites of the question found something, to debug the retrieval
+		documentsContent += "\nSub-queries:\n"
+		for idx, subQuery := range subQueries {
+			documentsContent += fmt.Sprintf("%d. (%s, %d results) %s\n", idx+1, subQuery.Kind, len(subQueryResults[idx]), subQuery.Query)
+		}
+	}
 	fmt.Println("✋", "Similarities found, total of records", len(similarities))
 	fmt.Println()
 
@@ -254,11 +977,398 @@ func searchInDocHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.
 	return mcp.NewToolResultText(documentsContent), nil
 }
 
+// formatAnswer returns the answer followed by the sources of the records it cites, ex: "[1] rag://source/notes/deployment.md (record 4f2c...)".
+func formatAnswer(answer string, records []rag.VectorRecord, includeScores bool) string {
+	cited := rag.CitedRecords(answer, records)
+	if len(cited) == 0 {
+		return answer
+	}
+	content := answer + "\n\nSources:\n"
+	for _, idx := range cited {
+		record := records[idx]
+		content += fmt.Sprintf("[%d] %s", idx+1, rag.CitationLabel(record))
+		if record.Metadata[rag.MetadataSource] != "" {
+			content += fmt.Sprintf(" (record %s)", record.Id)
+		}
+		if includeScores {
+			content += fmt.Sprintf(" - score: %.4f, cosine similarity: %.4f", record.Score, record.CosineSimilarity)
+		}
+		content += "\n"
+	}
+	return content
+}
+
+// formatSubQueryHits returns the numbers of the sub-queries, ex: "1, 3".
+func formatSubQueryHits(hits []int) string {
+	numbers := make([]string, len(hits))
+	for idx, hit := range hits {
+		numbers[idx] = strconv.Itoa(hit + 1)
+	}
+	return strings.Join(numbers, ", ")
+}
+
+func addDocumentHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	args := request.GetArguments()
+	source, ok := args["source"].(string)
+	if !ok || strings.TrimSpace(source) == "" {
+		return mcp.NewToolResultError("Missing required parameter 'source'"), nil
+	}
+	content, _ := args["content"].(string)
+	path, _ := args["path"].(string)
+	if (content == "") == (path == "") {
+		return mcp.NewToolResultError("Set either the content or the path of the document"), nil
+	}
+
+	// The document is read by the loader of the extension of the source (or of the path)
+	format := source
+	if path != "" {
+		// Only the files of the documents directory can be read
+		if !filepath.IsLocal(path) {
+			return mcp.NewToolResultError(fmt.Sprintf("The path %s must be relative to the documents directory", path)), nil
+		}
+		var err error
+		content, err = helpers.ReadTextFile(filepath.Join(documentsPath, path))
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Error reading %s: %v", path, err)), nil
+		}
+		if !rag.HasLoader(filepath.Ext(source)) {
+			format = path
+		}
+	}
+	document, err := rag.ParseDocument(format, []byte(content))
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Error reading the document: %v", err)), nil
+	}
+
+	chunks := chunkDocument(source, document)
+	if len(chunks) == 0 {
+		return mcp.NewToolResultError("The document is empty"), nil
+	}
+	if metadataArg, ok := args["metadata"].(map[string]any); ok {
+		for key, value := range metadataArg {
+			if key == rag.MetadataSource {
+				continue
+			}
+			for idx := range chunks {
+				chunks[idx].Metadata[key] = metadataValue(value)
+			}
+		}
+	}
+
+	fmt.Println("📥 Adding the document", source, "with", len(chunks), "chunks...")
+	report := embedChunks(ctx, chunks)
+	if report.Failed > 0 {
+		return mcp.NewToolResultError(fmt.Sprintf("%d of %d chunks could not be embedded, the document is not added: %v", report.Failed, report.Total, errors.Join(report.Errors...))), nil
+	}
+
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	previousIDs, err := rag.SourceRecordIDs(store, source)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Error reading the vector store: %v", err)), nil
+	}
+	savedIDs := []string{}
+	for _, chunk := range chunks {
+		saved, err := store.Save(chunk)
+		if err != nil {
+			// Keep the previous version of the document
+			for _, id := range savedIDs {
+				store.Delete(id)
+				keywordIndex.Remove(id)
+			}
+			return mcp.NewToolResultError(fmt.Sprintf("Error saving the document: %v", err)), nil
+		}
+		keywordIndex.Add(saved.Id, saved.Prompt)
+		savedIDs = append(savedIDs, saved.Id)
+	}
+	for _, id := range previousIDs {
+		store.Delete(id)
+		keywordIndex.Remove(id)
+	}
+	if err := store.Persist(storeFilePath); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("The document is added but the vector store could not be saved: %v", err)), nil
+	}
+	persistEmbeddingCache()
+	flushEmbeddingFixtures()
+	mcpServer.AddResource(sourceResource(source), readSourceHandler)
+
+	message := fmt.Sprintf("Document %s added: %d chunks.", source, len(chunks))
+	if len(previousIDs) > 0 {
+		message = fmt.Sprintf("Document %s replaced: %d chunks (previously %d).", source, len(chunks), len(previousIDs))
+	}
+	fmt.Println("✅", message)
+	return mcp.NewToolResultText(message), nil
+}
+
+func listSourcesHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	storeMutex.RLock()
+	sources, err := rag.ListSources(store)
+	storeMutex.RUnlock()
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Error reading the vector store: %v", err)), nil
+	}
+
+	content := fmt.Sprintf("Documents (%d):\n", len(sources))
+	for _, source := range sources {
+		name := source.Source
+		if name == "" {
+			name = "(no source)"
+		}
+		content += fmt.Sprintf("- %s: %d chunks\n", name, source.Chunks)
+	}
+	return mcp.NewToolResultText(content), nil
+}
+
+func deleteDocumentHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	args := request.GetArguments()
+	source, ok := args["source"].(string)
+	if !ok || strings.TrimSpace(source) == "" {
+		return mcp.NewToolResultError("Missing required parameter 'source'"), nil
+	}
+
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	deletedIDs, err := rag.DeleteSource(store, source)
+	for _, id := range deletedIDs {
+		keywordIndex.Remove(id)
+	}
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Error deleting the document: %v", err)), nil
+	}
+	if len(deletedIDs) == 0 {
+		return mcp.NewToolResultError(fmt.Sprintf("No document with the source %s (see list_sources)", source)), nil
+	}
+	mcpServer.RemoveResource(rag.SourceURI(source))
+	if err := store.Persist(storeFilePath); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("The document is deleted but the vector store could not be saved: %v", err)), nil
+	}
+
+	message := fmt.Sprintf("Document %s deleted: %d chunks.", source, len(deletedIDs))
+	fmt.Println("🗑️", message)
+	return mcp.NewToolResultText(message), nil
+}
+
+// sourceResource returns the MCP resource of a document of the database (see readSourceHandler).
+func sourceResource(source string) mcp.Resource {
+	return mcp.NewResource(rag.SourceURI(source), source,
+		mcp.WithResourceDescription(fmt.Sprintf("Document %s of the internal database", source)),
+		mcp.WithMIMEType(sourceMIMEType(source)),
+	)
+}
+
+// sourceMIMEType returns the MIME type of the text of a document (the loaders convert the other formats to text).
+func sourceMIMEType(source string) string {
+	switch strings.ToLower(filepath.Ext(source)) {
+	case ".md", ".markdown":
+		return "text/markdown"
+	}
+	return "text/plain"
+}
+
+// readSourceHandler returns the whole text of a document: the text of its file in the documents directory,
+// or its chunks put back together (for the documents added with their content).
+func readSourceHandler(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+	source, ok := rag.SourceFromURI(request.Params.URI)
+	if !ok {
+		return nil, fmt.Errorf("invalid document URI %s", request.Params.URI)
+	}
+
+	storeMutex.RLock()
+	text, found, err := rag.SourceText(store, source, "\n\n")
+	storeMutex.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("reading the vector store: %w", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("no document with the source %s (see list_sources)", source)
+	}
+	// The file has the text without the overlaps of the chunks
+	if filepath.IsLocal(source) {
+		if content, err := os.ReadFile(filepath.Join(documentsPath, source)); err == nil {
+			if document, err := rag.ParseDocument(source, content); err == nil {
+				text = document.Text
+			}
+		}
+	}
+
+	return []mcp.ResourceContents{
+		mcp.TextResourceContents{
+			URI:      request.Params.URI,
+			MIMEType: sourceMIMEType(source),
+			Text:     text,
+		},
+	}, nil
+}
+
+func answerWithCitationsPromptHandler(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+	question := strings.TrimSpace(request.Params.Arguments["question"])
+	if question == "" {
+		return nil, fmt.Errorf("missing required parameter 'question'")
+	}
+	maxResults := defaultMaxResults
+	if maxArg := request.Params.Arguments["max_results"]; maxArg != "" {
+		number, err := strconv.Atoi(maxArg)
+		if err != nil || number < 1 {
+			return nil, fmt.Errorf("parameter 'max_results' must be a positive integer")
+		}
+		maxResults = min(number, maxResultsCeiling)
+	}
+
+	fmt.Println("💬 Prompt with citations for question:", question)
+	similarities, err := searchKnowledgeBase(ctx, question, maxResults)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("✋", "Documents in the prompt:", len(similarities))
+
+	return mcp.NewGetPromptResult(
+		fmt.Sprintf("Answer with citations of %d documents of the knowledge base", len(similarities)),
+		[]mcp.PromptMessage{
+			mcp.NewPromptMessage(mcp.RoleUser, mcp.NewTextContent(rag.AnswerWithCitationsPrompt(question, similarities))),
+		},
+	), nil
+}
+
+// searchKnowledgeBase searches the chunks of a question with the server settings (without query expansion),
+// reranked when a reranker is configured.
+func searchKnowledgeBase(ctx context.Context, question string, maxResults int) ([]rag.VectorRecord, error) {
+	// The keyword mode does not call the embeddings model
+	var questionEmbedding []float64
+	if defaultSearchMode != rag.SearchModeKeyword {
+		questionEmbeddings, report := rag.CreateEmbeddings(ctx, embedder, []string{question}, embeddingOptions)
+		if report.Failed > 0 {
+			return nil, fmt.Errorf("the question could not be embedded, try again later: %w", report.Errors[0])
+		}
+		questionEmbedding = questionEmbeddings[0]
+	}
+
+	searchMaxResults := maxResults
+	if reranker != nil {
+		searchMaxResults = max(rerankCandidates, maxResults)
+	}
+	storeMutex.RLock()
+	similarities, err := rag.HybridSearch(store, keywordIndex, question, rag.VectorRecord{Embedding: questionEmbedding}, rag.SearchOptions{
+		Mode:         defaultSearchMode,
+		Limit:        defaultLimit,
+		MaxResults:   searchMaxResults,
+		VectorWeight: hybridVectorWeight,
+		Selection:    defaultSelection,
+		MMRLambda:    defaultMMRLambda,
+	})
+	storeMutex.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("searching the documents: %w", err)
+	}
+
+	if reranker != nil {
+		reranked, err := rag.Rerank(ctx, reranker, question, similarities, maxResults)
+		if err == nil {
+			return reranked, nil
+		}
+		// Better results without reranking than no result at all
+		log.Println("⚠️ Reranking failed, the search results are not reranked:", err)
+	}
+	return similarities[:min(len(similarities), maxResults)], nil
+}
+
+// metadataValue converts a metadata value of a tool argument to a string (lists are comma-separated, like the tags).
+func metadataValue(value any) string {
+	if list, ok := value.([]any); ok {
+		items := make([]string, len(list))
+		for idx, item := range list {
+			items[idx] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+// sourceFromPath returns the source of a document file: its path relative to the documents directory.
+func sourceFromPath(path string) string {
+	source, err := filepath.Rel(documentsPath, path)
+	if err != nil {
+		source = path
+	}
+	return filepath.ToSlash(source)
+}
+
+// chunkDocument splits a document with the configured chunk method (see rag.ChunkDocument).
+func chunkDocument(source string, document rag.Document) []rag.VectorRecord {
+	return rag.ChunkDocument(source, document, rag.ChunkOptions{
+		Method:        chunkMethod,
+		Size:          chunkSize,
+		Overlap:       chunkOverlap,
+		MaxTokens:     chunkMaxTokens,
+		OverlapTokens: chunkOverlapTokens,
+	})
+}
+
+// embedChunks sets the embeddings of the chunks (nil for the chunks that could not be embedded).
+func embedChunks(ctx context.Context, chunks []rag.VectorRecord) rag.EmbeddingReport {
+	texts := make([]string, len(chunks))
+	for idx, chunk := range chunks {
+		texts[idx] = chunk.Prompt
+	}
+	embeddings, report := rag.CreateEmbeddings(ctx, embedder, texts, embeddingOptions)
+	for idx := range chunks {
+		chunks[idx].Embedding = embeddings[idx]
+	}
+	return report
+}
+
+// embeddingCachePersistInterval is the delay between two saves of the embedding cache (when it changed).
+const embeddingCachePersistInterval = time.Minute
+
+// persistEmbeddingCache saves the embedding cache if it changed; a failure only costs embeddings to compute again.
+func persistEmbeddingCache() {
+	if embeddingCache == nil {
+		return
+	}
+	if err := embeddingCache.Persist(embeddingCacheFilePath); err != nil {
+		log.Println("⚠️ Error saving the embedding cache:", err)
+	}
+}
+
+// flushEmbeddingFixtures writes the embeddings recorded with EMBEDDER=record to EMBEDDING_FIXTURES_FILE.
+func flushEmbeddingFixtures() {
+	if err := rag.FlushEmbedder(embedder); err != nil {
+		log.Println("⚠️ Error saving the recorded embeddings:", err)
+	}
+}
+
+// getIntEnv returns the integer value of an environment variable, or defaultValue when it is not set.
+func getIntEnv(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	intValue, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalln("😡 Error converting", name, "to int:", err)
+	}
+	return intValue
+}
+
+// getFloatEnv returns the float value of an environment variable, or defaultValue when it is not set.
+func getFloatEnv(name string, defaultValue float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	floatValue, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalln("😡 Error converting", name, "to float:", err)
+	}
+	return floatValue
+}
+
 func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	// Check if vector store is initialized and has records
-	if len(store.Records) == 0 {
+	if store.Count() == 0 {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		response := map[string]interface{}{
 			"status": "unhealthy",
@@ -268,11 +1378,22 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The server keeps running when the model runner fails: it is degraded until the embeddings work again
+	status := "healthy"
+	embeddingsStatus := embeddingBreaker.Status()
+	if embeddingsStatus.State != rag.CircuitClosed {
+		status = "degraded"
+	}
+
 	w.WriteHeader(http.StatusOK)
 	response := map[string]interface{}{
-		"status":           "healthy",
-		"records":          len(store.Records),
+		"status":           status,
+		"embeddings":       embeddingsStatus,
+		"records":          store.Count(),
 		"embeddings_model": embeddingsModel,
 	}
+	if embeddingCache != nil {
+		response["embedding_cache"] = embeddingCache.Stats()
+	}
 	json.NewEncoder(w).Encode(response)
 }
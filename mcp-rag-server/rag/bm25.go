@@ -0,0 +1,143 @@
+package rag
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// wordPattern matches the words of a text (identifiers such as snake_case names included)
+	wordPattern = regexp.MustCompile(`[\p{L}\p{N}_]+`)
+	// compoundPattern matches qualified identifiers such as fmt.Println or std::io::Result
+	compoundPattern = regexp.MustCompile(`[\p{L}\p{N}_]+(?:(?:\.|::)[\p{L}\p{N}_]+)+`)
+)
+
+// KeywordMatch is a document of the keyword index matching a query.
+type KeywordMatch struct {
+	Id    string
+	Score float64
+}
+
+// BM25Index is an inverted index of documents with BM25 scoring.
+// It is used next to the vector store to find exact identifiers (function names, error codes...)
+// that embeddings tend to miss.
+type BM25Index struct {
+	K1 float64 // term frequency saturation (default 1.2)
+	B  float64 // length normalization (default 0.75)
+
+	postings    map[string]map[string]int // term -> document id -> term frequency
+	docTerms    map[string][]string       // document id -> distinct terms (to remove a document)
+	docLengths  map[string]int            // document id -> number of terms
+	totalLength int
+}
+
+// NewBM25Index creates an empty keyword index with the usual BM25 parameters.
+func NewBM25Index() *BM25Index {
+	return &BM25Index{
+		K1:         1.2,
+		B:          0.75,
+		postings:   make(map[string]map[string]int),
+		docTerms:   make(map[string][]string),
+		docLengths: make(map[string]int),
+	}
+}
+
+// Tokenize splits a text into lower-case keyword index terms.
+// Qualified identifiers (fmt.Println, std::io::Result) are indexed both as a whole and word by word.
+func Tokenize(text string) []string {
+	text = strings.ToLower(text)
+	terms := wordPattern.FindAllString(text, -1)
+	terms = append(terms, compoundPattern.FindAllString(text, -1)...)
+	return terms
+}
+
+// Add indexes the text of a document. An already indexed document is replaced.
+func (idx *BM25Index) Add(id string, text string) {
+	idx.Remove(id)
+
+	terms := Tokenize(text)
+	frequencies := make(map[string]int)
+	for _, term := range terms {
+		frequencies[term]++
+	}
+	distinctTerms := make([]string, 0, len(frequencies))
+	for term, frequency := range frequencies {
+		if idx.postings[term] == nil {
+			idx.postings[term] = make(map[string]int)
+		}
+		idx.postings[term][id] = frequency
+		distinctTerms = append(distinctTerms, term)
+	}
+	idx.docTerms[id] = distinctTerms
+	idx.docLengths[id] = len(terms)
+	idx.totalLength += len(terms)
+}
+
+// Remove removes a document from the index (it does nothing if the document is not indexed).
+func (idx *BM25Index) Remove(id string) {
+	terms, exists := idx.docTerms[id]
+	if !exists {
+		return
+	}
+	for _, term := range terms {
+		delete(idx.postings[term], id)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	idx.totalLength -= idx.docLengths[id]
+	delete(idx.docTerms, id)
+	delete(idx.docLengths, id)
+}
+
+// Count returns the number of indexed documents.
+func (idx *BM25Index) Count() int {
+	return len(idx.docLengths)
+}
+
+// Search returns the (at most max) documents with the best BM25 score for the query,
+// sorted by decreasing score. Documents without any term of the query are not returned.
+func (idx *BM25Index) Search(query string, max int) []KeywordMatch {
+	documentsCount := float64(len(idx.docLengths))
+	if documentsCount == 0 {
+		return []KeywordMatch{}
+	}
+	averageLength := float64(idx.totalLength) / documentsCount
+
+	scores := make(map[string]float64)
+	seen := make(map[string]bool)
+	for _, term := range Tokenize(query) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		postings := idx.postings[term]
+		if len(postings) == 0 {
+			continue
+		}
+		documentFrequency := float64(len(postings))
+		idf := math.Log(1 + (documentsCount-documentFrequency+0.5)/(documentFrequency+0.5))
+		for id, frequency := range postings {
+			tf := float64(frequency)
+			norm := 1 - idx.B + idx.B*float64(idx.docLengths[id])/averageLength
+			scores[id] += idf * tf * (idx.K1 + 1) / (tf + idx.K1*norm)
+		}
+	}
+
+	matches := make([]KeywordMatch, 0, len(scores))
+	for id, score := range scores {
+		matches = append(matches, KeywordMatch{Id: id, Score: score})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Score == matches[j].Score {
+			return matches[i].Id < matches[j].Id
+		}
+		return matches[i].Score > matches[j].Score
+	})
+	if max >= 0 && len(matches) > max {
+		matches = matches[:max]
+	}
+	return matches
+}
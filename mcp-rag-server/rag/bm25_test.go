@@ -0,0 +1,121 @@
+package rag
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	cases := []struct {
+		text string
+		want []string
+	}{
+		{text: "", want: nil},
+		{text: "Hello, World!", want: []string{"hello", "world"}},
+		{text: `fmt.Println("Hi")`, want: []string{"fmt", "println", "hi", "fmt.println"}},
+		{text: "std::io::Result", want: []string{"std", "io", "result", "std::io::result"}},
+		{text: "snake_case Été ERR_42", want: []string{"snake_case", "été", "err_42"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.text, func(t *testing.T) {
+			if got := Tokenize(tc.text); !slices.Equal(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// bm25Documents has an average length of 2 terms.
+var bm25Documents = map[string]string{
+	"a": "apple banana",
+	"b": "apple apple cherry",
+	"c": "cherry",
+}
+
+func TestBM25Search(t *testing.T) {
+	// idf of a term in 2 of the 3 documents, and in 1 of them
+	idf2 := math.Log(1 + (3-2+0.5)/(2+0.5))
+	idf1 := math.Log(1 + (3-1+0.5)/(1+0.5))
+	// score = idf * tf * (k1 + 1) / (tf + k1 * (1 - b + b * length / averageLength))
+	scoreA := idf2 * 1 * 2.2 / (1 + 1.2*(0.25+0.75*2.0/2))
+	scoreB := idf2 * 2 * 2.2 / (2 + 1.2*(0.25+0.75*3.0/2))
+
+	cases := []struct {
+		name  string
+		query string
+		max   int
+		want  []KeywordMatch
+	}{
+		{name: "term frequency", query: "apple", max: 10, want: []KeywordMatch{{Id: "b", Score: scoreB}, {Id: "a", Score: scoreA}}},
+		{name: "repeated query term", query: "apple APPLE apple", max: 10, want: []KeywordMatch{{Id: "b", Score: scoreB}, {Id: "a", Score: scoreA}}},
+		{name: "max", query: "apple", max: 1, want: []KeywordMatch{{Id: "b", Score: scoreB}}},
+		{name: "no max", query: "apple", max: -1, want: []KeywordMatch{{Id: "b", Score: scoreB}, {Id: "a", Score: scoreA}}},
+		{name: "rare term", query: "banana", max: 10, want: []KeywordMatch{{Id: "a", Score: idf1 * 2.2 / (1 + 1.2)}}},
+		{name: "unknown term", query: "durian", max: 10, want: []KeywordMatch{}},
+	}
+	index := NewBM25Index()
+	for id, text := range bm25Documents {
+		index.Add(id, text)
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := index.Search(tc.query, tc.max)
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+			for idx := range got {
+				if got[idx].Id != tc.want[idx].Id || math.Abs(got[idx].Score-tc.want[idx].Score) > 1e-9 {
+					t.Errorf("got %v, want %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBM25SearchTiesAreSortedByID(t *testing.T) {
+	index := NewBM25Index()
+	for _, id := range []string{"z", "m", "a"} {
+		index.Add(id, "same text")
+	}
+	got := index.Search("text", 10)
+	ids := []string{}
+	for _, match := range got {
+		ids = append(ids, match.Id)
+	}
+	if !slices.Equal(ids, []string{"a", "m", "z"}) {
+		t.Errorf("got %v, want [a m z]", ids)
+	}
+}
+
+func TestBM25AddAndRemove(t *testing.T) {
+	index := NewBM25Index()
+	if got := index.Search("apple", 10); len(got) != 0 {
+		t.Fatalf("empty index: got %v", got)
+	}
+	for id, text := range bm25Documents {
+		index.Add(id, text)
+	}
+
+	// Adding a document again replaces it
+	index.Add("a", "durian")
+	if got := index.Search("banana", 10); len(got) != 0 {
+		t.Errorf("the replaced text is still indexed: %v", got)
+	}
+	if got := index.Search("durian", 10); len(got) != 1 || got[0].Id != "a" {
+		t.Errorf("got %v, want the replaced document", got)
+	}
+
+	index.Remove("b")
+	index.Remove("unknown")
+	if index.Count() != 2 {
+		t.Errorf("got %d documents, want 2", index.Count())
+	}
+	if got := index.Search("apple", 10); len(got) != 0 {
+		t.Errorf("the removed document is still indexed: %v", got)
+	}
+	// The lengths of the removed documents are not counted anymore: "c" has the average length
+	if index.totalLength != 2 {
+		t.Errorf("got a total length of %d, want 2", index.totalLength)
+	}
+}
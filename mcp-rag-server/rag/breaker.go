@@ -0,0 +1,141 @@
+package rag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	CircuitClosed   = "closed"    // the requests are sent
+	CircuitOpen     = "open"      // the requests fail immediately, until the cooldown is over
+	CircuitHalfOpen = "half-open" // one request is sent to check whether the model is back
+)
+
+// ErrCircuitOpen is returned without calling the embedder while the circuit is open.
+var ErrCircuitOpen = errors.New("the embeddings service is unavailable (circuit open)")
+
+// CircuitBreakerEmbedder stops calling an embedder that keeps failing: after FailureThreshold
+// consecutive failures, the requests fail immediately with ErrCircuitOpen for Cooldown,
+// then one request checks whether the embedder is back.
+// It spares a model runner that is down (and the clients waiting for it) the requests and their retries.
+type CircuitBreakerEmbedder struct {
+	Embedder         Embedder
+	FailureThreshold int
+	Cooldown         time.Duration
+
+	mutex               sync.Mutex
+	consecutiveFailures int
+	openedAt            time.Time
+	trialRunning        bool
+	lastError           error
+	now                 func() time.Time // clock of the cooldown (time.Now, replaced by the tests)
+}
+
+// CircuitStatus describes the state of a CircuitBreakerEmbedder (for a health check).
+type CircuitStatus struct {
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	LastError           string `json:"last_error,omitempty"`
+}
+
+// NewCircuitBreakerEmbedder wraps the embedder with a circuit breaker.
+func NewCircuitBreakerEmbedder(embedder Embedder, failureThreshold int, cooldown time.Duration) *CircuitBreakerEmbedder {
+	return &CircuitBreakerEmbedder{
+		Embedder:         embedder,
+		FailureThreshold: max(failureThreshold, 1),
+		Cooldown:         cooldown,
+		now:              time.Now,
+	}
+}
+
+// EmbedBatch calls the embedder unless the circuit is open.
+func (cb *CircuitBreakerEmbedder) EmbedBatch(ctx context.Context, texts []string) ([][]float64, error) {
+	if err := cb.acquire(); err != nil {
+		return nil, err
+	}
+	vectors, err := cb.Embedder.EmbedBatch(ctx, texts)
+	cb.record(ctx, err)
+	return vectors, err
+}
+
+// ModelName returns the model of the embedder.
+func (cb *CircuitBreakerEmbedder) ModelName() string {
+	return cb.Embedder.ModelName()
+}
+
+// Status returns the state of the circuit, the number of consecutive failures and the last error.
+func (cb *CircuitBreakerEmbedder) Status() CircuitStatus {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	status := CircuitStatus{
+		State:               cb.state(),
+		ConsecutiveFailures: cb.consecutiveFailures,
+	}
+	if cb.lastError != nil {
+		status.LastError = cb.lastError.Error()
+	}
+	return status
+}
+
+// state returns the state of the circuit (the caller holds the mutex).
+func (cb *CircuitBreakerEmbedder) state() string {
+	switch {
+	case cb.consecutiveFailures < cb.FailureThreshold:
+		return CircuitClosed
+	case cb.clock().Sub(cb.openedAt) < cb.Cooldown:
+		return CircuitOpen
+	default:
+		return CircuitHalfOpen
+	}
+}
+
+// acquire returns ErrCircuitOpen when the request must not be sent.
+// In the half-open state, only one request at a time is let through.
+func (cb *CircuitBreakerEmbedder) acquire() error {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	switch cb.state() {
+	case CircuitOpen:
+		return fmt.Errorf("%w: %v", ErrCircuitOpen, cb.lastError)
+	case CircuitHalfOpen:
+		if cb.trialRunning {
+			return fmt.Errorf("%w: %v", ErrCircuitOpen, cb.lastError)
+		}
+		cb.trialRunning = true
+	}
+	return nil
+}
+
+// record updates the circuit with the result of a request.
+// A request canceled by the caller says nothing about the model runner: it is not counted.
+func (cb *CircuitBreakerEmbedder) record(ctx context.Context, err error) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.trialRunning = false
+	if err == nil {
+		cb.consecutiveFailures = 0
+		cb.lastError = nil
+		return
+	}
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	cb.consecutiveFailures++
+	cb.lastError = err
+	if cb.consecutiveFailures >= cb.FailureThreshold {
+		// Open (or open again after a failed trial)
+		cb.openedAt = cb.clock()
+	}
+}
+
+// clock returns the current time (of the now function when there is one).
+func (cb *CircuitBreakerEmbedder) clock() time.Time {
+	if cb.now == nil {
+		return time.Now()
+	}
+	return cb.now()
+}
@@ -0,0 +1,166 @@
+package rag
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEmbedder returns err (or one vector per text) and counts the calls.
+// When block is set, the calls wait for it to be closed.
+type fakeEmbedder struct {
+	mutex sync.Mutex
+	err   error
+	calls int
+	block chan struct{}
+}
+
+func (fe *fakeEmbedder) EmbedBatch(ctx context.Context, texts []string) ([][]float64, error) {
+	fe.mutex.Lock()
+	fe.calls++
+	err, block := fe.err, fe.block
+	fe.mutex.Unlock()
+	if block != nil {
+		<-block
+	}
+	if err != nil {
+		return nil, err
+	}
+	vectors := make([][]float64, len(texts))
+	for idx := range vectors {
+		vectors[idx] = []float64{1, 0}
+	}
+	return vectors, nil
+}
+
+func (fe *fakeEmbedder) ModelName() string { return "fake" }
+
+// fakeClock is a clock that only moves forward when told to.
+type fakeClock struct{ current time.Time }
+
+func (fc *fakeClock) now() time.Time                 { return fc.current }
+func (fc *fakeClock) advance(duration time.Duration) { fc.current = fc.current.Add(duration) }
+
+func newTestBreaker(embedder Embedder, threshold int) (*CircuitBreakerEmbedder, *fakeClock) {
+	clock := &fakeClock{current: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	breaker := NewCircuitBreakerEmbedder(embedder, threshold, 10*time.Second)
+	breaker.now = clock.now
+	return breaker, clock
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	errDown := errors.New("model runner down")
+	steps := []struct {
+		name        string
+		advance     time.Duration
+		err         error  // error of the embedder
+		stateBefore string // state of the circuit before the request
+		wantErr     error
+		wantState   string
+		wantCalls   int
+	}{
+		{name: "first failure", err: errDown, stateBefore: CircuitClosed, wantErr: errDown, wantState: CircuitClosed, wantCalls: 1},
+		{name: "threshold reached", err: errDown, stateBefore: CircuitClosed, wantErr: errDown, wantState: CircuitOpen, wantCalls: 2},
+		{name: "open", stateBefore: CircuitOpen, wantErr: ErrCircuitOpen, wantState: CircuitOpen, wantCalls: 2},
+		{name: "still open before the cooldown", advance: 9 * time.Second, stateBefore: CircuitOpen, wantErr: ErrCircuitOpen, wantState: CircuitOpen, wantCalls: 2},
+		{name: "failed trial", advance: time.Second, err: errDown, stateBefore: CircuitHalfOpen, wantErr: errDown, wantState: CircuitOpen, wantCalls: 3},
+		{name: "the cooldown starts again", advance: 5 * time.Second, stateBefore: CircuitOpen, wantErr: ErrCircuitOpen, wantState: CircuitOpen, wantCalls: 3},
+		{name: "successful trial", advance: 5 * time.Second, stateBefore: CircuitHalfOpen, wantState: CircuitClosed, wantCalls: 4},
+		{name: "failure after closing", err: errDown, stateBefore: CircuitClosed, wantErr: errDown, wantState: CircuitClosed, wantCalls: 5},
+		{name: "success resets the failures", stateBefore: CircuitClosed, wantState: CircuitClosed, wantCalls: 6},
+	}
+
+	embedder := &fakeEmbedder{}
+	breaker, clock := newTestBreaker(embedder, 2)
+	for _, step := range steps {
+		clock.advance(step.advance)
+		embedder.err = step.err
+		if state := breaker.Status().State; state != step.stateBefore {
+			t.Fatalf("%s: got state %s before the request, want %s", step.name, state, step.stateBefore)
+		}
+		vectors, err := breaker.EmbedBatch(context.Background(), []string{"text"})
+		switch {
+		case step.wantErr == nil && (err != nil || len(vectors) != 1):
+			t.Fatalf("%s: got %v and %d vectors, want a vector", step.name, err, len(vectors))
+		case step.wantErr != nil && !errors.Is(err, step.wantErr):
+			t.Fatalf("%s: got error %v, want %v", step.name, err, step.wantErr)
+		}
+		status := breaker.Status()
+		if status.State != step.wantState || embedder.calls != step.wantCalls {
+			t.Fatalf("%s: got state %s and %d calls, want %s and %d", step.name, status.State, embedder.calls, step.wantState, step.wantCalls)
+		}
+		if step.wantErr == nil && (status.ConsecutiveFailures != 0 || status.LastError != "") {
+			t.Fatalf("%s: got %+v after a success", step.name, status)
+		}
+	}
+}
+
+// A request canceled (or timed out) by the caller says nothing about the model runner.
+func TestCircuitBreakerIgnoresCanceledRequests(t *testing.T) {
+	embedder := &fakeEmbedder{}
+	breaker, _ := newTestBreaker(embedder, 1)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	embedder.err = context.Canceled
+	if _, err := breaker.EmbedBatch(canceled, []string{"text"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	// The client gave up, the embedder reports another error
+	embedder.err = errors.New("connection reset")
+	if _, err := breaker.EmbedBatch(canceled, []string{"text"}); err == nil {
+		t.Fatal("got no error")
+	}
+	// An error wrapping context.Canceled, with a live context
+	embedder.err = errors.Join(errors.New("request aborted"), context.Canceled)
+	if _, err := breaker.EmbedBatch(context.Background(), []string{"text"}); err == nil {
+		t.Fatal("got no error")
+	}
+	if status := breaker.Status(); status.State != CircuitClosed || status.ConsecutiveFailures != 0 {
+		t.Fatalf("got %+v, want a closed circuit without failures", status)
+	}
+
+	embedder.err = errors.New("model runner down")
+	breaker.EmbedBatch(context.Background(), []string{"text"})
+	if status := breaker.Status(); status.State != CircuitOpen || status.LastError != "model runner down" {
+		t.Errorf("got %+v, want an open circuit", status)
+	}
+}
+
+// In the half-open state, only one request checks whether the embedder is back.
+func TestCircuitBreakerSingleTrial(t *testing.T) {
+	embedder := &fakeEmbedder{err: errors.New("model runner down")}
+	breaker, clock := newTestBreaker(embedder, 1)
+	breaker.EmbedBatch(context.Background(), []string{"text"})
+	clock.advance(10 * time.Second)
+
+	embedder.err = nil
+	embedder.block = make(chan struct{})
+	trial := make(chan error)
+	go func() {
+		_, err := breaker.EmbedBatch(context.Background(), []string{"text"})
+		trial <- err
+	}()
+	// Wait for the trial to reach the embedder
+	for {
+		embedder.mutex.Lock()
+		calls := embedder.calls
+		embedder.mutex.Unlock()
+		if calls == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := breaker.EmbedBatch(context.Background(), []string{"text"}); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("got %v during the trial, want ErrCircuitOpen", err)
+	}
+	close(embedder.block)
+	if err := <-trial; err != nil {
+		t.Fatal(err)
+	}
+	if state := breaker.Status().State; state != CircuitClosed {
+		t.Errorf("got state %s after the trial, want closed", state)
+	}
+}
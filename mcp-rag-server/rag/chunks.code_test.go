@@ -0,0 +1,229 @@
+package rag
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestChunkMarkdownWithCode(t *testing.T) {
+	cases := []struct {
+		name      string
+		markdown  string
+		maxTokens int
+		want      []string
+	}{
+		{
+			name:      "sections that fit",
+			markdown:  "# A\n\nText a.\n\n## B\n\nText b.\n",
+			maxTokens: 100,
+			want:      []string{"# A\n\nText a.", "## B\n\nText b."},
+		},
+		{
+			name:      "header without content",
+			markdown:  "## Basic Syntax\n### Hello World\n\nText.",
+			maxTokens: 100,
+			want:      []string{"## Basic Syntax\n### Hello World\n\nText."},
+		},
+		{
+			name:      "comment in a code block",
+			markdown:  "# Shell\n\n```sh\n# not a header\nls\n```",
+			maxTokens: 0,
+			want:      []string{"# Shell\n\n```sh\n# not a header\nls\n```"},
+		},
+		{
+			name:      "code block with its description",
+			markdown:  "# Install\n\nFirst paragraph about the tool.\n\nRun this:\n\n```sh\napt-get update\n```\n\nLast paragraph about the tool.",
+			maxTokens: 14,
+			want: []string{
+				"# Install\n\nFirst paragraph about the tool.",
+				"# Install\n\nRun this:\n```sh\napt-get update\n```",
+				"# Install\n\nLast paragraph about the tool.",
+			},
+		},
+		{
+			name:      "oversized code block",
+			markdown:  "# Big\n\nThe script:\n\n~~~bash\n```\necho one two three four five six seven eight nine ten\n```\n~~~",
+			maxTokens: 5,
+			want:      []string{"# Big\n\nThe script:\n~~~bash\n```\necho one two three four five six seven eight nine ten\n```\n~~~"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ChunkMarkdownWithCode(tc.markdown, tc.maxTokens)
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// Whatever the budget, every fenced block ends up whole in a single chunk.
+func TestChunkMarkdownWithCodeNeverSplitsACodeBlock(t *testing.T) {
+	codeBlock := "```go\nfunc main() {\n\n\tfmt.Println(\"hello\")\n\n\tfmt.Println(\"world\")\n}\n```"
+	markdown := "# Example\n\nA long introduction. " + strings.Repeat("More words about the example. ", 20) +
+		"\n\nThe program:\n\n" + codeBlock + "\n\nA conclusion."
+	for maxTokens := 1; maxTokens <= 60; maxTokens++ {
+		found := 0
+		for _, chunk := range ChunkMarkdownWithCode(markdown, maxTokens) {
+			if strings.Contains(chunk, codeBlock) {
+				found++
+			} else if strings.Contains(chunk, "```") {
+				t.Fatalf("maxTokens %d: the code block is split in %q", maxTokens, chunk)
+			}
+		}
+		if found != 1 {
+			t.Fatalf("maxTokens %d: the code block is in %d chunks", maxTokens, found)
+		}
+	}
+}
+
+const goSource = `package main
+
+import "fmt"
+
+// Hello says hello.
+func Hello() {
+	fmt.Println("hello")
+}
+
+type Point struct {
+	X, Y int
+}`
+
+const rustSource = `use std::fmt;
+
+/// A point.
+#[derive(Debug)]
+pub struct Point {
+    x: i32,
+}
+
+impl Point {
+    pub fn new() -> Self {
+        Point { x: 0 }
+    }
+}
+
+pub(crate) async fn run() {}`
+
+const swiftSource = `import Foundation
+
+/// A greeter.
+@MainActor
+public final class Greeter {
+    func greet() {}
+}
+
+extension Greeter {
+}
+
+private func helper() -> Int {
+    return 1
+}`
+
+func TestChunkSourceCode(t *testing.T) {
+	cases := []struct {
+		name      string
+		source    string
+		language  string
+		maxTokens int
+		want      []string
+	}{
+		{
+			name:     "go declarations",
+			source:   goSource,
+			language: "go",
+			want: []string{
+				"package main\n\nimport \"fmt\"",
+				"// Hello says hello.\nfunc Hello() {\n\tfmt.Println(\"hello\")\n}",
+				"type Point struct {\n\tX, Y int\n}",
+			},
+		},
+		{
+			name:     "rust declarations",
+			source:   rustSource,
+			language: "rust",
+			want: []string{
+				"use std::fmt;",
+				"/// A point.\n#[derive(Debug)]\npub struct Point {\n    x: i32,\n}",
+				"impl Point {\n    pub fn new() -> Self {\n        Point { x: 0 }\n    }\n}",
+				"pub(crate) async fn run() {}",
+			},
+		},
+		{
+			name:     "swift declarations",
+			source:   swiftSource,
+			language: "swift",
+			want: []string{
+				"import Foundation",
+				"/// A greeter.\n@MainActor\npublic final class Greeter {\n    func greet() {}\n}",
+				"extension Greeter {\n}",
+				"private func helper() -> Int {\n    return 1\n}",
+			},
+		},
+		{
+			name:      "small declarations merged",
+			source:    goSource,
+			language:  "go",
+			maxTokens: 100,
+			want:      []string{goSource},
+		},
+		{
+			name:      "unsupported language",
+			source:    "def one():\n    pass\n\ndef two():\n    pass",
+			language:  "python",
+			maxTokens: 6,
+			want:      []string{"def one():\n    pass", "def two():\n    pass"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ChunkSourceCode(tc.source, tc.language, tc.maxTokens)
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// A function bigger than the budget is split by size instead of making an oversized chunk.
+func TestChunkSourceCodeSplitsAnOversizedFunction(t *testing.T) {
+	body := []string{}
+	for idx := range 30 {
+		body = append(body, "\tfmt.Println(\"line\", "+strings.Repeat("x", idx%5+1)+")")
+	}
+	source := "package main\n\nfunc Small() {}\n\nfunc Big() {\n" + strings.Join(body, "\n") + "\n}"
+
+	chunks := ChunkSourceCode(source, "go", 40)
+	if len(chunks) < 3 {
+		t.Fatalf("got %d chunks, want the big function split: %q", len(chunks), chunks)
+	}
+	if chunks[0] != "package main\n\nfunc Small() {}" {
+		t.Errorf("got first chunk %q", chunks[0])
+	}
+	for _, chunk := range chunks {
+		if EstimateTokens(chunk) > 40 {
+			t.Errorf("chunk %q has %d tokens, more than 40", chunk, EstimateTokens(chunk))
+		}
+	}
+	for _, line := range body {
+		if !slices.ContainsFunc(chunks, func(chunk string) bool { return strings.Contains(chunk, line) }) {
+			t.Errorf("line %q is lost", line)
+		}
+	}
+}
+
+func TestLanguageFromExtension(t *testing.T) {
+	for path, want := range map[string]string{
+		"main.go":         "go",
+		"src/lib.RS":      "rust",
+		"App.swift":       "swift",
+		"script.py":       "",
+		"no-extension-go": "",
+	} {
+		if got := LanguageFromExtension(path); got != want {
+			t.Errorf("LanguageFromExtension(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
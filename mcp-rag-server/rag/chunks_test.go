@@ -0,0 +1,122 @@
+package rag
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestChunkText(t *testing.T) {
+	cases := []struct {
+		name      string
+		text      string
+		chunkSize int
+		overlap   int
+		want      []string
+	}{
+		{name: "empty text", text: "", chunkSize: 4, want: []string{}},
+		{name: "no size", text: "abcdef", chunkSize: 0, want: []string{"abcdef"}},
+		{name: "shorter than a chunk", text: "abc", chunkSize: 4, want: []string{"abc"}},
+		{name: "last chunk shorter", text: "abcdefghij", chunkSize: 4, want: []string{"abcd", "efgh", "ij"}},
+		// The last chunk ends the text: no chunk made only of the overlap follows it
+		{name: "overlap", text: "abcdefgh", chunkSize: 4, overlap: 2, want: []string{"abcd", "cdef", "efgh"}},
+		{name: "overlap equal to the size", text: "abcdef", chunkSize: 2, overlap: 2, want: []string{"ab", "cd", "ef"}},
+		{name: "overlap bigger than the size", text: "abcdef", chunkSize: 2, overlap: 5, want: []string{"ab", "cd", "ef"}},
+		{name: "negative overlap", text: "abcdef", chunkSize: 3, overlap: -1, want: []string{"abc", "def"}},
+		{name: "CJK", text: "日本語のテキスト", chunkSize: 3, overlap: 1, want: []string{"日本語", "語のテ", "テキス", "スト"}},
+		{name: "emojis", text: "😀😃😄😁🙂", chunkSize: 2, want: []string{"😀😃", "😄😁", "🙂"}},
+		{name: "accents", text: "éàèù", chunkSize: 3, overlap: 1, want: []string{"éàè", "èù"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ChunkText(tc.text, tc.chunkSize, tc.overlap)
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEstimateTokens(t *testing.T) {
+	cases := []struct {
+		text string
+		want int
+	}{
+		{text: "", want: 0},
+		{text: " \n\t", want: 0},
+		{text: "abcd", want: 1},
+		{text: "hello", want: 2},
+		{text: "hello, world!", want: 6},
+		{text: "café crème", want: 3},
+		{text: "日本語", want: 1},
+		{text: "日本語のテキスト", want: 2},
+		{text: "😀😀", want: 2},
+		{text: "x := 42", want: 4},
+	}
+	for _, tc := range cases {
+		t.Run(tc.text, func(t *testing.T) {
+			if got := EstimateTokens(tc.text); got != tc.want {
+				t.Errorf("got %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestChunkTextByTokens(t *testing.T) {
+	cases := []struct {
+		name          string
+		text          string
+		maxTokens     int
+		overlapTokens int
+		want          []string
+	}{
+		{name: "empty text", text: "  \n ", maxTokens: 4, want: []string{}},
+		{name: "no budget", text: " aaaa bbbb \n", maxTokens: 0, want: []string{"aaaa bbbb"}},
+		{name: "paragraphs", text: "aaaa bbbb\n\ncccc dddd", maxTokens: 2, want: []string{"aaaa bbbb", "cccc dddd"}},
+		{name: "paragraphs in one chunk", text: "aaaa\n\nbbbb\n\ncccc", maxTokens: 3, want: []string{"aaaa\n\nbbbb\n\ncccc"}},
+		{name: "sentences", text: "Aaaa bbbb. Cccc dddd.", maxTokens: 3, want: []string{"Aaaa bbbb.", "Cccc dddd."}},
+		{name: "overlap", text: "aaaa bbbb cccc dddd", maxTokens: 2, overlapTokens: 1, want: []string{"aaaa bbbb", "bbbb cccc", "cccc dddd"}},
+		{name: "overlap equal to the budget", text: "aaaa bbbb cccc dddd", maxTokens: 2, overlapTokens: 2, want: []string{"aaaa bbbb", "cccc dddd"}},
+		{name: "overlap bigger than the budget", text: "aaaa bbbb cccc dddd", maxTokens: 2, overlapTokens: 3, want: []string{"aaaa bbbb", "cccc dddd"}},
+		{name: "oversized word", text: "abcdefghij", maxTokens: 1, want: []string{"abcd", "efgh", "ij"}},
+		{name: "oversized word with symbols", text: "a+b+c", maxTokens: 2, want: []string{"a+", "b+", "c"}},
+		{name: "CJK without spaces", text: "一二三四五六七八九十百千", maxTokens: 1, want: []string{"一二三四", "五六七八", "九十百千"}},
+		{name: "emojis", text: "😀😃😄", maxTokens: 2, want: []string{"😀😃", "😄"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ChunkTextByTokens(tc.text, tc.maxTokens, tc.overlapTokens)
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+			for _, chunk := range got {
+				if !utf8.ValidString(chunk) {
+					t.Errorf("chunk %q splits a rune", chunk)
+				}
+				if tc.maxTokens > 0 && EstimateTokens(chunk) > tc.maxTokens {
+					t.Errorf("chunk %q has %d tokens, more than %d", chunk, EstimateTokens(chunk), tc.maxTokens)
+				}
+			}
+		})
+	}
+}
+
+// A long blob is split in a single pass: every piece but the last one is full, and nothing is lost.
+func TestSplitRunes(t *testing.T) {
+	blob := strings.Repeat("aB3+", 10000)
+	units := splitRunes(blob, 8)
+	var builder strings.Builder
+	for idx, unit := range units {
+		if unit.tokens != EstimateTokens(unit.text) {
+			t.Fatalf("unit %d: got %d tokens, EstimateTokens gives %d", idx, unit.tokens, EstimateTokens(unit.text))
+		}
+		if unit.tokens > 8 || (idx < len(units)-1 && unit.tokens < 7) {
+			t.Fatalf("unit %d (%q) has %d tokens", idx, unit.text, unit.tokens)
+		}
+		builder.WriteString(unit.text)
+	}
+	if builder.String() != blob {
+		t.Error("the units do not rebuild the text")
+	}
+}
@@ -0,0 +1,65 @@
+package rag
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const citationsInstructions = `Answer the question using only the documents below.
+Cite the documents that support each statement with their number in square brackets, ex: [1] or [2][3].
+If the documents do not contain the answer, say that it was not found in the knowledge base: do not guess.`
+
+// CitationLabel returns what identifies a record in a citation: the URI of its source (see SourceURI),
+// or its ID when it has no source.
+func CitationLabel(record VectorRecord) string {
+	if source := record.Metadata[MetadataSource]; source != "" {
+		return SourceURI(source)
+	}
+	return "record " + record.Id
+}
+
+// CitationContext returns the records as numbered documents to cite, ex:
+//
+//	[1] rag://source/notes/deployment.md
+//	text of the chunk
+func CitationContext(records []VectorRecord) string {
+	documents := make([]string, len(records))
+	for idx, record := range records {
+		documents[idx] = fmt.Sprintf("[%d] %s\n%s", idx+1, CitationLabel(record), strings.TrimSpace(record.Prompt))
+	}
+	return strings.Join(documents, "\n\n")
+}
+
+// AnswerWithCitationsPrompt returns a prompt asking to answer the question with the records only, citing them.
+// Without records, the prompt asks to say that the answer was not found.
+func AnswerWithCitationsPrompt(question string, records []VectorRecord) string {
+	context := CitationContext(records)
+	if len(records) == 0 {
+		context = "(no document of the knowledge base matches the question)"
+	}
+	return citationsInstructions + "\nList the cited documents (number and source) at the end of the answer." +
+		"\n\nDocuments:\n\n" + context + "\n\nQuestion: " + question
+}
+
+// citationNumber matches a citation of a numbered document, ex: [2]
+var citationNumber = regexp.MustCompile(`\[(\d+)\]`)
+
+// CitedRecords returns the indexes (from 0) of the records cited by an answer ([1] is the first record),
+// in the order of the records. The numbers without record are ignored.
+func CitedRecords(answer string, records []VectorRecord) []int {
+	cited := make([]bool, len(records))
+	for _, matches := range citationNumber.FindAllStringSubmatch(answer, -1) {
+		if number, err := strconv.Atoi(matches[1]); err == nil && number >= 1 && number <= len(records) {
+			cited[number-1] = true
+		}
+	}
+	indexes := []int{}
+	for idx, isCited := range cited {
+		if isCited {
+			indexes = append(indexes, idx)
+		}
+	}
+	return indexes
+}
@@ -33,7 +33,11 @@ func dotProduct(v1 []float64, v2 []float64) float64 {
 }
 
 // cosineSimilarity calculates the cosine similarity between two vectors
+// Vectors of different dimensions (produced by different models) are not comparable: it returns 0.
 func cosineSimilarity(v1, v2 []float64) float64 {
+	if len(v1) != len(v2) {
+		return 0.0
+	}
 	// Calculate the cosine distance between two vectors
 	product := dotProduct(v1, v2)
 
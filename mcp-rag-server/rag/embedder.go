@@ -0,0 +1,122 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/openai/openai-go/v2"
+)
+
+// Embedder computes the embeddings of texts.
+// CreateEmbeddings adds the batching, the retries and the cache around an Embedder.
+type Embedder interface {
+	// EmbedBatch returns one embedding per text, in the order of the texts.
+	EmbedBatch(ctx context.Context, texts []string) ([][]float64, error)
+	// ModelName identifies the embeddings: vectors of different models cannot be compared.
+	ModelName() string
+}
+
+// OpenAIEmbedder computes the embeddings with a model of an OpenAI compatible API (ex: Docker Model Runner).
+type OpenAIEmbedder struct {
+	Client openai.Client
+	Model  string
+}
+
+// EmbedBatch sends one embeddings request for all the texts.
+func (oe *OpenAIEmbedder) EmbedBatch(ctx context.Context, texts []string) ([][]float64, error) {
+	response, err := oe.Client.Embeddings.New(ctx, openai.EmbeddingNewParams{
+		Input: openai.EmbeddingNewParamsInputUnion{
+			OfArrayOfStrings: texts,
+		},
+		Model: oe.Model,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Data) != len(texts) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(texts), len(response.Data))
+	}
+	vectors := make([][]float64, len(texts))
+	for _, data := range response.Data {
+		if data.Index < 0 || int(data.Index) >= len(texts) {
+			return nil, fmt.Errorf("unexpected embedding index %d", data.Index)
+		}
+		vectors[data.Index] = data.Embedding
+	}
+	return vectors, nil
+}
+
+// ModelName returns the name of the model.
+func (oe *OpenAIEmbedder) ModelName() string {
+	return oe.Model
+}
+
+// Kinds of embedders of NewEmbedder
+const (
+	EmbedderOpenAI = "openai" // the model of an OpenAI compatible API
+	EmbedderHash   = "hash"   // local and deterministic hash embeddings (no model)
+	EmbedderReplay = "replay" // embeddings recorded in a fixtures file
+	EmbedderRecord = "record" // the model of an OpenAI compatible API, recording its embeddings in a fixtures file
+)
+
+// EmbedderConfig configures NewEmbedder.
+type EmbedderConfig struct {
+	Kind             string        // EmbedderOpenAI (default), EmbedderHash, EmbedderReplay or EmbedderRecord
+	Client           openai.Client // openai and record
+	Model            string        // openai and record
+	Dimension        int           // hash
+	FixturesFilePath string        // replay and record
+}
+
+// NewEmbedder creates the embedder of the configuration.
+func NewEmbedder(config EmbedderConfig) (Embedder, error) {
+	switch config.Kind {
+	case EmbedderOpenAI, "":
+		return &OpenAIEmbedder{Client: config.Client, Model: config.Model}, nil
+	case EmbedderHash:
+		return &HashEmbedder{Dimension: config.Dimension}, nil
+	case EmbedderReplay:
+		if config.FixturesFilePath == "" {
+			return nil, fmt.Errorf("the %s embedder needs a fixtures file", EmbedderReplay)
+		}
+		fixtures, err := LoadEmbeddingFixtures(config.FixturesFilePath)
+		if err != nil {
+			return nil, err
+		}
+		return &ReplayEmbedder{Fixtures: fixtures}, nil
+	case EmbedderRecord:
+		if config.FixturesFilePath == "" {
+			return nil, fmt.Errorf("the %s embedder needs a fixtures file", EmbedderRecord)
+		}
+		// Record new embeddings next to the ones of a previous recording
+		fixtures, err := LoadEmbeddingFixtures(config.FixturesFilePath)
+		if os.IsNotExist(err) {
+			fixtures, err = &EmbeddingFixtures{Embeddings: make(map[string][]float64)}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if fixtures.Model != "" && fixtures.Model != config.Model {
+			return nil, fmt.Errorf("the fixtures of %s were recorded with the model %s, not %s", config.FixturesFilePath, fixtures.Model, config.Model)
+		}
+		return &RecordingEmbedder{
+			Embedder: &OpenAIEmbedder{Client: config.Client, Model: config.Model},
+			Fixtures: fixtures,
+			FilePath: config.FixturesFilePath,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown embedder %q (expected %s, %s, %s or %s)", config.Kind, EmbedderOpenAI, EmbedderHash, EmbedderReplay, EmbedderRecord)
+}
+
+// FlushEmbedder writes the recorded embeddings of a RecordingEmbedder (also behind a CircuitBreakerEmbedder)
+// to its fixtures file. It does nothing for the other embedders.
+func FlushEmbedder(embedder Embedder) error {
+	if breaker, ok := embedder.(*CircuitBreakerEmbedder); ok {
+		embedder = breaker.Embedder
+	}
+	if recorder, ok := embedder.(*RecordingEmbedder); ok {
+		return recorder.Flush()
+	}
+	return nil
+}
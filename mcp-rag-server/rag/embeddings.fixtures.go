@@ -0,0 +1,129 @@
+package rag
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// EmbeddingFixtures are embeddings recorded from a model, keyed by text, to replay them without the model.
+type EmbeddingFixtures struct {
+	Model      string               `json:"model"`
+	Embeddings map[string][]float64 `json:"embeddings"`
+
+	mutex   sync.RWMutex
+	changed bool // embeddings recorded since the last Persist
+}
+
+// LoadEmbeddingFixtures reads a fixtures file written by Persist.
+func LoadEmbeddingFixtures(fixturesFilePath string) (*EmbeddingFixtures, error) {
+	file, err := os.ReadFile(fixturesFilePath)
+	if err != nil {
+		return nil, err
+	}
+	fixtures := &EmbeddingFixtures{}
+	if err := json.Unmarshal(file, fixtures); err != nil {
+		return nil, fmt.Errorf("%s: %w", fixturesFilePath, err)
+	}
+	if fixtures.Embeddings == nil {
+		fixtures.Embeddings = make(map[string][]float64)
+	}
+	return fixtures, nil
+}
+
+// Persist writes the fixtures to a JSON file (replaced atomically: a failed write keeps the previous fixtures).
+func (ef *EmbeddingFixtures) Persist(fixturesFilePath string) error {
+	// Locked for writing: two concurrent writes of the file would mix their content
+	ef.mutex.Lock()
+	defer ef.mutex.Unlock()
+	err := writeFileAtomically(fixturesFilePath, func(writer io.Writer) error {
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(ef)
+	})
+	if err != nil {
+		return err
+	}
+	ef.changed = false
+	return nil
+}
+
+// ReplayEmbedder returns the recorded embeddings of the fixtures: deterministic and offline,
+// with the vectors of a real model. A text that was not recorded is an error.
+type ReplayEmbedder struct {
+	Fixtures *EmbeddingFixtures
+}
+
+// EmbedBatch returns the recorded embeddings of the texts.
+func (re *ReplayEmbedder) EmbedBatch(ctx context.Context, texts []string) ([][]float64, error) {
+	re.Fixtures.mutex.RLock()
+	defer re.Fixtures.mutex.RUnlock()
+	vectors := make([][]float64, len(texts))
+	for idx, text := range texts {
+		vector, exists := re.Fixtures.Embeddings[text]
+		if !exists {
+			return nil, fmt.Errorf("no recorded embedding for %q", truncateText(text, 60))
+		}
+		vectors[idx] = vector
+	}
+	return vectors, nil
+}
+
+// ModelName returns the model of the recorded embeddings.
+func (re *ReplayEmbedder) ModelName() string {
+	return re.Fixtures.Model
+}
+
+// RecordingEmbedder computes the embeddings with another embedder and records them in the fixtures,
+// to replay them later with a ReplayEmbedder. The fixtures are kept in memory: Flush writes them to FilePath.
+type RecordingEmbedder struct {
+	Embedder Embedder
+	Fixtures *EmbeddingFixtures
+	FilePath string
+}
+
+// EmbedBatch computes the embeddings of the texts and records them.
+func (re *RecordingEmbedder) EmbedBatch(ctx context.Context, texts []string) ([][]float64, error) {
+	vectors, err := re.Embedder.EmbedBatch(ctx, texts)
+	if err != nil {
+		return nil, err
+	}
+	re.Fixtures.mutex.Lock()
+	re.Fixtures.Model = re.Embedder.ModelName()
+	if re.Fixtures.Embeddings == nil {
+		re.Fixtures.Embeddings = make(map[string][]float64)
+	}
+	for idx, text := range texts {
+		re.Fixtures.Embeddings[text] = vectors[idx]
+	}
+	re.Fixtures.changed = true
+	re.Fixtures.mutex.Unlock()
+	return vectors, nil
+}
+
+// Flush writes the fixtures to FilePath when embeddings were recorded since the last write.
+func (re *RecordingEmbedder) Flush() error {
+	re.Fixtures.mutex.RLock()
+	changed := re.Fixtures.changed
+	re.Fixtures.mutex.RUnlock()
+	if !changed {
+		return nil
+	}
+	return re.Fixtures.Persist(re.FilePath)
+}
+
+// ModelName returns the model of the recorded embedder.
+func (re *RecordingEmbedder) ModelName() string {
+	return re.Embedder.ModelName()
+}
+
+func truncateText(text string, maxRunes int) string {
+	runes := []rune(text)
+	if len(runes) <= maxRunes {
+		return text
+	}
+	return string(runes[:maxRunes]) + "…"
+}
@@ -0,0 +1,153 @@
+package rag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// EmbeddingOptions configures CreateEmbeddings.
+type EmbeddingOptions struct {
+	BatchSize      int             // number of chunks sent in one embeddings request (array input)
+	Workers        int             // number of concurrent requests
+	MaxRetries     int             // number of retries of a failed batch
+	InitialBackoff time.Duration   // delay before the first retry, doubled at each retry
+	Cache          *EmbeddingCache // embeddings already computed (nil: no cache)
+}
+
+// DefaultEmbeddingOptions returns the options used when nothing is configured.
+func DefaultEmbeddingOptions() EmbeddingOptions {
+	return EmbeddingOptions{
+		BatchSize:      16,
+		Workers:        4,
+		MaxRetries:     3,
+		InitialBackoff: 500 * time.Millisecond,
+	}
+}
+
+// EmbeddingReport summarizes a CreateEmbeddings run.
+type EmbeddingReport struct {
+	Total     int
+	Succeeded int
+	Failed    int
+	Cached    int     // chunks found in the cache (counted in Succeeded)
+	Errors    []error // one error per failed batch
+}
+
+// CreateEmbeddings computes the embeddings of the chunks with the embedder.
+// Chunks are sent by batches of options.BatchSize (array input form) by options.Workers
+// concurrent workers, and a failed batch is retried options.MaxRetries times with an exponential backoff.
+//
+// It returns the embeddings in the same order as the chunks (nil for the chunks of a failed batch)
+// and a report with the number of failed chunks.
+// With options.Cache, only the chunks missing from the cache are sent to the model, and their embeddings are added to the cache.
+func CreateEmbeddings(ctx context.Context, embedder Embedder, chunks []string, options EmbeddingOptions) ([][]float64, EmbeddingReport) {
+	if options.Cache != nil {
+		return createEmbeddingsWithCache(ctx, embedder, chunks, options)
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = 1
+	}
+	if options.Workers <= 0 {
+		options.Workers = 1
+	}
+
+	embeddings := make([][]float64, len(chunks))
+	report := EmbeddingReport{Total: len(chunks)}
+	var mutex sync.Mutex
+
+	batches := make(chan int)
+	var wg sync.WaitGroup
+	for range options.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range batches {
+				end := min(start+options.BatchSize, len(chunks))
+				var vectors [][]float64
+				err := Retry(ctx, options.MaxRetries, options.InitialBackoff, func() error {
+					var err error
+					vectors, err = embedder.EmbedBatch(ctx, chunks[start:end])
+					return err
+				})
+
+				mutex.Lock()
+				if err != nil {
+					report.Failed += end - start
+					report.Errors = append(report.Errors, fmt.Errorf("chunks %d to %d: %w", start, end-1, err))
+				} else {
+					copy(embeddings[start:end], vectors)
+					report.Succeeded += end - start
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	for start := 0; start < len(chunks); start += options.BatchSize {
+		batches <- start
+	}
+	close(batches)
+	wg.Wait()
+
+	return embeddings, report
+}
+
+// createEmbeddingsWithCache takes the embeddings of the cache and computes the other ones.
+// The errors of the report give the positions of the chunks among the chunks missing from the cache.
+func createEmbeddingsWithCache(ctx context.Context, embedder Embedder, chunks []string, options EmbeddingOptions) ([][]float64, EmbeddingReport) {
+	cache := options.Cache
+	options.Cache = nil
+	model := embedder.ModelName()
+
+	embeddings := make([][]float64, len(chunks))
+	missing := []string{}
+	missingIndexes := []int{}
+	for idx, chunk := range chunks {
+		if embedding, found := cache.Get(model, chunk); found {
+			embeddings[idx] = embedding
+			continue
+		}
+		missing = append(missing, chunk)
+		missingIndexes = append(missingIndexes, idx)
+	}
+
+	vectors, report := CreateEmbeddings(ctx, embedder, missing, options)
+	for idx, vector := range vectors {
+		if vector == nil {
+			continue
+		}
+		embeddings[missingIndexes[idx]] = vector
+		cache.Put(model, missing[idx], vector)
+	}
+	report.Cached = len(chunks) - len(missing)
+	report.Total += report.Cached
+	report.Succeeded += report.Cached
+	return embeddings, report
+}
+
+// Retry calls fn until it succeeds, at most maxRetries+1 times.
+// The delay between two attempts starts at initialBackoff and doubles each time (with some jitter).
+// It stops early when the context is done or when the circuit is open (see ErrCircuitOpen), and returns the last error.
+func Retry(ctx context.Context, maxRetries int, initialBackoff time.Duration, fn func() error) error {
+	backoff := initialBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt >= maxRetries || errors.Is(err, ErrCircuitOpen) {
+			return err
+		}
+		jitter := time.Duration(rand.Int64N(int64(backoff)/2 + 1))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff + jitter):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,168 @@
+package rag
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+)
+
+// EvalQuestion is a question of an evaluation set, with what a good search should find:
+// records of the expected sources, or records containing the expected substrings (case insensitive).
+type EvalQuestion struct {
+	Question           string   `json:"question"`
+	ExpectedSources    []string `json:"expected_sources,omitempty"`
+	ExpectedSubstrings []string `json:"expected_substrings,omitempty"`
+}
+
+// EvalResult are the metrics of one question.
+type EvalResult struct {
+	Question       string   `json:"question"`
+	Recall         float64  `json:"recall"`            // proportion of the expected sources and substrings found in the results
+	ReciprocalRank float64  `json:"reciprocal_rank"`   // 1 / rank of the first relevant result, 0 if none
+	NDCG           float64  `json:"ndcg"`              // normalized discounted cumulative gain of the results
+	Relevant       []bool   `json:"relevant"`          // relevance of every result, in the order of the results
+	Missing        []string `json:"missing,omitempty"` // expected sources and substrings not found
+}
+
+// EvalReport are the metrics of an evaluation set: the means of the metrics of the questions, at K results.
+type EvalReport struct {
+	K       int          `json:"k"`
+	Recall  float64      `json:"recall"`
+	MRR     float64      `json:"mrr"`
+	NDCG    float64      `json:"ndcg"`
+	Results []EvalResult `json:"results"`
+}
+
+// LoadEvalQuestions reads an evaluation set: a JSONL file with one EvalQuestion per line (empty lines are ignored).
+func LoadEvalQuestions(jsonlFilePath string) ([]EvalQuestion, error) {
+	file, err := os.Open(jsonlFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	questions := []EvalQuestion{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		question := EvalQuestion{}
+		if err := json.Unmarshal([]byte(text), &question); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", jsonlFilePath, line, err)
+		}
+		if question.Question == "" || (len(question.ExpectedSources) == 0 && len(question.ExpectedSubstrings) == 0) {
+			return nil, fmt.Errorf("%s:%d: a question needs a text and expected sources or substrings", jsonlFilePath, line)
+		}
+		questions = append(questions, question)
+	}
+	return questions, scanner.Err()
+}
+
+// IsRelevant returns true if the record is from one of the expected sources or contains one of the expected substrings.
+func (eq EvalQuestion) IsRelevant(record VectorRecord) bool {
+	if slices.Contains(eq.ExpectedSources, record.Metadata[MetadataSource]) {
+		return true
+	}
+	prompt := strings.ToLower(record.Prompt)
+	for _, substring := range eq.ExpectedSubstrings {
+		if strings.Contains(prompt, strings.ToLower(substring)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate runs the questions with the search function (which returns at most k records)
+// and computes recall@k, the mean reciprocal rank and nDCG@k.
+// The ideal ranking of nDCG is computed from all the records of the store.
+func Evaluate(store VectorStore, questions []EvalQuestion, k int, search func(question string) ([]VectorRecord, error)) (EvalReport, error) {
+	report := EvalReport{K: k, Results: []EvalResult{}}
+	if len(questions) == 0 {
+		return report, nil
+	}
+	allRecords, err := store.GetAll()
+	if err != nil {
+		return report, err
+	}
+
+	for _, question := range questions {
+		records, err := search(question.Question)
+		if err != nil {
+			return report, fmt.Errorf("question %q: %w", question.Question, err)
+		}
+		if len(records) > k {
+			records = records[:k]
+		}
+		result := evaluateQuestion(question, records, allRecords, k)
+		report.Recall += result.Recall
+		report.MRR += result.ReciprocalRank
+		report.NDCG += result.NDCG
+		report.Results = append(report.Results, result)
+	}
+	report.Recall /= float64(len(questions))
+	report.MRR /= float64(len(questions))
+	report.NDCG /= float64(len(questions))
+	return report, nil
+}
+
+func evaluateQuestion(question EvalQuestion, records []VectorRecord, allRecords []VectorRecord, k int) EvalResult {
+	result := EvalResult{Question: question.Question, Relevant: make([]bool, len(records))}
+
+	dcg := 0.0
+	for rank, record := range records {
+		if !question.IsRelevant(record) {
+			continue
+		}
+		result.Relevant[rank] = true
+		dcg += 1 / math.Log2(float64(rank+2))
+		if result.ReciprocalRank == 0 {
+			result.ReciprocalRank = 1 / float64(rank+1)
+		}
+	}
+
+	// The ideal ranking puts all the relevant records of the store first
+	relevantInStore := 0
+	for _, record := range allRecords {
+		if question.IsRelevant(record) {
+			relevantInStore++
+		}
+	}
+	idcg := 0.0
+	for rank := range min(relevantInStore, k) {
+		idcg += 1 / math.Log2(float64(rank+2))
+	}
+	if idcg > 0 {
+		result.NDCG = dcg / idcg
+	}
+
+	// Recall: every expected source and every expected substring is an item to find
+	expected := 0
+	found := 0
+	for _, source := range question.ExpectedSources {
+		expected++
+		if slices.ContainsFunc(records, func(record VectorRecord) bool { return record.Metadata[MetadataSource] == source }) {
+			found++
+		} else {
+			result.Missing = append(result.Missing, source)
+		}
+	}
+	for _, substring := range question.ExpectedSubstrings {
+		expected++
+		if slices.ContainsFunc(records, func(record VectorRecord) bool {
+			return strings.Contains(strings.ToLower(record.Prompt), strings.ToLower(substring))
+		}) {
+			found++
+		} else {
+			result.Missing = append(result.Missing, substring)
+		}
+	}
+	result.Recall = float64(found) / float64(expected)
+	return result
+}
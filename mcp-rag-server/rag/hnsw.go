@@ -0,0 +1,384 @@
+package rag
+
+import (
+	"container/heap"
+	"encoding/gob"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"sort"
+)
+
+// HNSWOptions configures the recall/speed trade-off of an HNSWIndex.
+type HNSWOptions struct {
+	M              int // number of neighbours per node (2*M on the bottom layer); higher = better recall, more memory
+	EfConstruction int // size of the candidate list when inserting; higher = better graph, slower indexing
+	EfSearch       int // size of the candidate list when searching; higher = better recall, slower queries
+}
+
+// DefaultHNSWOptions returns options that work well for a few hundred thousand records.
+func DefaultHNSWOptions() HNSWOptions {
+	return HNSWOptions{
+		M:              16,
+		EfConstruction: 200,
+		EfSearch:       64,
+	}
+}
+
+// hnswMaxDeletedRatio is the proportion of deleted nodes over which the graph should be rebuilt (see DeletedRatio).
+const hnswMaxDeletedRatio = 0.2
+
+// hnswNode is a vector of the graph with its neighbours on each layer (0 is the bottom layer).
+type hnswNode struct {
+	Id            string
+	Level         int
+	Neighbors     [][]int32
+	Deleted       bool
+	DeletedVector []float64 // vector of a deleted node, persisted: the vector store does not have it any more
+	vector        []float64 // normalized, not persisted (it comes from the vector store)
+}
+
+// HNSWIndex is a Hierarchical Navigable Small World graph
+// for approximate nearest neighbour search on cosine similarity.
+// See "Efficient and robust approximate nearest neighbor search using HNSW graphs" (Malkov & Yashunin).
+type HNSWIndex struct {
+	Options    HNSWOptions
+	nodes      []*hnswNode
+	idToNode   map[string]int32
+	entryPoint int32
+	maxLevel   int
+	deleted    int
+	levelMult  float64
+}
+
+// NewHNSWIndex creates an empty index.
+func NewHNSWIndex(options HNSWOptions) *HNSWIndex {
+	defaults := DefaultHNSWOptions()
+	if options.M <= 1 {
+		options.M = defaults.M
+	}
+	if options.EfConstruction <= 0 {
+		options.EfConstruction = defaults.EfConstruction
+	}
+	if options.EfSearch <= 0 {
+		options.EfSearch = defaults.EfSearch
+	}
+	return &HNSWIndex{
+		Options:    options,
+		idToNode:   make(map[string]int32),
+		entryPoint: -1,
+		levelMult:  1 / math.Log(float64(options.M)),
+	}
+}
+
+// Count returns the number of (not deleted) vectors of the index.
+func (idx *HNSWIndex) Count() int {
+	return len(idx.nodes) - idx.deleted
+}
+
+// Add inserts a vector in the graph. An already indexed ID is replaced.
+func (idx *HNSWIndex) Add(id string, vector []float64) {
+	idx.Remove(id)
+
+	node := &hnswNode{
+		Id:     id,
+		Level:  int(math.Floor(-math.Log(1-rand.Float64()) * idx.levelMult)),
+		vector: normalize(vector),
+	}
+	node.Neighbors = make([][]int32, node.Level+1)
+	nodeIdx := int32(len(idx.nodes))
+	idx.nodes = append(idx.nodes, node)
+	idx.idToNode[id] = nodeIdx
+
+	if idx.entryPoint < 0 {
+		idx.entryPoint = nodeIdx
+		idx.maxLevel = node.Level
+		return
+	}
+
+	// Greedy descent on the layers above the node level
+	entry := idx.entryPoint
+	for level := idx.maxLevel; level > node.Level; level-- {
+		entry = idx.greedyClosest(node.vector, entry, level)
+	}
+
+	// Connect the node on each of its layers
+	entries := []int32{entry}
+	for level := min(node.Level, idx.maxLevel); level >= 0; level-- {
+		candidates := idx.searchLayer(node.vector, entries, idx.Options.EfConstruction, level, false)
+		neighbors := idx.selectNeighbors(candidates, idx.maxNeighbors(level))
+		node.Neighbors[level] = neighbors
+		for _, neighbor := range neighbors {
+			idx.connect(neighbor, nodeIdx, level)
+		}
+		entries = entries[:0]
+		for _, candidate := range candidates {
+			entries = append(entries, candidate.node)
+		}
+	}
+
+	if node.Level > idx.maxLevel {
+		idx.maxLevel = node.Level
+		idx.entryPoint = nodeIdx
+	}
+}
+
+// Remove marks the vector with the given ID as deleted.
+// The node is still used to navigate the graph (the searches skip it) until the index is rebuilt.
+func (idx *HNSWIndex) Remove(id string) {
+	nodeIdx, exists := idx.idToNode[id]
+	if !exists {
+		return
+	}
+	node := idx.nodes[nodeIdx]
+	node.Deleted = true
+	node.DeletedVector = node.vector
+	idx.deleted++
+	delete(idx.idToNode, id)
+}
+
+// DeletedRatio returns the proportion of deleted nodes in the graph.
+// Over hnswMaxDeletedRatio, they slow the searches down and the index should be rebuilt.
+func (idx *HNSWIndex) DeletedRatio() float64 {
+	if len(idx.nodes) == 0 {
+		return 0
+	}
+	return float64(idx.deleted) / float64(len(idx.nodes))
+}
+
+// NeighborMatch is a vector of the HNSW index close to a query.
+type NeighborMatch struct {
+	Id               string
+	CosineSimilarity float64
+}
+
+// Search returns the IDs of the (at most topN) vectors closest to the query, with their cosine similarity,
+// sorted by decreasing similarity. ef is the size of the candidate list (EfSearch when <= 0);
+// it is raised to topN when smaller. The deleted nodes are walked through but do not take a place in the list.
+func (idx *HNSWIndex) Search(query []float64, topN int, ef int) []NeighborMatch {
+	if idx.entryPoint < 0 || topN <= 0 {
+		return []NeighborMatch{}
+	}
+	if ef <= 0 {
+		ef = idx.Options.EfSearch
+	}
+	ef = max(ef, topN)
+	query = normalize(query)
+
+	entry := idx.entryPoint
+	for level := idx.maxLevel; level > 0; level-- {
+		entry = idx.greedyClosest(query, entry, level)
+	}
+	candidates := idx.searchLayer(query, []int32{entry}, ef, 0, true)
+
+	matches := []NeighborMatch{}
+	for _, candidate := range candidates {
+		node := idx.nodes[candidate.node]
+		matches = append(matches, NeighborMatch{Id: node.Id, CosineSimilarity: 1 - candidate.distance})
+		if len(matches) == topN {
+			break
+		}
+	}
+	return matches
+}
+
+func (idx *HNSWIndex) maxNeighbors(level int) int {
+	if level == 0 {
+		return 2 * idx.Options.M
+	}
+	return idx.Options.M
+}
+
+func (idx *HNSWIndex) distance(query []float64, nodeIdx int32) float64 {
+	return 1 - dotProduct(query, idx.nodes[nodeIdx].vector)
+}
+
+// greedyClosest walks the layer from the entry node to the closest node of the query.
+func (idx *HNSWIndex) greedyClosest(query []float64, entry int32, level int) int32 {
+	current := entry
+	currentDistance := idx.distance(query, current)
+	for changed := true; changed; {
+		changed = false
+		for _, neighbor := range idx.nodes[current].Neighbors[level] {
+			if d := idx.distance(query, neighbor); d < currentDistance {
+				current, currentDistance, changed = neighbor, d, true
+			}
+		}
+	}
+	return current
+}
+
+type hnswCandidate struct {
+	node     int32
+	distance float64
+}
+
+// candidateHeap is a min-heap on the distance (or a max-heap when farthestFirst is set).
+type candidateHeap struct {
+	items         []hnswCandidate
+	farthestFirst bool
+}
+
+func (h candidateHeap) Len() int { return len(h.items) }
+func (h candidateHeap) Less(i, j int) bool {
+	if h.farthestFirst {
+		return h.items[i].distance > h.items[j].distance
+	}
+	return h.items[i].distance < h.items[j].distance
+}
+func (h candidateHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *candidateHeap) Push(x any)   { h.items = append(h.items, x.(hnswCandidate)) }
+func (h *candidateHeap) Pop() any {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+// searchLayer returns the ef closest nodes of the query found on the layer, sorted by increasing distance.
+// With skipDeleted, the deleted nodes are walked through but not returned.
+func (idx *HNSWIndex) searchLayer(query []float64, entries []int32, ef int, level int, skipDeleted bool) []hnswCandidate {
+	visited := make(map[int32]bool)
+	candidates := &candidateHeap{}
+	results := &candidateHeap{farthestFirst: true}
+	for _, entry := range entries {
+		visited[entry] = true
+		candidate := hnswCandidate{node: entry, distance: idx.distance(query, entry)}
+		heap.Push(candidates, candidate)
+		if !skipDeleted || !idx.nodes[entry].Deleted {
+			heap.Push(results, candidate)
+		}
+	}
+	for results.Len() > ef {
+		heap.Pop(results)
+	}
+
+	for candidates.Len() > 0 {
+		closest := heap.Pop(candidates).(hnswCandidate)
+		if results.Len() >= ef && closest.distance > results.items[0].distance {
+			break
+		}
+		for _, neighbor := range idx.nodes[closest.node].Neighbors[level] {
+			if visited[neighbor] {
+				continue
+			}
+			visited[neighbor] = true
+			d := idx.distance(query, neighbor)
+			if results.Len() < ef || d < results.items[0].distance {
+				heap.Push(candidates, hnswCandidate{node: neighbor, distance: d})
+				if skipDeleted && idx.nodes[neighbor].Deleted {
+					continue
+				}
+				heap.Push(results, hnswCandidate{node: neighbor, distance: d})
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+
+	sorted := append([]hnswCandidate{}, results.items...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].distance < sorted[j].distance })
+	return sorted
+}
+
+// selectNeighbors keeps the closest candidates (they are sorted by increasing distance).
+func (idx *HNSWIndex) selectNeighbors(candidates []hnswCandidate, max int) []int32 {
+	neighbors := make([]int32, 0, max)
+	for _, candidate := range candidates {
+		if len(neighbors) == max {
+			break
+		}
+		neighbors = append(neighbors, candidate.node)
+	}
+	return neighbors
+}
+
+// connect adds a link from a node to a new neighbour, pruning the farthest links when the node has too many.
+func (idx *HNSWIndex) connect(from, to int32, level int) {
+	node := idx.nodes[from]
+	node.Neighbors[level] = append(node.Neighbors[level], to)
+	limit := idx.maxNeighbors(level)
+	if len(node.Neighbors[level]) <= limit {
+		return
+	}
+	candidates := make([]hnswCandidate, 0, len(node.Neighbors[level]))
+	for _, neighbor := range node.Neighbors[level] {
+		candidates = append(candidates, hnswCandidate{node: neighbor, distance: idx.distance(node.vector, neighbor)})
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].distance < candidates[j].distance })
+	node.Neighbors[level] = idx.selectNeighbors(candidates, limit)
+}
+
+// --- Persistence ---
+
+// hnswFile is the persisted form of the graph (vectors are not persisted, they come from the vector store).
+type hnswFile struct {
+	Options    HNSWOptions
+	Nodes      []*hnswNode
+	EntryPoint int32
+	MaxLevel   int
+}
+
+// Persist writes the graph to a file.
+func (idx *HNSWIndex) Persist(indexFilePath string) error {
+	return writeFileAtomically(indexFilePath, func(writer io.Writer) error {
+		return gob.NewEncoder(writer).Encode(hnswFile{
+			Options:    idx.Options,
+			Nodes:      idx.nodes,
+			EntryPoint: idx.entryPoint,
+			MaxLevel:   idx.maxLevel,
+		})
+	})
+}
+
+// LoadHNSWIndex reads a graph written by Persist. The vectors are looked up by ID with getVector
+// (the deleted nodes have their own): it returns false if a node has no vector, which means the graph is out of sync.
+func LoadHNSWIndex(indexFilePath string, getVector func(id string) ([]float64, bool)) (*HNSWIndex, bool, error) {
+	file, err := os.Open(indexFilePath)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	var persisted hnswFile
+	if err := gob.NewDecoder(file).Decode(&persisted); err != nil {
+		return nil, false, err
+	}
+
+	idx := NewHNSWIndex(persisted.Options)
+	idx.nodes = persisted.Nodes
+	idx.entryPoint = persisted.EntryPoint
+	idx.maxLevel = persisted.MaxLevel
+	for nodeIdx, node := range idx.nodes {
+		if node.Deleted {
+			// Graphs persisted before the deleted nodes kept their vector must be rebuilt
+			if len(node.DeletedVector) == 0 {
+				return nil, false, nil
+			}
+			node.vector = node.DeletedVector
+			idx.deleted++
+			continue
+		}
+		vector, found := getVector(node.Id)
+		if !found {
+			return nil, false, nil
+		}
+		node.vector = normalize(vector)
+		idx.idToNode[node.Id] = int32(nodeIdx)
+	}
+	return idx, true, nil
+}
+
+// normalize returns a copy of the vector with a norm of 1, so the cosine similarity is a dot product.
+func normalize(vector []float64) []float64 {
+	norm := math.Sqrt(dotProduct(vector, vector))
+	normalized := make([]float64, len(vector))
+	if norm == 0 {
+		return normalized
+	}
+	for i, value := range vector {
+		normalized[i] = value / norm
+	}
+	return normalized
+}
@@ -0,0 +1,161 @@
+package rag
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Search modes of HybridSearch
+const (
+	SearchModeVector  = "vector"  // cosine similarity only
+	SearchModeKeyword = "keyword" // BM25 only
+	SearchModeHybrid  = "hybrid"  // reciprocal rank fusion of both rankings
+)
+
+// rrfRankConstant is the k constant of the reciprocal rank fusion: score = weight / (k + rank).
+// 60 is the value of the original paper; it keeps the top ranks from overwhelming the others.
+const rrfRankConstant = 60
+
+// hybridCandidatesFactor is the number of candidates taken from each ranking, per expected result.
+const hybridCandidatesFactor = 4
+
+// SearchOptions configures HybridSearch.
+type SearchOptions struct {
+	Mode         string  // SearchModeVector (default), SearchModeKeyword or SearchModeHybrid
+	Limit        float64 // minimum cosine similarity of the vector search (not applied to the keyword matches)
+	MaxResults   int     // maximum number of records to return
+	VectorWeight float64 // weight (between 0 and 1) of the vector ranking in the hybrid mode, the keyword ranking weighs 1 - VectorWeight
+	Filter       Filter  // conditions on the metadata of the records (empty: no filter)
+	Selection    string  // SelectionTopN (default) or SelectionMMR
+	MMRLambda    float64 // trade-off between relevance (1) and diversity (0) of SelectionMMR
+}
+
+// HybridSearch searches the store with the given mode (see SearchModeVector, SearchModeKeyword and SearchModeHybrid).
+//
+// Parameters:
+//   - store: the vector store.
+//   - keywords: the keyword index of the records of the store.
+//   - question: the text of the question (used by the keyword search).
+//   - embeddingFromQuestion: the embedding of the question (used by the vector search).
+//   - options: the search mode, the limits, the metadata filter and the selection mode.
+//
+// Returns:
+//   - []VectorRecord: the records sorted by decreasing Score (the cosine similarity, the BM25 score or the fused score),
+//     or in the order of the MMR selection.
+//   - error: an error if the mode is unknown or if the search fails.
+func HybridSearch(store VectorStore, keywords *BM25Index, question string, embeddingFromQuestion VectorRecord, options SearchOptions) ([]VectorRecord, error) {
+	switch options.Selection {
+	case SelectionTopN, "":
+		return search(store, keywords, question, embeddingFromQuestion, options)
+	case SelectionMMR:
+		// Select diverse records among more candidates
+		maxResults := options.MaxResults
+		options.MaxResults *= mmrCandidatesFactor
+		candidates, err := search(store, keywords, question, embeddingFromQuestion, options)
+		if err != nil {
+			return nil, err
+		}
+		return SelectMMR(candidates, options.MMRLambda, maxResults), nil
+	}
+	return nil, fmt.Errorf("unknown selection mode %q (expected %s or %s)", options.Selection, SelectionTopN, SelectionMMR)
+}
+
+// search returns the (at most options.MaxResults) best records for the search mode.
+func search(store VectorStore, keywords *BM25Index, question string, embeddingFromQuestion VectorRecord, options SearchOptions) ([]VectorRecord, error) {
+	switch options.Mode {
+	case SearchModeVector, "":
+		records, err := store.SearchTopNSimilaritiesWithFilter(embeddingFromQuestion, options.Limit, options.MaxResults, options.Filter)
+		if err != nil {
+			return nil, err
+		}
+		for idx := range records {
+			records[idx].Score = records[idx].CosineSimilarity
+		}
+		return records, nil
+
+	case SearchModeKeyword:
+		return keywordSearch(store, keywords, question, embeddingFromQuestion, options.MaxResults, options.Filter)
+
+	case SearchModeHybrid:
+		candidates := options.MaxResults * hybridCandidatesFactor
+		vectorRecords, err := store.SearchTopNSimilaritiesWithFilter(embeddingFromQuestion, options.Limit, candidates, options.Filter)
+		if err != nil {
+			return nil, err
+		}
+		keywordRecords, err := keywordSearch(store, keywords, question, embeddingFromQuestion, candidates, options.Filter)
+		if err != nil {
+			return nil, err
+		}
+		return ReciprocalRankFusion(vectorRecords, keywordRecords, options.VectorWeight, options.MaxResults), nil
+	}
+	return nil, fmt.Errorf("unknown search mode %q (expected %s, %s or %s)", options.Mode, SearchModeVector, SearchModeKeyword, SearchModeHybrid)
+}
+
+// keywordSearch returns the (at most max) records of the best BM25 matches (that match the filter),
+// with their cosine similarity for information when the question has an embedding.
+// The minimum cosine similarity (SearchOptions.Limit) does not apply: a record containing the exact
+// terms of the question is returned whatever its similarity.
+func keywordSearch(store VectorStore, keywords *BM25Index, question string, embeddingFromQuestion VectorRecord, max int, filter Filter) ([]VectorRecord, error) {
+	// The matches filtered out (or missing from the store) must not take the place of a record:
+	// take all the matches and stop at max records
+	records := []VectorRecord{}
+	for _, match := range keywords.Search(question, -1) {
+		if len(records) >= max {
+			break
+		}
+		record, err := store.GetByID(match.Id)
+		if err != nil {
+			// The index is out of sync with the store: skip the record
+			continue
+		}
+		if !filter.Match(record) {
+			continue
+		}
+		if len(embeddingFromQuestion.Embedding) > 0 {
+			record.CosineSimilarity = cosineSimilarity(embeddingFromQuestion.Embedding, record.Embedding)
+		}
+		record.Score = match.Score
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// ReciprocalRankFusion merges two rankings of records: every record scores
+// weight / (60 + rank) for each ranking it appears in, with vectorWeight for the first ranking
+// and 1 - vectorWeight for the second one.
+// It returns the (at most max) records with the best fused Score.
+func ReciprocalRankFusion(vectorRanking, keywordRanking []VectorRecord, vectorWeight float64, max int) []VectorRecord {
+	return fuseRankings([][]VectorRecord{vectorRanking, keywordRanking}, []float64{vectorWeight, 1 - vectorWeight}, max)
+}
+
+// fuseRankings merges rankings of records with the reciprocal rank fusion (one weight per ranking).
+// The first occurrence of a record is kept, with the fused Score.
+func fuseRankings(rankings [][]VectorRecord, weights []float64, max int) []VectorRecord {
+	fused := make(map[string]VectorRecord)
+	scores := make(map[string]float64)
+
+	for idx, ranking := range rankings {
+		for rank, record := range ranking {
+			if _, exists := fused[record.Id]; !exists {
+				fused[record.Id] = record
+			}
+			scores[record.Id] += weights[idx] / float64(rrfRankConstant+rank+1)
+		}
+	}
+
+	records := make([]VectorRecord, 0, len(fused))
+	for id, record := range fused {
+		record.Score = scores[id]
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Score == records[j].Score {
+			return records[i].CosineSimilarity > records[j].CosineSimilarity
+		}
+		return records[i].Score > records[j].Score
+	})
+	if len(records) > max {
+		records = records[:max]
+	}
+	return records
+}
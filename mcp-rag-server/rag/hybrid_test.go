@@ -0,0 +1,182 @@
+package rag
+
+import (
+	"math"
+	"testing"
+)
+
+func TestReciprocalRankFusion(t *testing.T) {
+	vectorRanking := []VectorRecord{{Id: "a", CosineSimilarity: 0.9}, {Id: "b", CosineSimilarity: 0.8}}
+	keywordRanking := []VectorRecord{{Id: "b", CosineSimilarity: 0.8}, {Id: "c", CosineSimilarity: 0.1}}
+
+	cases := []struct {
+		name         string
+		vectorWeight float64
+		max          int
+		wantIds      []string
+		wantScores   []float64
+	}{
+		{
+			name:         "balanced",
+			vectorWeight: 0.5,
+			max:          10,
+			wantIds:      []string{"b", "a", "c"},
+			wantScores:   []float64{0.5/61 + 0.5/62, 0.5 / 61, 0.5 / 62},
+		},
+		{
+			name:         "max",
+			vectorWeight: 0.5,
+			max:          2,
+			wantIds:      []string{"b", "a"},
+			wantScores:   []float64{0.5/61 + 0.5/62, 0.5 / 61},
+		},
+		{
+			name:         "vector only",
+			vectorWeight: 1,
+			max:          10,
+			wantIds:      []string{"a", "b", "c"},
+			wantScores:   []float64{1.0 / 61, 1.0 / 62, 0},
+		},
+		{
+			name:         "keyword only",
+			vectorWeight: 0,
+			max:          10,
+			wantIds:      []string{"b", "c", "a"},
+			wantScores:   []float64{1.0 / 61, 1.0 / 62, 0},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ReciprocalRankFusion(vectorRanking, keywordRanking, tc.vectorWeight, tc.max)
+			if len(got) != len(tc.wantIds) {
+				t.Fatalf("got %d records, want %v", len(got), tc.wantIds)
+			}
+			for idx, record := range got {
+				if record.Id != tc.wantIds[idx] || math.Abs(record.Score-tc.wantScores[idx]) > 1e-12 {
+					t.Errorf("rank %d: got %s (%f), want %s (%f)", idx, record.Id, record.Score, tc.wantIds[idx], tc.wantScores[idx])
+				}
+			}
+		})
+	}
+}
+
+// Records with the same fused score are sorted by cosine similarity.
+func TestReciprocalRankFusionTies(t *testing.T) {
+	vectorRanking := []VectorRecord{{Id: "low", CosineSimilarity: 0.2}}
+	keywordRanking := []VectorRecord{{Id: "high", CosineSimilarity: 0.7}}
+	got := ReciprocalRankFusion(vectorRanking, keywordRanking, 0.5, 10)
+	if len(got) != 2 || got[0].Id != "high" || got[1].Id != "low" {
+		t.Errorf("got %v, want high then low", got)
+	}
+}
+
+// newKeywordTestStore returns a store and its keyword index with one record per text,
+// the "kind" metadata being "doc" for the even records and "code" for the odd ones.
+func newKeywordTestStore(t *testing.T, texts ...string) (*MemoryVectorStore, *BM25Index) {
+	t.Helper()
+	store := &MemoryVectorStore{Records: make(map[string]VectorRecord)}
+	keywords := NewBM25Index()
+	for idx, text := range texts {
+		kind := "doc"
+		if idx%2 == 1 {
+			kind = "code"
+		}
+		record := VectorRecord{Id: string(rune('a' + idx)), Prompt: text, Embedding: HashEmbedding(text, 16), Metadata: map[string]string{"kind": kind}}
+		if _, err := store.Save(record); err != nil {
+			t.Fatal(err)
+		}
+		keywords.Add(record.Id, text)
+	}
+	return store, keywords
+}
+
+func TestKeywordSearch(t *testing.T) {
+	store, keywords := newKeywordTestStore(t,
+		"ERR_TIMEOUT when the server is slow",
+		"ERR_TIMEOUT ERR_TIMEOUT in the client",
+		"ERR_TIMEOUT in the logs",
+		"nothing to see",
+	)
+	// An index entry without record (the index is out of sync with the store) is skipped
+	keywords.Add("missing", "ERR_TIMEOUT")
+
+	cases := []struct {
+		name    string
+		max     int
+		filter  Filter
+		wantIds []string
+	}{
+		{name: "all the matches", max: 10, wantIds: []string{"b", "c", "a"}},
+		{name: "max", max: 2, wantIds: []string{"b", "c"}},
+		{name: "no result", max: 0, wantIds: []string{}},
+		{name: "filter", max: 10, filter: Filter{{Key: "kind", Operator: OperatorEquals, Value: "doc"}}, wantIds: []string{"c", "a"}},
+		{name: "filter and max", max: 1, filter: Filter{{Key: "kind", Operator: OperatorEquals, Value: "doc"}}, wantIds: []string{"c"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := keywordSearch(store, keywords, "err_timeout", VectorRecord{}, tc.max, tc.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, record := range got {
+				ids = append(ids, record.Id)
+				if record.Score <= 0 || record.CosineSimilarity != 0 {
+					t.Errorf("record %s: got score %f and similarity %f, want a BM25 score and no similarity", record.Id, record.Score, record.CosineSimilarity)
+				}
+			}
+			if len(ids) != len(tc.wantIds) {
+				t.Fatalf("got %v, want %v", ids, tc.wantIds)
+			}
+			for idx := range ids {
+				if ids[idx] != tc.wantIds[idx] {
+					t.Fatalf("got %v, want %v", ids, tc.wantIds)
+				}
+			}
+		})
+	}
+}
+
+// The minimum similarity does not apply to the keyword mode, and the hybrid mode fuses both rankings.
+func TestHybridSearchModes(t *testing.T) {
+	store, keywords := newKeywordTestStore(t,
+		"the deployment uses docker compose",
+		"ERR_TIMEOUT in the client",
+		"docker images are rebuilt every night",
+	)
+	question := "docker ERR_TIMEOUT"
+	embedding := VectorRecord{Embedding: HashEmbedding(question, 16)}
+
+	keywordRecords, err := HybridSearch(store, keywords, question, VectorRecord{}, SearchOptions{Mode: SearchModeKeyword, Limit: 0.99, MaxResults: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keywordRecords) != 2 || keywordRecords[0].Id != "b" {
+		t.Errorf("keyword mode: got %v, want 2 records starting with b", keywordRecords)
+	}
+
+	vectorRecords, err := HybridSearch(store, keywords, question, embedding, SearchOptions{Mode: SearchModeVector, Limit: 0.99, MaxResults: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vectorRecords) != 0 {
+		t.Errorf("vector mode: got %v, want no record above the minimum similarity", vectorRecords)
+	}
+
+	hybridRecords, err := HybridSearch(store, keywords, question, embedding, SearchOptions{Mode: SearchModeHybrid, Limit: -1, MaxResults: 3, VectorWeight: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hybridRecords) != 3 {
+		t.Fatalf("hybrid mode: got %v, want 3 records", hybridRecords)
+	}
+	for idx := 1; idx < len(hybridRecords); idx++ {
+		if hybridRecords[idx].Score > hybridRecords[idx-1].Score {
+			t.Errorf("hybrid mode: the records are not sorted by fused score: %v", hybridRecords)
+		}
+	}
+
+	if _, err := HybridSearch(store, keywords, question, embedding, SearchOptions{Mode: "fuzzy", MaxResults: 3}); err == nil {
+		t.Error("unknown mode: got no error")
+	}
+}
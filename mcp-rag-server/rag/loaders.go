@@ -0,0 +1,353 @@
+package rag
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Metadata keys set by the loaders
+const (
+	MetadataFormat = "format" // format of the source document (markdown, html, rst, json, yaml, csv, text, code)
+	MetadataTitle  = "title"  // title of the source document (HTML <title>, first reStructuredText section)
+)
+
+// Document is the text of a file, ready to be chunked, with its metadata.
+type Document struct {
+	Text     string
+	Metadata map[string]string
+	Language string // programming language of a source file (see ChunkSourceCode), "" for the other documents
+}
+
+// Loader converts the content of a file to a Document.
+type Loader func(content []byte) (Document, error)
+
+// loaders is the registry of the loaders, by file extension (lower case, with the dot).
+var loaders = map[string]Loader{
+	".md":       loadMarkdown,
+	".markdown": loadMarkdown,
+	".txt":      loadText,
+	".html":     loadHTML,
+	".htm":      loadHTML,
+	".rst":      loadReStructuredText,
+	".json":     loadJSON,
+	".yaml":     loadYAML,
+	".yml":      loadYAML,
+	".csv":      loadCSV,
+	".go":       sourceCodeLoader("go"),
+	".rs":       sourceCodeLoader("rust"),
+	".swift":    sourceCodeLoader("swift"),
+}
+
+// HasLoader returns true if a loader is registered for the extension.
+func HasLoader(extension string) bool {
+	_, exists := loaders[strings.ToLower(extension)]
+	return exists
+}
+
+// LoaderExtensions returns the extensions of the registered loaders, sorted.
+func LoaderExtensions() []string {
+	extensions := make([]string, 0, len(loaders))
+	for extension := range loaders {
+		extensions = append(extensions, extension)
+	}
+	sort.Strings(extensions)
+	return extensions
+}
+
+// ParseDocument converts the content of a file with the loader of its extension.
+// Files without a registered loader are read as plain text.
+func ParseDocument(path string, content []byte) (Document, error) {
+	loader, exists := loaders[strings.ToLower(filepath.Ext(path))]
+	if !exists {
+		loader = loadText
+	}
+	document, err := loader(content)
+	if err != nil {
+		return Document{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if document.Metadata == nil {
+		document.Metadata = make(map[string]string)
+	}
+	return document, nil
+}
+
+// LoadDocument reads a file and converts it with the loader of its extension (see ParseDocument).
+func LoadDocument(path string) (Document, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return Document{}, err
+	}
+	return ParseDocument(path, content)
+}
+
+// --- Markdown and plain text ---
+
+func loadMarkdown(content []byte) (Document, error) {
+	return Document{Text: string(content), Metadata: map[string]string{MetadataFormat: "markdown"}}, nil
+}
+
+func loadText(content []byte) (Document, error) {
+	return Document{Text: string(content), Metadata: map[string]string{MetadataFormat: "text"}}, nil
+}
+
+// sourceCodeLoader returns a loader of source files: they are chunked at function and type boundaries.
+func sourceCodeLoader(language string) Loader {
+	return func(content []byte) (Document, error) {
+		return Document{
+			Text:     string(content),
+			Metadata: map[string]string{MetadataFormat: "code", MetadataLanguage: language},
+			Language: language,
+		}, nil
+	}
+}
+
+// --- HTML ---
+
+var (
+	htmlTitle         = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	htmlInvisible     = regexp.MustCompile(`(?is)<(script|style|head|noscript|template)\b[^>]*>.*?</(?:script|style|head|noscript|template)>|<!--.*?-->`)
+	htmlHeading       = regexp.MustCompile(`(?is)<h([1-6])\b[^>]*>(.*?)</h[1-6]>`)
+	htmlPreformatted  = regexp.MustCompile(`(?is)<pre\b[^>]*>(.*?)</pre>`)
+	htmlListItem      = regexp.MustCompile(`(?i)<li\b[^>]*>`)
+	htmlBlockBoundary = regexp.MustCompile(`(?i)</?(p|div|section|article|header|footer|main|nav|aside|ul|ol|table|tr|blockquote|dl|dt|dd|figure|br|hr)\b[^>]*>`)
+	htmlTag           = regexp.MustCompile(`(?s)<[^>]+>`)
+	blankLines        = regexp.MustCompile(`\n[ \t]*(\n[ \t]*)+`)
+	horizontalSpaces  = regexp.MustCompile(`[ \t]+`)
+)
+
+// loadHTML strips the tags of an HTML page. Headings become markdown headers
+// and <pre> blocks become fenced code blocks, so the markdown chunkers keep the structure.
+func loadHTML(content []byte) (Document, error) {
+	page := string(content)
+	metadata := map[string]string{MetadataFormat: "html"}
+	if matches := htmlTitle.FindStringSubmatch(page); matches != nil {
+		if title := htmlText(matches[1]); title != "" {
+			metadata[MetadataTitle] = title
+		}
+	}
+
+	page = htmlInvisible.ReplaceAllString(page, "")
+	// Keep the code blocks as they are (only their tags are removed)
+	blocks := []string{}
+	page = htmlPreformatted.ReplaceAllStringFunc(page, func(pre string) string {
+		code := html.UnescapeString(htmlTag.ReplaceAllString(htmlPreformatted.FindStringSubmatch(pre)[1], ""))
+		blocks = append(blocks, "```\n"+strings.Trim(code, "\n")+"\n```")
+		return fmt.Sprintf("\n\n\x00%d\x00\n\n", len(blocks)-1)
+	})
+	page = htmlHeading.ReplaceAllStringFunc(page, func(heading string) string {
+		matches := htmlHeading.FindStringSubmatch(heading)
+		level := int(matches[1][0] - '0')
+		return "\n\n" + strings.Repeat("#", level) + " " + htmlText(matches[2]) + "\n\n"
+	})
+	page = htmlListItem.ReplaceAllString(page, "\n- ")
+	page = htmlBlockBoundary.ReplaceAllString(page, "\n")
+	page = html.UnescapeString(htmlTag.ReplaceAllString(page, ""))
+	page = horizontalSpaces.ReplaceAllString(page, " ")
+
+	lines := strings.Split(page, "\n")
+	for idx, line := range lines {
+		lines[idx] = strings.TrimSpace(line)
+	}
+	page = blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	for idx, block := range blocks {
+		page = strings.Replace(page, fmt.Sprintf("\x00%d\x00", idx), block, 1)
+	}
+	return Document{Text: strings.TrimSpace(page), Metadata: metadata}, nil
+}
+
+// htmlText returns the text of an HTML fragment on a single line.
+func htmlText(fragment string) string {
+	text := html.UnescapeString(htmlTag.ReplaceAllString(fragment, ""))
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// --- reStructuredText ---
+
+// rstAdornmentCharacters are the punctuation characters that can underline (or overline) a section title.
+const rstAdornmentCharacters = "=-~^\"'`#*+:.,_;!?<>/\\|"
+
+// isRSTAdornment returns true if the line is made of the same adornment character, at least 3 times.
+func isRSTAdornment(line string) bool {
+	line = strings.TrimRight(line, " \t")
+	if len(line) < 3 || !strings.ContainsRune(rstAdornmentCharacters, rune(line[0])) {
+		return false
+	}
+	return strings.Count(line, line[:1]) == len(line)
+}
+
+// loadReStructuredText converts the section titles (underlined, and optionally overlined) to markdown headers.
+// The header levels follow the order in which the adornment styles appear, as in reStructuredText.
+func loadReStructuredText(content []byte) (Document, error) {
+	lines := strings.Split(strings.ReplaceAll(string(content), "\r\n", "\n"), "\n")
+	metadata := map[string]string{MetadataFormat: "rst"}
+	styles := []string{}
+	levelOf := func(style string) int {
+		for idx, known := range styles {
+			if known == style {
+				return idx + 1
+			}
+		}
+		styles = append(styles, style)
+		return len(styles)
+	}
+
+	output := []string{}
+	for idx := 0; idx < len(lines); idx++ {
+		line := lines[idx]
+		title := strings.TrimSpace(line)
+
+		// Overlined title: adornment, title, adornment
+		if isRSTAdornment(line) && idx+2 < len(lines) && title != "" &&
+			strings.TrimSpace(lines[idx+1]) != "" && strings.TrimSpace(lines[idx+2]) == title {
+			sectionTitle := strings.TrimSpace(lines[idx+1])
+			level := levelOf("over" + title[:1])
+			output = append(output, strings.Repeat("#", min(level, 6))+" "+sectionTitle)
+			if _, exists := metadata[MetadataTitle]; !exists {
+				metadata[MetadataTitle] = sectionTitle
+			}
+			idx += 2
+			continue
+		}
+		// Underlined title: title, adornment at least as long as the title
+		if title != "" && !isRSTAdornment(line) && idx+1 < len(lines) {
+			underline := strings.TrimSpace(lines[idx+1])
+			if isRSTAdornment(lines[idx+1]) && len([]rune(underline)) >= len([]rune(title)) {
+				level := levelOf(underline[:1])
+				output = append(output, strings.Repeat("#", min(level, 6))+" "+title)
+				if _, exists := metadata[MetadataTitle]; !exists {
+					metadata[MetadataTitle] = title
+				}
+				idx++
+				continue
+			}
+		}
+		output = append(output, line)
+	}
+	return Document{Text: strings.Join(output, "\n"), Metadata: metadata}, nil
+}
+
+// --- JSON and YAML ---
+
+// loadJSON flattens a JSON document to "path: value" lines (see flattenValue).
+func loadJSON(content []byte) (Document, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	lines := []string{}
+	for {
+		var value any
+		err := decoder.Decode(&value)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return Document{}, err
+		}
+		lines = flattenValue("", value, lines)
+	}
+	return Document{Text: strings.Join(lines, "\n"), Metadata: map[string]string{MetadataFormat: "json"}}, nil
+}
+
+// loadYAML flattens a YAML document (or a stream of documents) to "path: value" lines (see flattenValue).
+func loadYAML(content []byte) (Document, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	lines := []string{}
+	for {
+		var value any
+		err := decoder.Decode(&value)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return Document{}, err
+		}
+		if len(lines) > 0 {
+			// Separate the documents of the stream
+			lines = append(lines, "")
+		}
+		lines = flattenValue("", value, lines)
+	}
+	return Document{Text: strings.Join(lines, "\n"), Metadata: map[string]string{MetadataFormat: "yaml"}}, nil
+}
+
+// flattenValue appends a line "path: value" for every scalar of a decoded JSON or YAML value
+// (ex: "server.ports[0]: 8080"), with the keys of the objects sorted.
+func flattenValue(path string, value any, lines []string) []string {
+	switch typed := value.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(typed))
+		for key := range typed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			lines = flattenValue(joinPath(path, key), typed[key], lines)
+		}
+	case map[any]any:
+		converted := make(map[string]any, len(typed))
+		for key, item := range typed {
+			converted[fmt.Sprint(key)] = item
+		}
+		lines = flattenValue(path, converted, lines)
+	case []any:
+		for idx, item := range typed {
+			lines = flattenValue(fmt.Sprintf("%s[%d]", path, idx), item, lines)
+		}
+	case nil:
+		lines = append(lines, strings.TrimPrefix(path+": null", ": "))
+	default:
+		lines = append(lines, strings.TrimPrefix(path+": "+fmt.Sprint(typed), ": "))
+	}
+	return lines
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// --- CSV ---
+
+// loadCSV converts every row to a line of "column: value" pairs, the first row being the header.
+func loadCSV(content []byte) (Document, error) {
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return Document{}, err
+	}
+	if len(rows) == 0 {
+		return Document{Metadata: map[string]string{MetadataFormat: "csv"}}, nil
+	}
+
+	header := rows[0]
+	lines := make([]string, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		pairs := make([]string, 0, len(row))
+		for idx, value := range row {
+			if strings.TrimSpace(value) == "" {
+				continue
+			}
+			column := fmt.Sprintf("column %d", idx+1)
+			if idx < len(header) && strings.TrimSpace(header[idx]) != "" {
+				column = strings.TrimSpace(header[idx])
+			}
+			pairs = append(pairs, column+": "+strings.TrimSpace(value))
+		}
+		lines = append(lines, strings.Join(pairs, ", "))
+	}
+	return Document{Text: strings.Join(lines, "\n"), Metadata: map[string]string{MetadataFormat: "csv"}}, nil
+}
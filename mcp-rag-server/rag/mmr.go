@@ -0,0 +1,49 @@
+package rag
+
+import "math"
+
+// Selection modes of the search results
+const (
+	SelectionTopN = "top" // the most relevant records
+	SelectionMMR  = "mmr" // maximal marginal relevance: relevant records that do not repeat each other
+)
+
+// DefaultMMRLambda favours relevance while discarding the near duplicates (overlapping chunks).
+const DefaultMMRLambda = 0.7
+
+// mmrCandidatesFactor is the number of candidates considered by the MMR selection, per expected result.
+const mmrCandidatesFactor = 4
+
+// SelectMMR selects (at most max) records with Maximal Marginal Relevance: at each step, it picks the record that
+// maximizes lambda * relevance - (1 - lambda) * redundancy, where the relevance is the cosine similarity with the
+// question and the redundancy the highest cosine similarity with the already selected records.
+//
+// lambda is between 0 and 1: 1 is a plain top N selection, 0 only looks for diversity.
+// The records are returned in the order of their selection.
+func SelectMMR(records []VectorRecord, lambda float64, max int) []VectorRecord {
+	lambda = math.Min(math.Max(lambda, 0), 1)
+	selected := make([]VectorRecord, 0, min(max, len(records)))
+	remaining := append([]VectorRecord{}, records...)
+	// redundancy[i] is the highest similarity between remaining[i] and the selected records
+	redundancy := make([]float64, len(remaining))
+
+	for len(selected) < max && len(remaining) > 0 {
+		best := 0
+		bestScore := math.Inf(-1)
+		for idx, record := range remaining {
+			score := lambda*record.CosineSimilarity - (1-lambda)*redundancy[idx]
+			if score > bestScore {
+				best, bestScore = idx, score
+			}
+		}
+		chosen := remaining[best]
+		selected = append(selected, chosen)
+
+		remaining = append(remaining[:best], remaining[best+1:]...)
+		redundancy = append(redundancy[:best], redundancy[best+1:]...)
+		for idx, record := range remaining {
+			redundancy[idx] = math.Max(redundancy[idx], cosineSimilarity(chosen.Embedding, record.Embedding))
+		}
+	}
+	return selected
+}
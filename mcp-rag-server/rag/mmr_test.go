@@ -0,0 +1,45 @@
+package rag
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSelectMMR(t *testing.T) {
+	// "a-copy" is an overlapping chunk of "a", "b" is less relevant but says something else
+	records := []VectorRecord{
+		{Id: "a", Embedding: []float64{1, 0}, CosineSimilarity: 0.95},
+		{Id: "a-copy", Embedding: []float64{0.99, 0.14}, CosineSimilarity: 0.94},
+		{Id: "b", Embedding: []float64{0, 1}, CosineSimilarity: 0.6},
+		{Id: "c", Embedding: []float64{0.7, 0.7}, CosineSimilarity: 0.5},
+	}
+	cases := []struct {
+		name    string
+		records []VectorRecord
+		lambda  float64
+		max     int
+		wantIds []string
+	}{
+		{name: "relevance only", records: records, lambda: 1, max: 3, wantIds: []string{"a", "a-copy", "b"}},
+		{name: "default lambda", records: records, lambda: DefaultMMRLambda, max: 3, wantIds: []string{"a", "b", "a-copy"}},
+		{name: "diversity only", records: records, lambda: 0, max: 2, wantIds: []string{"a", "b"}},
+		{name: "lambda above 1", records: records, lambda: 1.5, max: 2, wantIds: []string{"a", "a-copy"}},
+		{name: "lambda below 0", records: records, lambda: -1, max: 2, wantIds: []string{"a", "b"}},
+		{name: "more than the records", records: records, lambda: 1, max: 10, wantIds: []string{"a", "a-copy", "b", "c"}},
+		{name: "max 0", records: records, lambda: 1, max: 0, wantIds: []string{}},
+		{name: "no records", records: nil, lambda: 1, max: 3, wantIds: []string{}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := recordIds(SelectMMR(tc.records, tc.lambda, tc.max)); !slices.Equal(got, tc.wantIds) {
+				t.Errorf("got %v, want %v", got, tc.wantIds)
+			}
+		})
+	}
+
+	// The records of the caller are not reordered
+	SelectMMR(records, DefaultMMRLambda, 3)
+	if got := recordIds(records); !slices.Equal(got, []string{"a", "a-copy", "b", "c"}) {
+		t.Errorf("got %v, the records were modified", got)
+	}
+}
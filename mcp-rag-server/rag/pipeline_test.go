@@ -0,0 +1,170 @@
+package rag
+
+import (
+	"context"
+	"flag"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// go test ./rag -run TestPipeline -record-fixtures rewrites the replay fixtures after a change of the documents or questions
+var recordFixtures = flag.Bool("record-fixtures", false, "record the embeddings of testdata/pipeline with the hash embedder")
+
+const (
+	pipelineDocumentsPath    = "testdata/pipeline/docs"
+	pipelineFixturesFilePath = "testdata/pipeline/embeddings.fixtures.json"
+	pipelineDimension        = 64
+)
+
+// pipelineCases are the questions about testdata/pipeline/docs with the IDs (source#chunk) of the expected results, in order.
+var pipelineCases = []struct {
+	name     string
+	question string
+	mode     string
+	filter   string
+	max      int
+	want     []string
+}{
+	{
+		name:     "vector search",
+		question: "deploy the containers with docker compose",
+		mode:     SearchModeVector,
+		max:      1,
+		want:     []string{"deploy.md#0"},
+	},
+	{
+		name:     "keyword search",
+		question: "pg_dump",
+		mode:     SearchModeKeyword,
+		max:      3,
+		want:     []string{"backup.md#0"},
+	},
+	{
+		name:     "hybrid search",
+		question: "when does the token expire",
+		mode:     SearchModeHybrid,
+		max:      1,
+		want:     []string{"auth.md#0"},
+	},
+	{
+		name:     "chunk of a document",
+		question: "alert rules of the on-call channel",
+		mode:     SearchModeHybrid,
+		max:      1,
+		want:     []string{"monitoring.md#1"},
+	},
+	{
+		name:     "filter on the source",
+		question: "the database of the server",
+		mode:     SearchModeHybrid,
+		filter:   "source^=monitoring",
+		max:      2,
+		want:     []string{"monitoring.md#0", "monitoring.md#1"},
+	},
+}
+
+func TestPipeline(t *testing.T) {
+	embedders := map[string]Embedder{"hash": &HashEmbedder{Dimension: pipelineDimension}}
+	var recorder *RecordingEmbedder
+	if *recordFixtures {
+		recorder = &RecordingEmbedder{
+			Embedder: embedders["hash"],
+			Fixtures: &EmbeddingFixtures{Embeddings: make(map[string][]float64)},
+			FilePath: pipelineFixturesFilePath,
+		}
+		embedders["hash"] = recorder
+	} else {
+		fixtures, err := LoadEmbeddingFixtures(pipelineFixturesFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		embedders["replay"] = &ReplayEmbedder{Fixtures: fixtures}
+	}
+
+	for embedderName, embedder := range embedders {
+		stores := map[string]VectorStore{
+			"flat": &MemoryVectorStore{Records: make(map[string]VectorRecord)},
+			"hnsw": NewHNSWVectorStore(DefaultHNSWOptions()),
+		}
+		for storeName, store := range stores {
+			keywords := indexPipelineDocuments(t, embedder, store)
+			for _, tc := range pipelineCases {
+				t.Run(embedderName+"/"+storeName+"/"+tc.name, func(t *testing.T) {
+					filter, err := ParseFilter(tc.filter)
+					if err != nil {
+						t.Fatal(err)
+					}
+					questionEmbeddings, report := CreateEmbeddings(context.Background(), embedder, []string{tc.question}, DefaultEmbeddingOptions())
+					if report.Failed > 0 {
+						t.Fatal(report.Errors)
+					}
+					records, err := HybridSearch(store, keywords, tc.question, VectorRecord{Embedding: questionEmbeddings[0]}, SearchOptions{
+						Mode:         tc.mode,
+						Limit:        -1,
+						MaxResults:   tc.max,
+						VectorWeight: 0.5,
+						Filter:       filter,
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+					got := make([]string, len(records))
+					for idx, record := range records {
+						got[idx] = record.Id
+					}
+					if !slices.Equal(got, tc.want) {
+						t.Errorf("got %v, want %v", got, tc.want)
+					}
+				})
+			}
+		}
+	}
+
+	if recorder != nil {
+		if err := recorder.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// indexPipelineDocuments chunks, embeds and saves the documents of testdata/pipeline/docs (with source#chunk IDs),
+// and returns their keyword index.
+func indexPipelineDocuments(t *testing.T, embedder Embedder, store VectorStore) *BM25Index {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(pipelineDocumentsPath, "*.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := []VectorRecord{}
+	for _, path := range paths {
+		document, err := LoadDocument(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		source, err := filepath.Rel(pipelineDocumentsPath, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, ChunkDocument(filepath.ToSlash(source), document, ChunkOptions{Method: ChunkMethodCode, MaxTokens: 60})...)
+	}
+
+	texts := make([]string, len(chunks))
+	for idx, chunk := range chunks {
+		texts[idx] = chunk.Prompt
+	}
+	embeddings, report := CreateEmbeddings(context.Background(), embedder, texts, DefaultEmbeddingOptions())
+	if report.Failed > 0 {
+		t.Fatal(report.Errors)
+	}
+	keywords := NewBM25Index()
+	for idx, chunk := range chunks {
+		chunk.Id = chunk.Metadata[MetadataSource] + "#" + chunk.Metadata[MetadataChunk]
+		chunk.Embedding = embeddings[idx]
+		if _, err := store.Save(chunk); err != nil {
+			t.Fatal(err)
+		}
+		keywords.Add(chunk.Id, chunk.Prompt)
+	}
+	return keywords
+}
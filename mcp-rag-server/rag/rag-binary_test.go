@@ -0,0 +1,211 @@
+package rag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// binaryTestRecords returns records with metadata and 16-dimension embeddings.
+func binaryTestRecords() map[string]VectorRecord {
+	records := make(map[string]VectorRecord)
+	for _, vector := range randomVectors(11, 5, 16) {
+		record := testRecord(len(records))
+		record.Embedding = vector
+		record.CosineSimilarity = 0.5
+		records[record.Id] = record
+	}
+	return records
+}
+
+func encodeTestStore(t *testing.T, records map[string]VectorRecord, format string) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	if err := encodeBinaryStore(&buffer, "test-model", 16, records, format); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestBinaryStoreRoundTrip(t *testing.T) {
+	cases := []struct {
+		format    string
+		tolerance func(vector []float64) float64 // maximum error of a value
+	}{
+		{format: StoreFormatFloat32, tolerance: func([]float64) float64 { return 1e-6 }},
+		{
+			format: StoreFormatInt8,
+			tolerance: func(vector []float64) float64 {
+				// Half a quantization step (and the float32 rounding of the minimum and the scale)
+				minimum, maximum := vector[0], vector[0]
+				for _, value := range vector {
+					minimum, maximum = math.Min(minimum, value), math.Max(maximum, value)
+				}
+				return (maximum-minimum)/255/2 + 1e-5
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.format, func(t *testing.T) {
+			records := binaryTestRecords()
+			content := encodeTestStore(t, records, tc.format)
+			if !isBinaryStore(content) {
+				t.Fatal("the file does not start with the magic")
+			}
+
+			model, dimension, decoded, err := decodeBinaryStore(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if model != "test-model" || dimension != 16 || len(decoded) != len(records) {
+				t.Fatalf("got model %q, dimension %d and %d records", model, dimension, len(decoded))
+			}
+			for id, record := range records {
+				got := decoded[id]
+				if got.Prompt != record.Prompt || got.Metadata["group"] != record.Metadata["group"] || got.CosineSimilarity != 0 {
+					t.Errorf("got record %+v, want %+v without its similarity", got, record)
+				}
+				tolerance := tc.tolerance(record.Embedding)
+				for i, value := range record.Embedding {
+					if math.Abs(got.Embedding[i]-value) > tolerance {
+						t.Errorf("record %s, dimension %d: got %f, want %f (±%g)", id, i, got.Embedding[i], value, tolerance)
+					}
+				}
+				if similarity := cosineSimilarity(got.Embedding, record.Embedding); similarity < 0.999 {
+					t.Errorf("record %s: the decoded vector has a cosine similarity of %f with the original", id, similarity)
+				}
+			}
+
+			// The records are sorted by ID: the same records give the same file
+			if tc.format == StoreFormatFloat32 && !bytes.Equal(encodeTestStore(t, decoded, tc.format), content) {
+				t.Error("encoding the decoded records does not give the same file")
+			}
+		})
+	}
+}
+
+func TestQuantizeConstantVector(t *testing.T) {
+	quantized := make([]uint8, 3)
+	minimum, scale := quantize([]float64{0.25, 0.25, 0.25}, quantized)
+	if minimum != 0.25 || scale != 0 || quantized[0] != 0 {
+		t.Errorf("got minimum %f, scale %f and %v", minimum, scale, quantized)
+	}
+}
+
+func TestEncodeBinaryStoreChecksTheDimension(t *testing.T) {
+	records := binaryTestRecords()
+	record := records["record-000"]
+	record.Embedding = record.Embedding[:8]
+	records[record.Id] = record
+	if err := encodeBinaryStore(io.Discard, "test-model", 16, records, StoreFormatFloat32); err == nil {
+		t.Error("got no error for a record of another dimension")
+	}
+}
+
+func TestDecodeCorruptBinaryStore(t *testing.T) {
+	valid := encodeTestStore(t, binaryTestRecords(), StoreFormatFloat32)
+	// Offsets of the header fields (with the 10 bytes of "test-model")
+	const (
+		versionOffset      = 4
+		encodingOffset     = 6
+		dimensionOffset    = 9 + 10
+		countOffset        = dimensionOffset + 4
+		recordLengthOffset = countOffset + 4
+	)
+	modified := func(offset int, value any) []byte {
+		content := bytes.Clone(valid)
+		var field bytes.Buffer
+		binary.Write(&field, binary.LittleEndian, value)
+		copy(content[offset:], field.Bytes())
+		return content
+	}
+
+	cases := []struct {
+		name    string
+		content []byte
+		wantErr string
+		wantEOF bool
+	}{
+		{name: "empty file", content: []byte{}, wantErr: "not a binary vector store file"},
+		{name: "wrong magic", content: append([]byte("RAGX"), valid[4:]...), wantErr: "not a binary vector store file"},
+		{name: "truncated header", content: valid[:7], wantEOF: true},
+		{name: "truncated model", content: valid[:12], wantEOF: true},
+		{name: "truncated record", content: valid[:len(valid)-10], wantEOF: true},
+		{name: "newer version", content: modified(versionOffset, uint16(99)), wantErr: "unsupported binary vector store version 99"},
+		{name: "unknown encoding", content: modified(encodingOffset, uint8(7)), wantErr: "unsupported binary vector store encoding 7"},
+		{name: "corrupt count", content: modified(countOffset, uint32(1_000_000_000)), wantEOF: true},
+		{name: "corrupt dimension", content: modified(dimensionOffset, uint32(1_000_000_000)), wantEOF: true},
+		{name: "corrupt record length", content: modified(recordLengthOffset, uint32(1_000_000_000)), wantEOF: true},
+		{name: "corrupt record", content: modified(recordLengthOffset+4, []byte("}")), wantErr: "invalid character"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, _, err := decodeBinaryStore(tc.content)
+			switch {
+			case err == nil:
+				t.Fatal("got no error")
+			case tc.wantEOF && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF):
+				t.Errorf("got %v, want an unexpected end of file", err)
+			case !tc.wantEOF && !strings.Contains(err.Error(), tc.wantErr):
+				t.Errorf("got %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadBinaryStore(t *testing.T) {
+	storeFilePath := filepath.Join(t.TempDir(), "store.bin")
+	store := &MemoryVectorStore{Model: "model-a", Format: StoreFormatInt8, Records: make(map[string]VectorRecord)}
+	for _, record := range binaryTestRecords() {
+		if _, err := store.Save(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Persist(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another model: the store is not loaded
+	other := &MemoryVectorStore{Model: "model-b", Records: make(map[string]VectorRecord)}
+	var modelMismatch *ModelMismatchError
+	if err := other.Load(storeFilePath); !errors.As(err, &modelMismatch) {
+		t.Fatalf("got %v, want a model mismatch", err)
+	}
+	if modelMismatch.StoredModel != "model-a" || modelMismatch.StoredDimension != 16 || modelMismatch.ExpectedModel != "model-b" {
+		t.Errorf("got %+v", modelMismatch)
+	}
+	if other.Count() != 0 {
+		t.Errorf("got %d records loaded, want none", other.Count())
+	}
+
+	// The same model in another format: the file is migrated to float32
+	loaded := &MemoryVectorStore{Model: "model-a", Format: StoreFormatFloat32, Records: make(map[string]VectorRecord)}
+	if err := loaded.Load(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Count() != 5 || loaded.Dimension != 16 {
+		t.Errorf("got %d records of dimension %d", loaded.Count(), loaded.Dimension)
+	}
+	content, err := os.ReadFile(storeFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content[6] != binaryEncodingFloat32 {
+		t.Errorf("got encoding %d, want the file migrated to float32", content[6])
+	}
+
+	// No expected model: the model of the file is adopted
+	adopted := &MemoryVectorStore{Records: make(map[string]VectorRecord)}
+	if err := adopted.Load(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if adopted.Model != "model-a" {
+		t.Errorf("got model %q, want model-a", adopted.Model)
+	}
+}
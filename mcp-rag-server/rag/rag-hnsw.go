@@ -0,0 +1,244 @@
+package rag
+
+import (
+	"log"
+	"os"
+	"sort"
+)
+
+// HNSWVectorStore is a MemoryVectorStore with an HNSW index for approximate nearest neighbour search.
+// Searches walk the graph instead of scanning every record;
+// ExactSearchTopNSimilarities is still available to validate the results.
+// The graph is persisted next to the store file (with an ".hnsw" suffix).
+type HNSWVectorStore struct {
+	MemoryVectorStore
+	Index *HNSWIndex
+}
+
+// NewHNSWVectorStore creates an empty store with the given index options.
+func NewHNSWVectorStore(options HNSWOptions) *HNSWVectorStore {
+	return &HNSWVectorStore{
+		MemoryVectorStore: MemoryVectorStore{
+			Records: make(map[string]VectorRecord),
+		},
+		Index: NewHNSWIndex(options),
+	}
+}
+
+// Save saves the vector record in the store and adds it to the index.
+func (hvs *HNSWVectorStore) Save(vectorRecord VectorRecord) (VectorRecord, error) {
+	hvs.mutex.Lock()
+	defer hvs.mutex.Unlock()
+	vectorRecord, err := hvs.save(vectorRecord)
+	if err != nil {
+		return vectorRecord, err
+	}
+	hvs.Index.Add(vectorRecord.Id, vectorRecord.Embedding)
+	return vectorRecord, nil
+}
+
+// Delete removes the vector record from the store and from the index.
+func (hvs *HNSWVectorStore) Delete(id string) error {
+	hvs.mutex.Lock()
+	defer hvs.mutex.Unlock()
+	if err := hvs.delete(id); err != nil {
+		return err
+	}
+	hvs.Index.Remove(id)
+	return nil
+}
+
+// SearchSimilarities returns the records found by the index with a cosine similarity greater than or equal to the limit.
+// Only the EfSearch closest records are considered: use the MemoryVectorStore method for an exhaustive search.
+func (hvs *HNSWVectorStore) SearchSimilarities(embeddingFromQuestion VectorRecord, limit float64) ([]VectorRecord, error) {
+	hvs.mutex.RLock()
+	defer hvs.mutex.RUnlock()
+	if err := hvs.checkDimension(embeddingFromQuestion.Embedding); err != nil {
+		return nil, err
+	}
+	return hvs.searchIndex(embeddingFromQuestion, limit, hvs.Index.Options.EfSearch), nil
+}
+
+// SearchTopNSimilarities returns the (at most max) records closest to the question according to the index,
+// with a cosine similarity greater than or equal to the limit.
+func (hvs *HNSWVectorStore) SearchTopNSimilarities(embeddingFromQuestion VectorRecord, limit float64, max int) ([]VectorRecord, error) {
+	hvs.mutex.RLock()
+	defer hvs.mutex.RUnlock()
+	if err := hvs.checkDimension(embeddingFromQuestion.Embedding); err != nil {
+		return nil, err
+	}
+	return hvs.searchIndex(embeddingFromQuestion, limit, max), nil
+}
+
+// SearchTopNSimilaritiesWithFilter returns the (at most max) records matching the filter that are the closest
+// to the question according to the index. The number of candidates taken from the index grows until
+// enough records match; when the filter is too selective, it falls back to an exact search on the matching records.
+func (hvs *HNSWVectorStore) SearchTopNSimilaritiesWithFilter(embeddingFromQuestion VectorRecord, limit float64, max int, filter Filter) ([]VectorRecord, error) {
+	if len(filter) == 0 {
+		return hvs.SearchTopNSimilarities(embeddingFromQuestion, limit, max)
+	}
+	hvs.mutex.RLock()
+	defer hvs.mutex.RUnlock()
+	if err := hvs.checkDimension(embeddingFromQuestion.Embedding); err != nil {
+		return nil, err
+	}
+	if max <= 0 {
+		return []VectorRecord{}, nil
+	}
+	for candidates := max * 4; candidates <= hvs.Index.Options.EfSearch*16; candidates *= 2 {
+		found := hvs.searchIndex(embeddingFromQuestion, -1, candidates)
+		records := []VectorRecord{}
+		reachedLimit := false
+		for _, record := range found {
+			if record.CosineSimilarity < limit {
+				reachedLimit = true
+				break
+			}
+			if filter.Match(record) {
+				records = append(records, record)
+			}
+		}
+		// Stop when there are enough records, or when the next candidates are under the limit
+		if len(records) >= max || reachedLimit || len(found) < candidates {
+			return getTopNVectorRecords(records, max), nil
+		}
+	}
+	records, err := hvs.searchSimilaritiesWithFilter(embeddingFromQuestion, limit, filter)
+	if err != nil {
+		return nil, err
+	}
+	return getTopNVectorRecords(records, max), nil
+}
+
+// ExactSearchTopNSimilarities scans every record (like MemoryVectorStore.SearchTopNSimilarities),
+// to validate the results of the index.
+func (hvs *HNSWVectorStore) ExactSearchTopNSimilarities(embeddingFromQuestion VectorRecord, limit float64, max int) ([]VectorRecord, error) {
+	return hvs.MemoryVectorStore.SearchTopNSimilarities(embeddingFromQuestion, limit, max)
+}
+
+// searchIndex returns the records found by the index (the caller holds the mutex).
+func (hvs *HNSWVectorStore) searchIndex(embeddingFromQuestion VectorRecord, limit float64, max int) []VectorRecord {
+	records := []VectorRecord{}
+	for _, match := range hvs.Index.Search(embeddingFromQuestion.Embedding, max, 0) {
+		if match.CosineSimilarity < limit {
+			continue
+		}
+		record, exists := hvs.Records[match.Id]
+		if !exists {
+			continue
+		}
+		record.CosineSimilarity = match.CosineSimilarity
+		records = append(records, record)
+	}
+	return records
+}
+
+// EstimateRecall measures the quality of the index: it uses (at most) samples records of the store as questions
+// and returns the average proportion of the exact top max records that the index finds.
+func (hvs *HNSWVectorStore) EstimateRecall(samples int, max int) float64 {
+	hvs.mutex.RLock()
+	defer hvs.mutex.RUnlock()
+	ids := make([]string, 0, len(hvs.Records))
+	for id := range hvs.Records {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if samples > len(ids) {
+		samples = len(ids)
+	}
+	if samples <= 0 || max <= 0 {
+		return 0
+	}
+
+	total := 0.0
+	step := len(ids) / samples
+	for i := range samples {
+		question := hvs.Records[ids[i*step]]
+		similar, _ := hvs.searchSimilaritiesWithFilter(question, -1, nil)
+		exact := getTopNVectorRecords(similar, max)
+		approximate := hvs.searchIndex(question, -1, max)
+		found := make(map[string]bool)
+		for _, record := range approximate {
+			found[record.Id] = true
+		}
+		hits := 0
+		for _, record := range exact {
+			if found[record.Id] {
+				hits++
+			}
+		}
+		if len(exact) > 0 {
+			total += float64(hits) / float64(len(exact))
+		}
+	}
+	return total / float64(samples)
+}
+
+// Load loads the records from the store file and the graph from the index file.
+// The graph is rebuilt when the index file is missing or out of sync with the records.
+func (hvs *HNSWVectorStore) Load(storeFilePath string) error {
+	if err := hvs.MemoryVectorStore.Load(storeFilePath); err != nil {
+		return err
+	}
+	hvs.mutex.Lock()
+	defer hvs.mutex.Unlock()
+
+	index, inSync, err := LoadHNSWIndex(hnswIndexFilePath(storeFilePath), func(id string) ([]float64, bool) {
+		record, exists := hvs.Records[id]
+		return record.Embedding, exists
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && inSync && index.Count() == len(hvs.Records) {
+		index.Options.EfSearch = hvs.Index.Options.EfSearch
+		hvs.Index = index
+		return nil
+	}
+
+	log.Println("🕸️ Building the HNSW index of", len(hvs.Records), "records...")
+	hvs.rebuildIndex()
+	return hvs.Index.Persist(hnswIndexFilePath(storeFilePath))
+}
+
+// Persist writes the records to the store file and the graph to the index file.
+func (hvs *HNSWVectorStore) Persist(storeFilePath string) error {
+	// Locked for writing: the index may be rebuilt
+	hvs.mutex.Lock()
+	defer hvs.mutex.Unlock()
+	if err := hvs.persist(storeFilePath); err != nil {
+		return err
+	}
+	if hvs.Index.DeletedRatio() > hnswMaxDeletedRatio {
+		// Too many deleted nodes to walk through: compact the graph
+		hvs.rebuildIndex()
+	}
+	return hvs.Index.Persist(hnswIndexFilePath(storeFilePath))
+}
+
+// ResetMemory removes all the records and empties the index.
+func (hvs *HNSWVectorStore) ResetMemory() error {
+	hvs.mutex.Lock()
+	defer hvs.mutex.Unlock()
+	hvs.Index = NewHNSWIndex(hvs.Index.Options)
+	hvs.resetMemory()
+	return nil
+}
+
+// rebuildIndex creates a new graph from the records of the store, in a stable order (the caller holds the mutex for writing).
+func (hvs *HNSWVectorStore) rebuildIndex() {
+	index := NewHNSWIndex(hvs.Index.Options)
+	ids := make([]string, 0, len(hvs.Records))
+	for id := range hvs.Records {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		index.Add(id, hvs.Records[id].Embedding)
+	}
+	hvs.Index = index
+}
+
+func hnswIndexFilePath(storeFilePath string) string {
+	return storeFilePath + ".hnsw"
+}
@@ -0,0 +1,243 @@
+package rag
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// newHNSWTestStore returns an HNSW store with the given vectors (record-000, record-001...).
+func newHNSWTestStore(t *testing.T, options HNSWOptions, vectors [][]float64) *HNSWVectorStore {
+	t.Helper()
+	store := NewHNSWVectorStore(options)
+	for idx, vector := range vectors {
+		record := testRecord(idx)
+		record.Embedding = vector
+		if _, err := store.Save(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func recordIds(records []VectorRecord) []string {
+	ids := make([]string, len(records))
+	for idx, record := range records {
+		ids[idx] = record.Id
+	}
+	return ids
+}
+
+// The index finds almost all the exact nearest neighbours.
+func TestHNSWRecallAgainstBruteForce(t *testing.T) {
+	const topN = 10
+	store := newHNSWTestStore(t, DefaultHNSWOptions(), randomVectors(42, 1000, 32))
+
+	questions := randomVectors(7, 50, 32)
+	hits := 0
+	for _, question := range questions {
+		exact, err := store.ExactSearchTopNSimilarities(VectorRecord{Embedding: question}, -1, topN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		approximate, err := store.SearchTopNSimilarities(VectorRecord{Embedding: question}, -1, topN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, record := range exact {
+			if slices.Contains(recordIds(approximate), record.Id) {
+				hits++
+			}
+		}
+	}
+	if recall := float64(hits) / float64(len(questions)*topN); recall < 0.95 {
+		t.Errorf("got a recall of %.3f, want at least 0.95", recall)
+	}
+	if recall := store.EstimateRecall(50, topN); recall < 0.95 {
+		t.Errorf("EstimateRecall returned %.3f, want at least 0.95", recall)
+	}
+}
+
+func TestHNSWEstimateRecall(t *testing.T) {
+	empty := NewHNSWVectorStore(DefaultHNSWOptions())
+	if recall := empty.EstimateRecall(10, 5); recall != 0 {
+		t.Errorf("empty store: got %f, want 0", recall)
+	}
+	// Fewer records than EfSearch: the graph search sees all of them
+	store := newHNSWTestStore(t, DefaultHNSWOptions(), randomVectors(3, 30, 8))
+	if recall := store.EstimateRecall(100, 5); recall != 1 {
+		t.Errorf("got %f, want 1", recall)
+	}
+	if recall := store.EstimateRecall(0, 5); recall != 0 {
+		t.Errorf("no sample: got %f, want 0", recall)
+	}
+}
+
+// The graph is rebuilt by Persist once more than 20% of its nodes are deleted.
+func TestHNSWRebuildOverTheDeletedRatio(t *testing.T) {
+	storeFilePath := filepath.Join(t.TempDir(), "store.bin")
+	store := newHNSWTestStore(t, DefaultHNSWOptions(), randomVectors(4, 10, 8))
+
+	for _, idx := range []int{0, 1} {
+		if err := store.Delete(testRecord(idx).Id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Persist(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.Index.nodes) != 10 || store.Index.DeletedRatio() != 0.2 {
+		t.Fatalf("got %d nodes and a deleted ratio of %f, want the tombstones kept at 0.2", len(store.Index.nodes), store.Index.DeletedRatio())
+	}
+
+	if err := store.Delete(testRecord(2).Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Persist(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.Index.nodes) != 7 || store.Index.DeletedRatio() != 0 {
+		t.Errorf("got %d nodes and a deleted ratio of %f, want a rebuilt graph of 7 nodes", len(store.Index.nodes), store.Index.DeletedRatio())
+	}
+}
+
+func TestHNSWSearchWithFilter(t *testing.T) {
+	vectors := randomVectors(5, 1000, 16)
+	question := vectors[0]
+	// The only "rare" record is the opposite of the question: no graph search reaches it
+	opposite := make([]float64, len(question))
+	for idx, value := range question {
+		opposite[idx] = -value
+	}
+	vectors = append(vectors, opposite)
+	store := newHNSWTestStore(t, HNSWOptions{EfSearch: 4}, vectors)
+	rare := testRecord(len(vectors) - 1)
+	rare.Embedding = opposite
+	rare.Metadata = map[string]string{"group": "rare"}
+	if _, err := store.Save(rare); err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(recordIds(store.searchIndex(VectorRecord{Embedding: question}, -1, store.Index.Options.EfSearch*16)), rare.Id) {
+		t.Fatal("the graph search reaches the rare record: the exact search fallback is not tested")
+	}
+
+	cases := []struct {
+		name    string
+		filter  Filter
+		limit   float64
+		max     int
+		wantIds []string
+	}{
+		{
+			name:    "exact search when the filter is too selective",
+			filter:  Filter{{Key: "group", Operator: OperatorEquals, Value: "rare"}},
+			limit:   -1,
+			max:     3,
+			wantIds: []string{rare.Id},
+		},
+		{
+			name:    "the limit applies to the exact search",
+			filter:  Filter{{Key: "group", Operator: OperatorEquals, Value: "rare"}},
+			limit:   0,
+			max:     3,
+			wantIds: []string{},
+		},
+		{
+			name:    "no result",
+			filter:  Filter{{Key: "group", Operator: OperatorEquals, Value: "even"}},
+			limit:   -1,
+			max:     0,
+			wantIds: []string{},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			records, err := store.SearchTopNSimilaritiesWithFilter(VectorRecord{Embedding: question}, tc.limit, tc.max, tc.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := recordIds(records); !slices.Equal(got, tc.wantIds) {
+				t.Errorf("got %v, want %v", got, tc.wantIds)
+			}
+		})
+	}
+
+	// A filter matching half of the records: more candidates are taken from the index until 5 of them match
+	filter := Filter{{Key: "group", Operator: OperatorEquals, Value: "even"}}
+	records, err := store.SearchTopNSimilaritiesWithFilter(VectorRecord{Embedding: question}, -1, 5, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 || records[0].Id != testRecord(0).Id {
+		t.Fatalf("got %v, want 5 records starting with the question", recordIds(records))
+	}
+	for _, record := range records {
+		if record.Metadata["group"] != "even" {
+			t.Errorf("record %s does not match the filter", record.Id)
+		}
+	}
+}
+
+// Deleted records stay deleted after a reload, and the persisted graph (with its tombstones) is reused.
+func TestHNSWDeletePersistAndReload(t *testing.T) {
+	storeFilePath := filepath.Join(t.TempDir(), "store.bin")
+	vectors := randomVectors(6, 50, 16)
+	store := newHNSWTestStore(t, DefaultHNSWOptions(), vectors)
+	deleted := []string{}
+	for _, idx := range []int{1, 7, 13, 21, 34} {
+		deleted = append(deleted, testRecord(idx).Id)
+		if err := store.Delete(testRecord(idx).Id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Persist(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewHNSWVectorStore(DefaultHNSWOptions())
+	if err := loaded.Load(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Count() != 45 || loaded.Index.Count() != 45 {
+		t.Fatalf("got %d records and %d indexed vectors, want 45", loaded.Count(), loaded.Index.Count())
+	}
+	if loaded.Index.DeletedRatio() != 0.1 {
+		t.Errorf("got a deleted ratio of %f, want the persisted graph and its 5 tombstones", loaded.Index.DeletedRatio())
+	}
+	for _, idx := range []int{1, 7, 13} {
+		records, err := loaded.SearchTopNSimilarities(VectorRecord{Embedding: vectors[idx]}, -1, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range recordIds(records) {
+			if slices.Contains(deleted, id) {
+				t.Errorf("the deleted record %s is found after the reload", id)
+			}
+		}
+	}
+	for _, idx := range []int{0, 10, 49} {
+		records, err := loaded.SearchTopNSimilarities(VectorRecord{Embedding: vectors[idx]}, -1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 || records[0].Id != testRecord(idx).Id {
+			t.Errorf("got %v, want %s", recordIds(records), testRecord(idx).Id)
+		}
+	}
+
+	// Without the graph file, the graph is rebuilt from the records (without tombstones)
+	if err := os.Remove(hnswIndexFilePath(storeFilePath)); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt := NewHNSWVectorStore(DefaultHNSWOptions())
+	if err := rebuilt.Load(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt.Index.Count() != 45 || rebuilt.Index.DeletedRatio() != 0 {
+		t.Errorf("got %d indexed vectors and a deleted ratio of %f, want a rebuilt graph", rebuilt.Index.Count(), rebuilt.Index.DeletedRatio())
+	}
+	if _, err := os.Stat(hnswIndexFilePath(storeFilePath)); err != nil {
+		t.Errorf("the rebuilt graph is not persisted: %v", err)
+	}
+}
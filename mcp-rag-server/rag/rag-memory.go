@@ -1,31 +1,77 @@
 package rag
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/google/uuid"
 )
 
 type VectorRecord struct {
-	Id               string    `json:"id"`
-	Prompt           string    `json:"prompt"`
-	Embedding        []float64 `json:"embedding"`
+	Id               string            `json:"id"`
+	Prompt           string            `json:"prompt"`
+	Embedding        []float64         `json:"embedding"`
+	Metadata         map[string]string `json:"metadata,omitempty"` // see MetadataSource, MetadataLanguage, MetadataTags, MetadataHeaderLevel, MetadataChunk
 	CosineSimilarity float64
+	Score            float64 `json:"-"` // ranking score of the last search (cosine similarity, BM25 or fused score)
 }
 
 type VectorStore interface {
 	GetAll() ([]VectorRecord, error)
+	GetByID(id string) (VectorRecord, error)
 	Save(vectorRecord VectorRecord) (VectorRecord, error)
+	Delete(id string) error
 	SearchSimilarities(embeddingFromQuestion VectorRecord, limit float64) ([]VectorRecord, error)
 	SearchTopNSimilarities(embeddingFromQuestion VectorRecord, limit float64, max int) ([]VectorRecord, error)
+	SearchTopNSimilaritiesWithFilter(embeddingFromQuestion VectorRecord, limit float64, max int, filter Filter) ([]VectorRecord, error)
+}
+
+// PersistentVectorStore is a VectorStore that is loaded from and persisted to a file.
+type PersistentVectorStore interface {
+	VectorStore
+	Count() int
+	Load(storeFilePath string) error
+	Persist(storeFilePath string) error
+	ExportJSON(jsonFilePath string) error
+	ResetMemory() error
+}
+
+// ErrDimensionMismatch is returned when a vector does not have the dimension of the store.
+var ErrDimensionMismatch = errors.New("embedding dimension mismatch")
+
+// ModelMismatchError is returned by Load when the store was created with another embedding model
+// than the expected one: the vectors cannot be compared with the vectors of the expected model.
+type ModelMismatchError struct {
+	StoredModel     string
+	StoredDimension int
+	ExpectedModel   string
+}
+
+func (e *ModelMismatchError) Error() string {
+	return fmt.Sprintf("the vector store was created with the embedding model %s (%d dimensions), not with %s", e.StoredModel, e.StoredDimension, e.ExpectedModel)
 }
 
 type MemoryVectorStore struct {
-	Records map[string]VectorRecord
+	Model     string `json:"Model,omitempty"`     // name of the embedding model that produced the vectors
+	Dimension int    `json:"Dimension,omitempty"` // dimension of the vectors (set by the first saved record)
+	Records   map[string]VectorRecord
+	Format    string `json:"-"` // file format written by Persist: StoreFormatFloat32 (default), StoreFormatInt8 or StoreFormatJSON
+
+	// mutex protects the records: the MCP servers handle the requests concurrently,
+	// so records can be saved or deleted while other requests search them
+	mutex sync.RWMutex
 }
 
 func (mvs *MemoryVectorStore) GetAll() ([]VectorRecord, error) {
+	mvs.mutex.RLock()
+	defer mvs.mutex.RUnlock()
 	var records []VectorRecord
 	for _, record := range mvs.Records {
 		records = append(records, record)
@@ -33,11 +79,42 @@ func (mvs *MemoryVectorStore) GetAll() ([]VectorRecord, error) {
 	return records, nil
 }
 
+// Count returns the number of records of the store.
+func (mvs *MemoryVectorStore) Count() int {
+	mvs.mutex.RLock()
+	defer mvs.mutex.RUnlock()
+	return len(mvs.Records)
+}
+
+// GetByID returns the vector record with the given ID, or an error if it does not exist.
+func (mvs *MemoryVectorStore) GetByID(id string) (VectorRecord, error) {
+	mvs.mutex.RLock()
+	defer mvs.mutex.RUnlock()
+	record, exists := mvs.Records[id]
+	if !exists {
+		return VectorRecord{}, fmt.Errorf("vector record %s not found", id)
+	}
+	return record, nil
+}
+
 // Save saves a vector record to the MemoryVectorStore.
 // If the record does not have an ID, it generates a new UUID for it.
 // It returns the saved vector record and an error if any occurred during the save operation.
 // If the record already exists, it will be overwritten.
 func (mvs *MemoryVectorStore) Save(vectorRecord VectorRecord) (VectorRecord, error) {
+	mvs.mutex.Lock()
+	defer mvs.mutex.Unlock()
+	return mvs.save(vectorRecord)
+}
+
+// save saves the vector record (the caller holds the mutex for writing).
+func (mvs *MemoryVectorStore) save(vectorRecord VectorRecord) (VectorRecord, error) {
+	if err := mvs.checkDimension(vectorRecord.Embedding); err != nil {
+		return vectorRecord, err
+	}
+	if mvs.Dimension == 0 {
+		mvs.Dimension = len(vectorRecord.Embedding)
+	}
 	if vectorRecord.Id == "" {
 		vectorRecord.Id = uuid.New().String()
 	}
@@ -45,6 +122,22 @@ func (mvs *MemoryVectorStore) Save(vectorRecord VectorRecord) (VectorRecord, err
 	return vectorRecord, nil
 }
 
+// Delete removes the vector record with the given ID, or returns an error if it does not exist.
+func (mvs *MemoryVectorStore) Delete(id string) error {
+	mvs.mutex.Lock()
+	defer mvs.mutex.Unlock()
+	return mvs.delete(id)
+}
+
+// delete removes the vector record (the caller holds the mutex for writing).
+func (mvs *MemoryVectorStore) delete(id string) error {
+	if _, exists := mvs.Records[id]; !exists {
+		return fmt.Errorf("vector record %s not found", id)
+	}
+	delete(mvs.Records, id)
+	return nil
+}
+
 // SearchSimilarities searches for vector records in the MemoryVectorStore that have a cosine distance similarity greater than or equal to the given limit.
 //
 // Parameters:
@@ -55,10 +148,23 @@ func (mvs *MemoryVectorStore) Save(vectorRecord VectorRecord) (VectorRecord, err
 //   - []llm.VectorRecord: a slice of vector records that have a cosine distance similarity greater than or equal to the limit.
 //   - error: an error if any occurred during the search.
 func (mvs *MemoryVectorStore) SearchSimilarities(embeddingFromQuestion VectorRecord, limit float64) ([]VectorRecord, error) {
+	mvs.mutex.RLock()
+	defer mvs.mutex.RUnlock()
+	return mvs.searchSimilaritiesWithFilter(embeddingFromQuestion, limit, nil)
+}
+
+// searchSimilaritiesWithFilter scans every record (the caller holds the mutex).
+func (mvs *MemoryVectorStore) searchSimilaritiesWithFilter(embeddingFromQuestion VectorRecord, limit float64, filter Filter) ([]VectorRecord, error) {
+	if err := mvs.checkDimension(embeddingFromQuestion.Embedding); err != nil {
+		return nil, err
+	}
 
 	var records []VectorRecord
 
 	for _, v := range mvs.Records {
+		if !filter.Match(v) {
+			continue
+		}
 		distance := cosineSimilarity(embeddingFromQuestion.Embedding, v.Embedding)
 		if distance >= limit {
 			v.CosineSimilarity = distance
@@ -73,34 +179,148 @@ func (mvs *MemoryVectorStore) SearchSimilarities(embeddingFromQuestion VectorRec
 // The limit parameter specifies the minimum similarity score for a record to be considered similar.
 // The max parameter specifies the maximum number of vector records to return.
 func (mvs *MemoryVectorStore) SearchTopNSimilarities(embeddingFromQuestion VectorRecord, limit float64, max int) ([]VectorRecord, error) {
-	records, err := mvs.SearchSimilarities(embeddingFromQuestion, limit)
+	mvs.mutex.RLock()
+	defer mvs.mutex.RUnlock()
+	records, err := mvs.searchSimilaritiesWithFilter(embeddingFromQuestion, limit, nil)
+	if err != nil {
+		return nil, err
+	}
+	return getTopNVectorRecords(records, max), nil
+}
+
+// SearchTopNSimilaritiesWithFilter works like SearchTopNSimilarities,
+// but only the records whose metadata match the filter are considered.
+func (mvs *MemoryVectorStore) SearchTopNSimilaritiesWithFilter(embeddingFromQuestion VectorRecord, limit float64, max int, filter Filter) ([]VectorRecord, error) {
+	mvs.mutex.RLock()
+	defer mvs.mutex.RUnlock()
+	records, err := mvs.searchSimilaritiesWithFilter(embeddingFromQuestion, limit, filter)
 	if err != nil {
 		return nil, err
 	}
 	return getTopNVectorRecords(records, max), nil
 }
 
+// Load loads the store from a file written by Persist, whatever its format (JSON or binary).
+// A file that is not in the format of the store (mvs.Format) is migrated: it is persisted again in that format.
+//
+// If the store has a Model, it is the expected embedding model: a file created with another model
+// is not loaded and a *ModelMismatchError is returned. A file without model (created before the model
+// was recorded) is adopted by the expected model.
 func (mvs *MemoryVectorStore) Load(storeFilePath string) error {
 	// Check if the store file exists
 	if _, err := os.Stat(storeFilePath); os.IsNotExist(err) {
 		return err
 	}
 
-	// Read the store file
-	file, err := os.ReadFile(storeFilePath)
+	loaded, fileFormat, err := readStoreFile(storeFilePath)
 	if err != nil {
 		return err
 	}
 
-	// Unmarshal the JSON into the vector store
-	if err := json.Unmarshal(file, &mvs); err != nil {
-		return err
+	mvs.mutex.Lock()
+	defer mvs.mutex.Unlock()
+	migrate := fileFormat != mvs.format()
+	switch {
+	case mvs.Model != "" && loaded.Model != "" && loaded.Model != mvs.Model:
+		return &ModelMismatchError{StoredModel: loaded.Model, StoredDimension: loaded.Dimension, ExpectedModel: mvs.Model}
+	case mvs.Model != "" && loaded.Model == "":
+		log.Println("⚠️ The vector store", storeFilePath, "does not record its embedding model, assuming", mvs.Model)
+		migrate = true
+	default:
+		mvs.Model = loaded.Model
+	}
+	mvs.Dimension = loaded.Dimension
+	mvs.Records = loaded.Records
+	if mvs.Records == nil {
+		mvs.Records = make(map[string]VectorRecord)
 	}
 
+	if migrate {
+		log.Println("📦 Migrating the vector store", storeFilePath, "from", fileFormat, "to", mvs.format())
+		return mvs.persist(storeFilePath)
+	}
 	return nil
 }
 
+// readStoreFile reads a store file (binary or JSON) and returns the store and the format of the file.
+func readStoreFile(storeFilePath string) (*MemoryVectorStore, string, error) {
+	loaded := &MemoryVectorStore{}
+	file, err := os.ReadFile(storeFilePath)
+	if err != nil {
+		return loaded, "", err
+	}
+
+	fileFormat := StoreFormatJSON
+	if isBinaryStore(file) {
+		loaded.Model, loaded.Dimension, loaded.Records, err = decodeBinaryStore(file)
+		if err != nil {
+			return loaded, "", err
+		}
+		fileFormat = StoreFormatFloat32
+		if file[len(binaryStoreMagic)+2] == binaryEncodingInt8 {
+			fileFormat = StoreFormatInt8
+		}
+	} else if err := json.Unmarshal(file, loaded); err != nil {
+		// Unmarshal the JSON into the vector store
+		return loaded, "", err
+	}
+
+	// Check the records dimension (stores created before the dimension was recorded)
+	for _, record := range loaded.Records {
+		if loaded.Dimension == 0 {
+			loaded.Dimension = len(record.Embedding)
+		}
+		if len(record.Embedding) != loaded.Dimension {
+			return loaded, "", fmt.Errorf("%w: vector record %s has %d dimensions, expected %d", ErrDimensionMismatch, record.Id, len(record.Embedding), loaded.Dimension)
+		}
+	}
+	return loaded, fileFormat, nil
+}
+
+// CopyStoreFile writes the store file sourceFilePath (binary or JSON) to targetFilePath in the format,
+// unless targetFilePath already exists. It returns false when nothing was written (or sourceFilePath does not exist).
+func CopyStoreFile(sourceFilePath string, targetFilePath string, format string) (bool, error) {
+	if _, err := os.Stat(targetFilePath); err == nil {
+		return false, nil
+	}
+	loaded, _, err := readStoreFile(sourceFilePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	loaded.Format = format
+	return true, loaded.persist(targetFilePath)
+}
+
+// Persist writes the store to a file, in the format of the store (see Format).
+// The file is replaced atomically: a crash while writing leaves the previous file intact.
 func (mvs *MemoryVectorStore) Persist(storeFilePath string) error {
+	mvs.mutex.RLock()
+	defer mvs.mutex.RUnlock()
+	return mvs.persist(storeFilePath)
+}
+
+// persist writes the store to a file (the caller holds the mutex).
+func (mvs *MemoryVectorStore) persist(storeFilePath string) error {
+	if mvs.format() == StoreFormatJSON {
+		return mvs.exportJSON(storeFilePath)
+	}
+	return writeFileAtomically(storeFilePath, func(writer io.Writer) error {
+		return encodeBinaryStore(writer, mvs.Model, mvs.Dimension, mvs.Records, mvs.format())
+	})
+}
+
+// ExportJSON writes the store to a JSON file (to debug or to share a store), whatever the format of the store.
+func (mvs *MemoryVectorStore) ExportJSON(jsonFilePath string) error {
+	mvs.mutex.RLock()
+	defer mvs.mutex.RUnlock()
+	return mvs.exportJSON(jsonFilePath)
+}
+
+// exportJSON writes the store to a JSON file (the caller holds the mutex).
+func (mvs *MemoryVectorStore) exportJSON(jsonFilePath string) error {
 	// Marshal the store to JSON
 	storeJSON, err := json.MarshalIndent(mvs, "", "  ")
 	if err != nil {
@@ -108,16 +328,59 @@ func (mvs *MemoryVectorStore) Persist(storeFilePath string) error {
 	}
 
 	// Write the JSON to a file
+	return writeFileAtomically(jsonFilePath, func(writer io.Writer) error {
+		_, err := writer.Write(storeJSON)
+		return err
+	})
+}
 
-	err = os.WriteFile(storeFilePath, storeJSON, 0644)
+// writeFileAtomically writes a file through a temporary file of the same directory, renamed at the end:
+// the readers (and the next start after a crash) see either the previous file or the new one, never a truncated file.
+func writeFileAtomically(filePath string, write func(writer io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*.tmp")
 	if err != nil {
 		return err
 	}
+	// Nothing to remove once the file is renamed
+	defer os.Remove(file.Name())
+
+	buffer := bufio.NewWriter(file)
+	if err := errors.Join(write(buffer), buffer.Flush(), file.Chmod(0644), file.Sync()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filePath)
+}
+
+// checkDimension returns an ErrDimensionMismatch error if the store has vectors of another dimension
+// (the caller holds the mutex).
+func (mvs *MemoryVectorStore) checkDimension(embedding []float64) error {
+	if mvs.Dimension != 0 && len(embedding) != mvs.Dimension {
+		return fmt.Errorf("%w: got %d dimensions, the store (model %s) has %d", ErrDimensionMismatch, len(embedding), mvs.Model, mvs.Dimension)
+	}
 	return nil
 }
 
+func (mvs *MemoryVectorStore) format() string {
+	if mvs.Format == "" {
+		return StoreFormatFloat32
+	}
+	return mvs.Format
+}
+
 func (mvs *MemoryVectorStore) ResetMemory() error {
+	mvs.mutex.Lock()
+	defer mvs.mutex.Unlock()
+	mvs.resetMemory()
+	return nil
+}
+
+// resetMemory removes all the records (the caller holds the mutex for writing).
+func (mvs *MemoryVectorStore) resetMemory() {
 	// Reset the vector store to a new empty MemoryVectorStore
 	mvs.Records = make(map[string]VectorRecord)
-	return nil
+	mvs.Dimension = 0
 }
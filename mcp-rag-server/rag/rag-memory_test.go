@@ -0,0 +1,215 @@
+package rag
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// testStores create the persistent stores to test, with the file to persist them to.
+var testStores = []struct {
+	name     string
+	newStore func() PersistentVectorStore
+	fileName string
+}{
+	{
+		name:     "memory",
+		newStore: func() PersistentVectorStore { return &MemoryVectorStore{Records: make(map[string]VectorRecord)} },
+		fileName: "store.bin",
+	},
+	{
+		name:     "hnsw",
+		newStore: func() PersistentVectorStore { return NewHNSWVectorStore(DefaultHNSWOptions()) },
+		fileName: "store.bin",
+	},
+	{
+		name:     "bolt",
+		newStore: func() PersistentVectorStore { return NewBoltVectorStore("") },
+		fileName: "store.db",
+	},
+}
+
+// testRecord returns a record with a hash embedding of its ID and a "group" metadata (even or odd).
+func testRecord(idx int) VectorRecord {
+	id := fmt.Sprintf("record-%03d", idx)
+	group := "even"
+	if idx%2 == 1 {
+		group = "odd"
+	}
+	return VectorRecord{
+		Id:        id,
+		Prompt:    "text of " + id,
+		Embedding: HashEmbedding(id, 32),
+		Metadata:  map[string]string{"group": group},
+	}
+}
+
+// closeStore closes the database of a bolt store (the other stores have nothing to close).
+func closeStore(t *testing.T, store PersistentVectorStore) {
+	t.Helper()
+	if boltStore, ok := store.(*BoltVectorStore); ok {
+		if err := boltStore.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Run with go test -race: the tools save, delete, search and persist the store at the same time.
+func TestConcurrentStoreAccess(t *testing.T) {
+	const initialRecords = 100
+	const workers = 4
+	const operations = 25
+
+	for _, tc := range testStores {
+		t.Run(tc.name, func(t *testing.T) {
+			storeFilePath := filepath.Join(t.TempDir(), tc.fileName)
+			store := tc.newStore()
+			for idx := range initialRecords {
+				if _, err := store.Save(testRecord(idx)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			errs := make(chan error, workers*operations*4)
+			var wg sync.WaitGroup
+			for worker := range workers {
+				wg.Add(4)
+				// Save new records
+				go func() {
+					defer wg.Done()
+					for op := range operations {
+						if _, err := store.Save(testRecord(initialRecords + worker*operations + op)); err != nil {
+							errs <- err
+						}
+					}
+				}()
+				// Delete the initial records (every worker its own ones)
+				go func() {
+					defer wg.Done()
+					for idx := worker; idx < initialRecords; idx += workers {
+						if err := store.Delete(testRecord(idx).Id); err != nil {
+							errs <- err
+						}
+					}
+				}()
+				// Search with a filter
+				go func() {
+					defer wg.Done()
+					filter := Filter{{Key: "group", Operator: OperatorEquals, Value: "even"}}
+					for op := range operations {
+						records, err := store.SearchTopNSimilaritiesWithFilter(testRecord(op), -1, 5, filter)
+						if err != nil {
+							errs <- err
+							continue
+						}
+						for _, record := range records {
+							if record.Metadata["group"] != "even" {
+								errs <- fmt.Errorf("record %s does not match the filter", record.Id)
+							}
+						}
+					}
+				}()
+				// Persist
+				go func() {
+					defer wg.Done()
+					for range operations / 5 {
+						if err := store.Persist(storeFilePath); err != nil {
+							errs <- err
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Error(err)
+			}
+
+			// Only the new records are left, and they are all persisted
+			if count := store.Count(); count != workers*operations {
+				t.Fatalf("got %d records, want %d", count, workers*operations)
+			}
+			if err := store.Persist(storeFilePath); err != nil {
+				t.Fatal(err)
+			}
+			closeStore(t, store)
+
+			loaded := tc.newStore()
+			if err := loaded.Load(storeFilePath); err != nil {
+				t.Fatal(err)
+			}
+			defer closeStore(t, loaded)
+			records, err := loaded.GetAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]string, len(records))
+			for idx, record := range records {
+				ids[idx] = record.Id
+			}
+			slices.Sort(ids)
+			want := make([]string, 0, workers*operations)
+			for idx := initialRecords; idx < initialRecords+workers*operations; idx++ {
+				want = append(want, testRecord(idx).Id)
+			}
+			if !slices.Equal(ids, want) {
+				t.Errorf("loaded %v, want %v", ids, want)
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomicallyKeepsThePreviousFile(t *testing.T) {
+	storeFilePath := filepath.Join(t.TempDir(), "store.json")
+	store := &MemoryVectorStore{Format: StoreFormatJSON, Records: make(map[string]VectorRecord)}
+	if _, err := store.Save(testRecord(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Persist(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+	previous, err := os.ReadFile(storeFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A write failing in the middle of the file
+	errWrite := errors.New("disk full")
+	err = writeFileAtomically(storeFilePath, func(writer io.Writer) error {
+		if _, err := writer.Write([]byte(`{"records":`)); err != nil {
+			return err
+		}
+		return errWrite
+	})
+	if !errors.Is(err, errWrite) {
+		t.Fatalf("got error %v, want %v", err, errWrite)
+	}
+
+	content, err := os.ReadFile(storeFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != string(previous) {
+		t.Errorf("the store file was modified by the failed write:\n%s", content)
+	}
+	loaded := &MemoryVectorStore{Records: make(map[string]VectorRecord)}
+	if err := loaded.Load(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Count() != 1 {
+		t.Errorf("got %d records, want 1", loaded.Count())
+	}
+	// The temporary file is removed
+	files, err := filepath.Glob(filepath.Join(filepath.Dir(storeFilePath), "*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) > 0 {
+		t.Errorf("temporary files left: %v", files)
+	}
+}
@@ -0,0 +1,198 @@
+package rag
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/openai/openai-go/v2"
+)
+
+// Reranker scores the relevance of records to a question more precisely (and more slowly) than the cosine similarity.
+type Reranker interface {
+	// Score returns one relevance score per record (higher is more relevant), in the order of the records.
+	Score(ctx context.Context, question string, records []VectorRecord) ([]float64, error)
+}
+
+// Rerank sorts the records by decreasing relevance score of the reranker and returns the (at most topK) best ones.
+// The Score of the returned records is the relevance score; their CosineSimilarity is unchanged.
+func Rerank(ctx context.Context, reranker Reranker, question string, records []VectorRecord, topK int) ([]VectorRecord, error) {
+	if len(records) == 0 {
+		return records, nil
+	}
+	scores, err := reranker.Score(ctx, question, records)
+	if err != nil {
+		return nil, err
+	}
+	if len(scores) != len(records) {
+		return nil, fmt.Errorf("the reranker returned %d scores for %d records", len(scores), len(records))
+	}
+
+	reranked := make([]VectorRecord, len(records))
+	copy(reranked, records)
+	for idx := range reranked {
+		reranked[idx].Score = scores[idx]
+	}
+	sort.SliceStable(reranked, func(i, j int) bool {
+		return reranked[i].Score > reranked[j].Score
+	})
+	if len(reranked) > topK {
+		reranked = reranked[:topK]
+	}
+	return reranked, nil
+}
+
+// --- Reranker endpoint ---
+
+// Formats of the rerank endpoints
+const (
+	RerankFormatOpenAI = "openai" // POST /rerank {model, query, documents} -> {results: [{index, relevance_score}]} (llama.cpp, vLLM, Jina, Cohere)
+	RerankFormatTEI    = "tei"    // POST /rerank {query, texts} -> [{index, score}] (Hugging Face Text Embeddings Inference)
+)
+
+// EndpointReranker scores the records with a cross-encoder served by a /rerank endpoint.
+type EndpointReranker struct {
+	BaseURL    string // the "/rerank" path is added to this URL
+	Model      string
+	Format     string // RerankFormatOpenAI (default) or RerankFormatTEI
+	HTTPClient *http.Client
+}
+
+type rerankResult struct {
+	Index          int      `json:"index"`
+	RelevanceScore *float64 `json:"relevance_score"` // openai format
+	Score          *float64 `json:"score"`           // tei format
+}
+
+// Score sends the prompts of the records to the rerank endpoint.
+func (er *EndpointReranker) Score(ctx context.Context, question string, records []VectorRecord) ([]float64, error) {
+	documents := make([]string, len(records))
+	for idx, record := range records {
+		documents[idx] = record.Prompt
+	}
+
+	var payload any
+	switch er.Format {
+	case RerankFormatTEI:
+		payload = map[string]any{"query": question, "texts": documents}
+	case RerankFormatOpenAI, "":
+		payload = map[string]any{"model": er.Model, "query": question, "documents": documents, "top_n": len(documents)}
+	default:
+		return nil, fmt.Errorf("unknown rerank format %q (expected %s or %s)", er.Format, RerankFormatOpenAI, RerankFormatTEI)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(er.BaseURL, "/")+"/rerank", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	httpClient := er.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rerank endpoint: %s: %s", response.Status, strings.TrimSpace(string(content)))
+	}
+
+	// TEI returns an array, the other servers an object with the results
+	var results []rerankResult
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &results)
+	} else {
+		var wrapped struct {
+			Results []rerankResult `json:"results"`
+		}
+		err = json.Unmarshal(trimmed, &wrapped)
+		results = wrapped.Results
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rerank endpoint: invalid response: %w", err)
+	}
+
+	scores := make([]float64, len(records))
+	found := make([]bool, len(records))
+	for _, result := range results {
+		if result.Index < 0 || result.Index >= len(records) {
+			return nil, fmt.Errorf("rerank endpoint: invalid document index %d", result.Index)
+		}
+		switch {
+		case result.RelevanceScore != nil:
+			scores[result.Index] = *result.RelevanceScore
+		case result.Score != nil:
+			scores[result.Index] = *result.Score
+		default:
+			return nil, fmt.Errorf("rerank endpoint: no score for document %d", result.Index)
+		}
+		found[result.Index] = true
+	}
+	for idx, ok := range found {
+		if !ok {
+			return nil, fmt.Errorf("rerank endpoint: no score for document %d", idx)
+		}
+	}
+	return scores, nil
+}
+
+// --- LLM reranker ---
+
+// llmRerankSystemPrompt asks the chat model for a grade only, so the answer is easy to parse.
+const llmRerankSystemPrompt = `You are a search relevance grader.
+Given a question and a document, grade how useful the document is to answer the question,
+from 0 (unrelated) to 10 (it contains the answer).
+Answer with the grade only, a single number, without any explanation.`
+
+var firstNumber = regexp.MustCompile(`\d+(?:\.\d+)?`)
+
+// LLMReranker scores the records by asking a chat model to grade each of them (one request per record).
+// It is slower than a cross-encoder, but works with any chat model.
+type LLMReranker struct {
+	Client openai.Client
+	Model  string
+}
+
+// Score grades the records between 0 and 1.
+func (lr *LLMReranker) Score(ctx context.Context, question string, records []VectorRecord) ([]float64, error) {
+	scores := make([]float64, len(records))
+	for idx, record := range records {
+		completion, err := lr.Client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
+			Model: lr.Model,
+			Messages: []openai.ChatCompletionMessageParamUnion{
+				openai.SystemMessage(llmRerankSystemPrompt),
+				openai.UserMessage("Question: " + question + "\n\nDocument:\n" + record.Prompt),
+			},
+			Temperature: openai.Float(0),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(completion.Choices) == 0 {
+			return nil, fmt.Errorf("the chat model returned no grade for record %s", record.Id)
+		}
+		grade, err := strconv.ParseFloat(firstNumber.FindString(completion.Choices[0].Message.Content), 64)
+		if err != nil {
+			return nil, fmt.Errorf("the chat model returned an invalid grade for record %s: %q", record.Id, completion.Choices[0].Message.Content)
+		}
+		scores[idx] = min(grade, 10) / 10
+	}
+	return scores, nil
+}
@@ -0,0 +1,217 @@
+package rag
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Snippet is a code snippet of a snippets file, written as:
+//
+//	## Title
+//	One-line description
+//	```language
+//	code
+//	```
+type Snippet struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Language    string `json:"language,omitempty"` // see NormalizeLanguage
+	Code        string `json:"code,omitempty"`
+	Source      string `json:"source,omitempty"` // path of the snippets file
+}
+
+// ParseSnippet reads the title (the first header), the description (the text between the header and the code block)
+// and the first fenced code block of a snippet. The missing parts are left empty.
+func ParseSnippet(text string) Snippet {
+	snippet := Snippet{}
+	description := []string{}
+	code := []string{}
+	fence := ""
+	codeRead := false
+	for _, line := range strings.Split(text, "\n") {
+		newFence := updateFence(fence, line)
+		switch {
+		case codeRead:
+			// Only the first code block is the code of the snippet
+		case fence == "" && newFence != "":
+			if matches := firstFenceInfo.FindStringSubmatch(line); matches != nil {
+				snippet.Language = NormalizeLanguage(matches[1])
+			}
+		case fence != "" && newFence == "":
+			codeRead = true
+		case fence != "":
+			code = append(code, line)
+		case snippet.Title == "" && len(description) == 0 && markdownHeader.MatchString(line):
+			snippet.Title = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#"))
+		case strings.TrimSpace(line) != "":
+			description = append(description, strings.TrimSpace(line))
+		}
+		fence = newFence
+	}
+	snippet.Description = strings.Join(description, " ")
+	snippet.Code = strings.Join(code, "\n")
+	return snippet
+}
+
+// SnippetFromRecord returns the snippet of a vector record (the snippet text is the prompt of the record).
+func SnippetFromRecord(record VectorRecord) Snippet {
+	snippet := ParseSnippet(record.Prompt)
+	snippet.Source = record.Metadata[MetadataSource]
+	return snippet
+}
+
+// SnippetEmbeddingScheme identifies the texts embedded for a snippet by ChunkSnippet. It is saved in the metadata
+// of the records (MetadataEmbedding): the records embedded with other texts must be embedded again.
+const SnippetEmbeddingScheme = "title-description-chunks"
+
+// CountOutdatedSnippetRecords returns the number of records of the store that were not embedded with the SnippetEmbeddingScheme.
+func CountOutdatedSnippetRecords(store VectorStore) (int, error) {
+	records, err := store.GetAll()
+	if err != nil {
+		return 0, err
+	}
+	outdated := 0
+	for _, record := range records {
+		if record.Metadata[MetadataEmbedding] != SnippetEmbeddingScheme {
+			outdated++
+		}
+	}
+	return outdated, nil
+}
+
+// EmbeddingText returns the text to embed for the snippet: its title and its description,
+// which say what the snippet does in the words of a question (the code matches the questions poorly).
+// The code is used when the snippet has neither.
+func (snippet Snippet) EmbeddingText() string {
+	text := strings.TrimSpace(snippet.Title + "\n" + snippet.Description)
+	if text == "" {
+		return snippet.Code
+	}
+	return text
+}
+
+// SnippetChunk is a chunk of a snippet split by ChunkSnippet.
+type SnippetChunk struct {
+	Text          string // the part of the snippet: the texts of the chunks, in order, are the snippet
+	EmbeddingText string // the text to embed for the chunk
+}
+
+// ChunkSnippet splits a snippet longer than chunkSize runes (0: never) into chunks. The first chunk embeds
+// the title and the description of the snippet (see EmbeddingText), the next ones embed the title and their text,
+// after the last overlap runes of the previous chunk (for an embedding model with a small context).
+func ChunkSnippet(text string, chunkSize int, overlap int) []SnippetChunk {
+	snippet := ParseSnippet(text)
+	runes := []rune(text)
+	if chunkSize <= 0 || len(runes) <= chunkSize {
+		return []SnippetChunk{{Text: text, EmbeddingText: snippet.EmbeddingText()}}
+	}
+	if overlap < 0 || overlap >= chunkSize {
+		overlap = 0
+	}
+	chunks := []SnippetChunk{}
+	step := chunkSize - overlap
+	for start := 0; start < len(runes); start += step {
+		end := min(start+step, len(runes))
+		chunk := SnippetChunk{Text: string(runes[start:end])}
+		if start == 0 {
+			chunk.EmbeddingText = snippet.EmbeddingText()
+		} else {
+			chunk.EmbeddingText = strings.TrimSpace(snippet.Title + "\n" + string(runes[max(start-overlap, 0):end]))
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// GroupSnippetChunks returns the records of the chunks of every snippet (see MetadataSnippet) in the order of the chunks,
+// the snippets being sorted by source and position. A record without snippet ID is a whole snippet.
+func GroupSnippetChunks(records []VectorRecord) [][]VectorRecord {
+	position := func(record VectorRecord) int {
+		chunk, _ := strconv.Atoi(record.Metadata[MetadataChunk])
+		return chunk
+	}
+	sorted := append([]VectorRecord{}, records...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Metadata[MetadataSource] != sorted[j].Metadata[MetadataSource] {
+			return sorted[i].Metadata[MetadataSource] < sorted[j].Metadata[MetadataSource]
+		}
+		if position(sorted[i]) != position(sorted[j]) {
+			return position(sorted[i]) < position(sorted[j])
+		}
+		return sorted[i].Id < sorted[j].Id
+	})
+
+	snippets := [][]VectorRecord{}
+	indexes := make(map[string]int)
+	for _, record := range sorted {
+		id := SnippetIDOf(record)
+		if idx, exists := indexes[id]; exists {
+			snippets[idx] = append(snippets[idx], record)
+			continue
+		}
+		indexes[id] = len(snippets)
+		snippets = append(snippets, []VectorRecord{record})
+	}
+	return snippets
+}
+
+// SnippetIDOf returns the ID of the snippet of a record: its MetadataSnippet, or its own ID.
+func SnippetIDOf(record VectorRecord) string {
+	if id := record.Metadata[MetadataSnippet]; id != "" {
+		return id
+	}
+	return record.Id
+}
+
+// SnippetText returns the text of a snippet from the records of its chunks, in order (see GroupSnippetChunks).
+func SnippetText(chunks []VectorRecord) string {
+	var text strings.Builder
+	for _, chunk := range chunks {
+		text.WriteString(chunk.Prompt)
+	}
+	return text.String()
+}
+
+// Markdown returns the snippet in the format of the snippets files (title header, description, fenced code block).
+func (snippet Snippet) Markdown() string {
+	markdown := "## " + snippet.Title + "\n"
+	if snippet.Description != "" {
+		markdown += snippet.Description + "\n"
+	}
+	// A longer fence when the code contains one
+	fence := "```"
+	for strings.Contains(snippet.Code, fence) {
+		fence += "`"
+	}
+	return markdown + fence + snippet.Language + "\n" + strings.TrimRight(snippet.Code, "\n") + "\n" + fence + "\n"
+}
+
+// AppendSnippet adds the snippet text at the end of the content of a snippets file, after a delimiter.
+func AppendSnippet(content string, delimiter string, snippetText string) string {
+	if strings.TrimSpace(content) == "" {
+		return snippetText
+	}
+	return strings.TrimRight(content, "\n") + "\n\n" + delimiter + "\n\n" + snippetText
+}
+
+// RemoveSnippet removes the snippet text (and its delimiter) from the content of a snippets file.
+// It returns false when the content does not contain the snippet.
+func RemoveSnippet(content string, delimiter string, snippetText string) (string, bool) {
+	parts := SplitTextWithDelimiter(content, delimiter)
+	for idx, part := range parts {
+		if strings.TrimSpace(part) != strings.TrimSpace(snippetText) {
+			continue
+		}
+		parts = append(parts[:idx], parts[idx+1:]...)
+		remaining := make([]string, len(parts))
+		for partIdx, part := range parts {
+			remaining[partIdx] = strings.TrimSpace(part)
+		}
+		if len(remaining) == 0 {
+			return "", true
+		}
+		return strings.Join(remaining, "\n\n"+delimiter+"\n\n") + "\n", true
+	}
+	return content, false
+}
@@ -3,10 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
@@ -19,8 +27,41 @@ import (
 )
 
 var client openai.Client
-var store rag.MemoryVectorStore
+var store rag.PersistentVectorStore
 var embeddingsModel string
+var embedder rag.Embedder
+var embeddingBreaker *rag.CircuitBreakerEmbedder
+var embeddingOptions rag.EmbeddingOptions
+var embeddingCache *rag.EmbeddingCache
+var embeddingCacheFilePath string
+var keywordIndex *rag.BM25Index
+var defaultSearchMode string
+var hybridVectorWeight float64
+var defaultLimit float64
+var defaultMaxResults int
+var maxResultsCeiling int
+var minSimilarityFloor float64
+var defaultSelection string
+var defaultMMRLambda float64
+var reranker rag.Reranker
+var rerankCandidates int
+var queryRewriter *rag.QueryRewriter
+var defaultQueryExpansion string
+var storeFilePath string // JSON_STORE_FILE_PATH (with the .bin extension in a binary format), or BOLT_STORE_FILE_PATH with VECTOR_STORE=bolt
+
+// storeMutex protects the store, the keyword index and the snippets files: the snippet tools modify them while searches read them
+var storeMutex sync.RWMutex
+
+// snippetsPath is the directory of the snippets files (DOCUMENTS_PATH), where add_snippet writes
+var snippetsPath string
+
+// snippetDelimiter separates the snippets of a snippets file (SNIPPET_DELIMITER)
+var snippetDelimiter string
+
+// chunkSize and chunkOverlap split the long snippets (CHUNK_SIZE, CHUNK_OVERLAP), see rag.ChunkSnippet
+var chunkSize int
+var chunkOverlap int
+var mcpServer *server.MCPServer // the snippet tools update its resources
 
 func main() {
 	ctx := context.Background()
@@ -29,7 +70,11 @@ func main() {
 	s := server.NewMCPServer(
 		"mcp-snippets-server",
 		"0.0.0",
+		// The snippets files are resources: the list changes with add_snippet and delete_snippet
+		server.WithResourceCapabilities(false, true),
+		server.WithPromptCapabilities(false),
 	)
+	mcpServer = s
 
 	// Ensure MODEL_RUNNER_BASE_URL is set in the environment
 	if os.Getenv("MODEL_RUNNER_BASE_URL") == "" {
@@ -43,24 +88,221 @@ func main() {
 		os.Setenv("JSON_STORE_FILE_PATH", "rag-memory-store.json")
 	}
 
+	// Ensure DOCUMENTS_PATH is set in the environment
+	if os.Getenv("DOCUMENTS_PATH") == "" {
+		os.Setenv("DOCUMENTS_PATH", "snippets")
+	}
+
 	llmURL := os.Getenv("MODEL_RUNNER_BASE_URL")
 	embeddingsModel = os.Getenv("EMBEDDING_MODEL")
 	jsonStoreFilePath := os.Getenv("JSON_STORE_FILE_PATH")
+	snippetsPath = os.Getenv("DOCUMENTS_PATH")
+
+	// SNIPPET_DELIMITER: the line between two snippets of a snippets file
+	snippetDelimiter = os.Getenv("SNIPPET_DELIMITER")
+	if snippetDelimiter == "" {
+		snippetDelimiter = "----------"
+	}
+	// DOCUMENTS_INCLUDE, DOCUMENTS_EXCLUDE: comma-separated glob patterns of the files of DOCUMENTS_PATH to index (or not)
+	// ex: DOCUMENTS_INCLUDE=snippets-*.md DOCUMENTS_EXCLUDE=drafts,README.md
+	documentsInclude := splitPatterns(os.Getenv("DOCUMENTS_INCLUDE"))
+	if len(documentsInclude) == 0 {
+		documentsInclude = []string{"*.md"}
+	}
+	documentsExclude := splitPatterns(os.Getenv("DOCUMENTS_EXCLUDE"))
+	// CHUNK_SIZE, CHUNK_OVERLAP: a snippet longer than CHUNK_SIZE characters is embedded in chunks overlapping by CHUNK_OVERLAP
+	// characters (for an embedding model with a small context), 0 keeps every snippet whole.
+	// The chunks of a snippet share its ID: the tools always return, list and delete whole snippets
+	chunkSize = getIntEnv("CHUNK_SIZE", 1024)
+	chunkOverlap = getIntEnv("CHUNK_OVERLAP", 256)
+	if chunkSize > 0 && chunkOverlap >= chunkSize {
+		log.Println("⚠️ Chunk overlap must be smaller than the chunk size, the overlap will be ignored.")
+	}
 
 	client = openai.NewClient(
 		option.WithBaseURL(llmURL),
 		option.WithAPIKey(""),
 	)
 
+	// EMBEDDER: "openai" (EMBEDDING_MODEL of MODEL_RUNNER_BASE_URL, default), "hash" (local and deterministic, no model),
+	// "replay" (embeddings recorded in EMBEDDING_FIXTURES_FILE, offline) or "record" (EMBEDDING_MODEL, recording its embeddings)
+	var errEmbedder error
+	embedder, errEmbedder = rag.NewEmbedder(rag.EmbedderConfig{
+		Kind:             os.Getenv("EMBEDDER"),
+		Client:           client,
+		Model:            embeddingsModel,
+		Dimension:        getIntEnv("EMBEDDING_DIMENSION", rag.DefaultHashEmbeddingDimension),
+		FixturesFilePath: os.Getenv("EMBEDDING_FIXTURES_FILE"),
+	})
+	if errEmbedder != nil {
+		log.Fatalln("😡 Error creating the embedder:", errEmbedder)
+	}
+	if os.Getenv("EMBEDDER") == rag.EmbedderRecord {
+		// The recorded embeddings (of the questions too) are written regularly, not after every request
+		go func() {
+			for range time.Tick(embeddingCachePersistInterval) {
+				flushEmbeddingFixtures()
+			}
+		}()
+	}
+	// EMBEDDING_BREAKER_THRESHOLD: consecutive failed embeddings requests that open the circuit (the requests then fail immediately)
+	// EMBEDDING_BREAKER_COOLDOWN: seconds before a request checks whether the model runner is back
+	embeddingBreaker = rag.NewCircuitBreakerEmbedder(embedder,
+		getIntEnv("EMBEDDING_BREAKER_THRESHOLD", 5),
+		time.Duration(getIntEnv("EMBEDDING_BREAKER_COOLDOWN", 30))*time.Second,
+	)
+	embedder = embeddingBreaker
+	// The vector store and the embedding cache record the model of the embeddings
+	embeddingsModel = embedder.ModelName()
+
+	embeddingOptions = rag.DefaultEmbeddingOptions()
+	embeddingOptions.BatchSize = getIntEnv("EMBEDDING_BATCH_SIZE", embeddingOptions.BatchSize)
+	embeddingOptions.Workers = getIntEnv("EMBEDDING_WORKERS", embeddingOptions.Workers)
+	embeddingOptions.MaxRetries = getIntEnv("EMBEDDING_MAX_RETRIES", embeddingOptions.MaxRetries)
+
+	// -------------------------------------------------
+	// Embedding cache: unchanged snippets and repeated topics are not embedded again
+	// -------------------------------------------------
+	// EMBEDDING_CACHE_MAX_ENTRIES: number of embeddings kept in the cache (0 disables the cache)
+	// EMBEDDING_CACHE_MAX_MB: size of the embeddings kept in the cache
+	if maxEntries := getIntEnv("EMBEDDING_CACHE_MAX_ENTRIES", 10000); maxEntries > 0 {
+		embeddingCache = rag.NewEmbeddingCache(maxEntries, getIntEnv("EMBEDDING_CACHE_MAX_MB", 256)*1024*1024)
+		// EMBEDDING_CACHE_FILE_PATH: where the cache is persisted (default: next to the vector store)
+		embeddingCacheFilePath = os.Getenv("EMBEDDING_CACHE_FILE_PATH")
+		if embeddingCacheFilePath == "" {
+			embeddingCacheFilePath = jsonStoreFilePath + ".embeddings-cache"
+		}
+		if err := embeddingCache.Load(embeddingCacheFilePath); err != nil && !os.IsNotExist(err) {
+			log.Println("⚠️ The embedding cache cannot be read, starting with an empty cache:", err)
+		}
+		log.Println("🗃️ Embedding cache loaded:", embeddingCache.Stats().Entries, "embeddings")
+		embeddingOptions.Cache = embeddingCache
+
+		// The topics are cached too: save the cache regularly, not only after an indexing
+		go func() {
+			for range time.Tick(embeddingCachePersistInterval) {
+				persistEmbeddingCache()
+			}
+		}()
+	}
+
 	// -------------------------------------------------
 	// Create a vector store
 	// -------------------------------------------------
-	store = rag.MemoryVectorStore{
-		Records: make(map[string]rag.VectorRecord),
+	// VECTOR_INDEX: "flat" (exact search on every record, default) or "hnsw" (approximate nearest neighbour search)
+	vectorIndex := os.Getenv("VECTOR_INDEX")
+	if vectorIndex == "" {
+		vectorIndex = "flat"
+	}
+	// STORE_FORMAT: "binary" (float32, default), "binary-int8" (quantized) or "json"
+	// An existing store file in another format is migrated when it is loaded
+	storeFormat := os.Getenv("STORE_FORMAT")
+	if storeFormat == "" {
+		storeFormat = rag.StoreFormatFloat32
+	}
+	if storeFormat != rag.StoreFormatFloat32 && storeFormat != rag.StoreFormatInt8 && storeFormat != rag.StoreFormatJSON {
+		log.Fatalln("😡 Unknown store format:", storeFormat)
+	}
+	// VECTOR_STORE: "file" (the whole store in JSON_STORE_FILE_PATH, default) or "bolt" (a bbolt database,
+	// BOLT_STORE_FILE_PATH, where only the changed records are written)
+	vectorStore := os.Getenv("VECTOR_STORE")
+	if vectorStore == "" {
+		vectorStore = "file"
+	}
+	storeFilePath = jsonStoreFilePath
+	switch {
+	case vectorStore == "bolt" && vectorIndex != "flat":
+		log.Fatalln("😡 VECTOR_STORE=bolt only supports VECTOR_INDEX=flat")
+	case vectorStore == "bolt":
+		storeFilePath = os.Getenv("BOLT_STORE_FILE_PATH")
+		if storeFilePath == "" {
+			storeFilePath = strings.TrimSuffix(jsonStoreFilePath, filepath.Ext(jsonStoreFilePath)) + ".db"
+		}
+	case vectorStore != "file":
+		log.Fatalln("😡 Unknown vector store:", vectorStore)
+	case storeFormat != rag.StoreFormatJSON && strings.EqualFold(filepath.Ext(jsonStoreFilePath), ".json"):
+		// A binary store is not written over a .json file (it may be tracked by git): it goes to a .bin file,
+		// created from the JSON file at the first start
+		storeFilePath = strings.TrimSuffix(jsonStoreFilePath, filepath.Ext(jsonStoreFilePath)) + ".bin"
+		copied, err := rag.CopyStoreFile(jsonStoreFilePath, storeFilePath, storeFormat)
+		if err != nil {
+			log.Fatalln("😡 Error converting the vector store file:", err)
+		}
+		if copied {
+			log.Println("📦 Vector store", jsonStoreFilePath, "converted to", storeFilePath)
+		}
+	}
+	switch {
+	case vectorStore == "bolt":
+		boltStore := rag.NewBoltVectorStore(embeddingsModel)
+		// The first start with the database: move the existing store file to it instead of re-indexing the snippets
+		_, errDatabase := os.Stat(storeFilePath)
+		_, errFile := os.Stat(jsonStoreFilePath)
+		if os.IsNotExist(errDatabase) && errFile == nil {
+			var modelMismatch *rag.ModelMismatchError
+			err := boltStore.ImportStoreFile(jsonStoreFilePath)
+			switch {
+			case errors.As(err, &modelMismatch) && os.Getenv("ON_MODEL_MISMATCH") == "reindex":
+				log.Println("♻️", modelMismatch, "-> the store file is not imported.")
+			case err != nil:
+				log.Fatalln("😡 Error importing the vector store file into the database:", err)
+			default:
+				if err := boltStore.Persist(storeFilePath); err != nil {
+					log.Fatalln("😡 Error saving vector store:", err)
+				}
+				log.Println("📥", boltStore.Count(), "records imported from", jsonStoreFilePath, "into", storeFilePath)
+			}
+		}
+		store = boltStore
+	case vectorIndex == "flat":
+		store = &rag.MemoryVectorStore{
+			Model:   embeddingsModel,
+			Format:  storeFormat,
+			Records: make(map[string]rag.VectorRecord),
+		}
+	case vectorIndex == "hnsw":
+		hnswOptions := rag.DefaultHNSWOptions()
+		hnswOptions.M = getIntEnv("HNSW_M", hnswOptions.M)
+		hnswOptions.EfConstruction = getIntEnv("HNSW_EF_CONSTRUCTION", hnswOptions.EfConstruction)
+		hnswOptions.EfSearch = getIntEnv("HNSW_EF_SEARCH", hnswOptions.EfSearch)
+		hnswStore := rag.NewHNSWVectorStore(hnswOptions)
+		hnswStore.Model = embeddingsModel
+		hnswStore.Format = storeFormat
+		store = hnswStore
+	default:
+		log.Fatalln("😡 Unknown vector index:", vectorIndex)
 	}
 
 	// Load the vector store from a file if it exists
-	err := store.Load(jsonStoreFilePath)
+	err := store.Load(storeFilePath)
+
+	// The store was created with another embedding model: its vectors cannot be compared with the new ones
+	// ON_MODEL_MISMATCH: "refuse" (default, stop the server) or "reindex" (create a new store from the documents)
+	var modelMismatch *rag.ModelMismatchError
+	if errors.As(err, &modelMismatch) {
+		if os.Getenv("ON_MODEL_MISMATCH") != "reindex" {
+			log.Fatalln("😡", modelMismatch, "(set ON_MODEL_MISMATCH=reindex to re-create the vector store)")
+		}
+		log.Println("♻️", modelMismatch, "-> re-indexing the documents.")
+		err = os.ErrNotExist
+	}
+
+	// The snippets were embedded with another text (ex: the whole snippet instead of its title and its description):
+	// their vectors cannot be compared with the vectors of the topics, re-index them
+	if err == nil {
+		outdated, errCount := rag.CountOutdatedSnippetRecords(store)
+		if errCount != nil {
+			log.Fatalln("😡 Error reading the vector store:", errCount)
+		}
+		if outdated > 0 {
+			log.Println("♻️", outdated, "snippets were not embedded with the", rag.SnippetEmbeddingScheme, "scheme -> re-indexing the snippets.")
+			if errReset := store.ResetMemory(); errReset != nil {
+				log.Fatalln("😡 Error resetting the vector store:", errReset)
+			}
+			err = os.ErrNotExist
+		}
+	}
+
 	if err != nil {
 		if os.IsNotExist(err) {
 			log.Println("🚀 No existing vector store found, starting fresh.")
@@ -68,35 +310,35 @@ func main() {
 			// =================================================
 			// CHUNKS:
 			// =================================================
-			contents, err := helpers.GetContentFiles(".", ".md")
+			paths, err := helpers.FindFilesWithGlobs(snippetsPath, documentsInclude, documentsExclude)
 			if err != nil {
 				log.Fatalln("😡 Error getting content files:", err)
 			}
-			chunks := []string{}
-			fmt.Println("💡 Found", len(contents), "content files to process.")
-			//fmt.Println("📂 Processing content files...", contents)
+			// The snippets are saved with metadata: source file and language of the code
+			chunks := []rag.VectorRecord{}
+			// The title and the description of a snippet are embedded (they say what the code does),
+			// the text of the snippet is saved (and indexed for the keyword search)
+			texts := []string{}
+			fmt.Println("💡 Found", len(paths), "content files to process in", snippetsPath)
 			fmt.Println("📝 Processing(Chunking) content files...")
 
-			// chunkSize := os.Getenv("CHUNK_SIZE")
-			// if chunkSize == "" {
-			// 	chunkSize = "1024"
-			// }
-			// chunkOverlap := os.Getenv("CHUNK_OVERLAP")
-			// if chunkOverlap == "" {
-			// 	chunkOverlap = "256"
-			// }
-			// chunkSizeInt, err := strconv.Atoi(chunkSize)
-			// if err != nil {
-			// 	log.Fatalln("😡 Error converting chunk size to int:", err)
-			// }
-			// chunkOverlapInt, err := strconv.Atoi(chunkOverlap)
-			// if err != nil {
-			// 	log.Fatalln("😡 Error converting chunk overlap to int:", err)
-			// }
-
-			for _, content := range contents {
-				//chunks = append(chunks, rag.ChunkText(content, chunkSizeInt, chunkOverlapInt)...)
-				chunks = append(chunks, rag.SplitTextWithDelimiter(content, "----------")...)
+			for _, path := range paths {
+				content, err := helpers.ReadTextFile(path)
+				if err != nil {
+					log.Fatalln("😡 Error reading a content file:", err)
+				}
+				position := 0
+				for _, snippet := range rag.SplitTextWithDelimiter(content, snippetDelimiter) {
+					if strings.TrimSpace(snippet) == "" {
+						continue
+					}
+					snippetChunks := rag.ChunkSnippet(snippet, chunkSize, chunkOverlap)
+					chunks = append(chunks, snippetRecords(snippet, snippetChunks, filepath.ToSlash(filepath.Clean(path)), position)...)
+					for _, chunk := range snippetChunks {
+						texts = append(texts, chunk.EmbeddingText)
+					}
+					position += len(snippetChunks)
+				}
 				//chunks = append(chunks, rag.ChunkWithMarkdownHierarchy(content)... )
 
 			}
@@ -106,56 +348,325 @@ func main() {
 			// -------------------------------------------------
 			fmt.Println("⏳ Creating the embeddings...")
 
+			embeddings, report := rag.CreateEmbeddings(ctx, embedder, texts, embeddingOptions)
 			for idx, chunk := range chunks {
-				embeddingsResponse, err := client.Embeddings.New(ctx, openai.EmbeddingNewParams{
-					Input: openai.EmbeddingNewParamsInputUnion{
-						OfString: openai.String(chunk),
-					},
-					Model: embeddingsModel,
-				})
-
-				if err != nil {
-					fmt.Println(err)
-				} else {
-					_, errSave := store.Save(rag.VectorRecord{
-						Prompt:    chunk,
-						Embedding: embeddingsResponse.Data[0].Embedding,
-					})
-					if errSave != nil {
-						fmt.Println("😡:", errSave)
-					}
-					fmt.Println("✅ Chunk", idx, "saved with embedding:", len(embeddingsResponse.Data[0].Embedding))
+				if embeddings[idx] == nil {
+					continue
+				}
+				chunk.Embedding = embeddings[idx]
+				_, errSave := store.Save(chunk)
+				if errSave != nil {
+					fmt.Println("😡:", errSave)
+				}
+			}
+			fmt.Println("✅", report.Succeeded, "chunks embedded,", report.Cached, "of them from the cache,", report.Failed, "failed, on a total of", report.Total)
+			if report.Failed > 0 {
+				for _, errEmbedding := range report.Errors {
+					fmt.Println("😡:", errEmbedding)
+				}
+				// Do not persist a partial index: it would be loaded as is at the next start
+				if os.Getenv("ALLOW_PARTIAL_INDEX") != "true" {
+					log.Fatalln("😡", report.Failed, "chunks could not be embedded, the vector store is not saved (set ALLOW_PARTIAL_INDEX=true to keep it anyway)")
 				}
 			}
 
-			fmt.Println("✋", "Embeddings created, total of records", len(store.Records))
-			err = store.Persist(jsonStoreFilePath)
+			fmt.Println("✋", "Embeddings created, total of records", store.Count())
+			err = store.Persist(storeFilePath)
 			if err != nil {
 				log.Fatalln("😡 Error saving vector store:", err)
 			}
-			fmt.Println("✅ Vector store saved to", jsonStoreFilePath)
-			fmt.Println("💾 Vector store initialized with", len(store.Records), "records.")
+			fmt.Println("✅ Vector store saved to", storeFilePath)
+			persistEmbeddingCache()
+			flushEmbeddingFixtures()
+			fmt.Println("💾 Vector store initialized with", store.Count(), "records.")
 			fmt.Println()
 
 		} else {
 			log.Fatalln("Error loading vector store:", err)
 		}
 	} else {
-		log.Println("Vector store loaded successfully, total records:", len(store.Records))
+		log.Println("Vector store loaded successfully, total records:", store.Count())
+
+		// Stores created before the metadata were recorded: extract what can be read from the snippets
+		updated, err := rag.BackfillMetadata(store)
+		if err != nil {
+			log.Fatalln("😡 Error adding metadata to the vector store:", err)
+		}
+		if updated > 0 {
+			if err := store.Persist(storeFilePath); err != nil {
+				log.Fatalln("😡 Error saving vector store:", err)
+			}
+			log.Println("🏷️ Metadata added to", updated, "records.")
+		}
+	}
+
+	// JSON_EXPORT_FILE_PATH: write a JSON copy of the vector store (to debug it)
+	if jsonExportFilePath := os.Getenv("JSON_EXPORT_FILE_PATH"); jsonExportFilePath != "" {
+		if err := store.ExportJSON(jsonExportFilePath); err != nil {
+			log.Fatalln("😡 Error exporting the vector store to JSON:", err)
+		}
+		log.Println("📤 Vector store exported to", jsonExportFilePath)
+	}
+
+	// HNSW_RECALL_SAMPLES: compare the approximate search with the exact search on N records at startup
+	if hnswStore, ok := store.(*rag.HNSWVectorStore); ok {
+		if samples := getIntEnv("HNSW_RECALL_SAMPLES", 0); samples > 0 {
+			log.Printf("🕸️ HNSW index recall@10 estimated on %d records: %.3f", samples, hnswStore.EstimateRecall(samples, 10))
+		}
+	}
+
+	// -------------------------------------------------
+	// Create the keyword index (BM25) next to the vector store
+	// -------------------------------------------------
+	keywordIndex = rag.NewBM25Index()
+	allRecords, err := store.GetAll()
+	if err != nil {
+		log.Fatalln("😡 Error reading the vector store:", err)
+	}
+	for _, record := range allRecords {
+		keywordIndex.Add(record.Id, record.Prompt)
+	}
+	log.Println("🔑 Keyword index created, total of documents:", keywordIndex.Count())
+
+	// SEARCH_MODE: "vector" (default), "keyword" or "hybrid"
+	defaultSearchMode = os.Getenv("SEARCH_MODE")
+	if defaultSearchMode == "" {
+		defaultSearchMode = rag.SearchModeVector
+	}
+	if defaultSearchMode != rag.SearchModeVector && defaultSearchMode != rag.SearchModeKeyword && defaultSearchMode != rag.SearchModeHybrid {
+		log.Fatalln("😡 Unknown search mode:", defaultSearchMode)
+	}
+	// HYBRID_VECTOR_WEIGHT: weight of the vector ranking in the hybrid mode (the keyword ranking weighs 1 - weight)
+	hybridVectorWeight = 0.5
+	if strWeight := os.Getenv("HYBRID_VECTOR_WEIGHT"); strWeight != "" {
+		hybridVectorWeight, err = strconv.ParseFloat(strWeight, 64)
+		if err != nil || hybridVectorWeight < 0 || hybridVectorWeight > 1 {
+			log.Fatalln("😡 HYBRID_VECTOR_WEIGHT must be a number between 0 and 1:", strWeight)
+		}
+	}
+
+	// -------------------------------------------------
+	// Retrieval parameters (the tool arguments can override them, within the bounds)
+	// -------------------------------------------------
+	// LIMIT: default minimum cosine similarity of the results
+	defaultLimit = getFloatEnv("LIMIT", 0.6)
+	// MIN_SIMILARITY_FLOOR: lowest min_similarity a caller can ask for
+	minSimilarityFloor = getFloatEnv("MIN_SIMILARITY_FLOOR", 0)
+	if minSimilarityFloor < -1 || minSimilarityFloor > 1 || defaultLimit < minSimilarityFloor || defaultLimit > 1 {
+		log.Fatalln("😡 LIMIT and MIN_SIMILARITY_FLOOR must be between -1 and 1, with MIN_SIMILARITY_FLOOR <= LIMIT")
+	}
+	// MAX_RESULTS: default number of results
+	defaultMaxResults = getIntEnv("MAX_RESULTS", 2)
+	// MAX_RESULTS_CEILING: highest max_results a caller can ask for
+	maxResultsCeiling = getIntEnv("MAX_RESULTS_CEILING", max(20, defaultMaxResults))
+	if defaultMaxResults < 1 || maxResultsCeiling < defaultMaxResults {
+		log.Fatalln("😡 MAX_RESULTS must be at least 1 and MAX_RESULTS_CEILING at least MAX_RESULTS")
+	}
+
+	// RESULT_SELECTION: "top" (the most relevant results, default) or "mmr" (maximal marginal relevance, no near duplicates)
+	defaultSelection = os.Getenv("RESULT_SELECTION")
+	if defaultSelection == "" {
+		defaultSelection = rag.SelectionTopN
+	}
+	if defaultSelection != rag.SelectionTopN && defaultSelection != rag.SelectionMMR {
+		log.Fatalln("😡 Unknown result selection:", defaultSelection)
+	}
+	// MMR_LAMBDA: trade-off between relevance (1) and diversity (0) of the "mmr" selection
+	defaultMMRLambda = rag.DefaultMMRLambda
+	if strLambda := os.Getenv("MMR_LAMBDA"); strLambda != "" {
+		defaultMMRLambda, err = strconv.ParseFloat(strLambda, 64)
+		if err != nil || defaultMMRLambda < 0 || defaultMMRLambda > 1 {
+			log.Fatalln("😡 MMR_LAMBDA must be a number between 0 and 1:", strLambda)
+		}
+	}
+
+	// -------------------------------------------------
+	// Reranking stage (optional)
+	// -------------------------------------------------
+	// RERANKER: "none" (default), "endpoint" (cross-encoder behind a /rerank endpoint) or "llm" (grades from a chat model)
+	rerankModel := os.Getenv("RERANK_MODEL")
+	switch rerankerKind := os.Getenv("RERANKER"); rerankerKind {
+	case "", "none":
+	case "endpoint":
+		rerankBaseURL := os.Getenv("RERANK_BASE_URL")
+		if rerankBaseURL == "" {
+			rerankBaseURL = llmURL
+		}
+		// RERANK_FORMAT: "openai" (llama.cpp, vLLM, Jina, Cohere; default) or "tei" (Text Embeddings Inference)
+		reranker = &rag.EndpointReranker{
+			BaseURL: rerankBaseURL,
+			Model:   rerankModel,
+			Format:  os.Getenv("RERANK_FORMAT"),
+		}
+	case "llm":
+		if rerankModel == "" {
+			log.Fatalln("😡 RERANK_MODEL (a chat model) is required with RERANKER=llm")
+		}
+		reranker = &rag.LLMReranker{
+			Client: client,
+			Model:  rerankModel,
+		}
+	default:
+		log.Fatalln("😡 Unknown reranker:", rerankerKind)
+	}
+	// RERANK_CANDIDATES: number of search results given to the reranker (the best MAX_RESULTS are kept)
+	rerankCandidates = getIntEnv("RERANK_CANDIDATES", 10)
+	if reranker != nil {
+		log.Println("🥇 Reranking", rerankCandidates, "candidates with", os.Getenv("RERANKER"), rerankModel)
+	}
+
+	// -------------------------------------------------
+	// Query expansion (optional)
+	// -------------------------------------------------
+	// QUERY_EXPANSION: "none" (default), "multi-query" (paraphrases of the question) or "hyde" (hypothetical answer)
+	defaultQueryExpansion = os.Getenv("QUERY_EXPANSION")
+	if defaultQueryExpansion == "" {
+		defaultQueryExpansion = rag.QueryExpansionNone
+	}
+	switch defaultQueryExpansion {
+	case rag.QueryExpansionNone, rag.QueryExpansionMultiQuery, rag.QueryExpansionHyDE:
+	default:
+		log.Fatalln("😡 Unknown query expansion:", defaultQueryExpansion)
+	}
+	// QUERY_EXPANSION_MODEL: the chat model that rewrites the questions
+	if queryExpansionModel := os.Getenv("QUERY_EXPANSION_MODEL"); queryExpansionModel != "" {
+		queryRewriter = &rag.QueryRewriter{
+			Client:      client,
+			Model:       queryExpansionModel,
+			Paraphrases: getIntEnv("QUERY_PARAPHRASES", 3),
+		}
+		log.Println("🔀 Query expansion:", defaultQueryExpansion, "with", queryExpansionModel)
+	} else if defaultQueryExpansion != rag.QueryExpansionNone {
+		log.Fatalln("😡 QUERY_EXPANSION_MODEL (a chat model) is required with QUERY_EXPANSION=" + defaultQueryExpansion)
 	}
 
 	// =================================================
 	// TOOLS:
 	// =================================================
 	searchInDoc := mcp.NewTool("search_snippet",
-		mcp.WithDescription(`Find one or more snippets related to the topic.`),
+		mcp.WithDescription(`Find one or more snippets related to the topic. Returns JSON: a list of snippets with their title, description, language, code and source file.`),
 		mcp.WithString("topic",
 			mcp.Required(),
 			mcp.Description("Search topic or question to find relevant snippets."),
 		),
+		mcp.WithString("search_mode",
+			mcp.Description("Search mode: 'vector' (semantic similarity), 'keyword' (exact terms such as function names or error codes) or 'hybrid' (both). Defaults to the server setting."),
+			mcp.Enum(rag.SearchModeVector, rag.SearchModeKeyword, rag.SearchModeHybrid),
+		),
+		mcp.WithNumber("max_results",
+			mcp.Description("Maximum number of results (bounded by the server). Defaults to the server setting."),
+			mcp.Min(1),
+		),
+		mcp.WithNumber("min_similarity",
+			mcp.Description("Minimum cosine similarity of the results, between -1 and 1 (bounded by the server). It does not apply to the keyword matches of the 'keyword' and 'hybrid' modes. Defaults to the server setting."),
+			mcp.Max(1),
+		),
+		mcp.WithBoolean("include_scores",
+			mcp.Description("Add the score and the cosine similarity of every result to the response."),
+		),
+		mcp.WithString("selection",
+			mcp.Description("Result selection: 'top' (the most relevant results) or 'mmr' (relevant results that do not repeat each other). Defaults to the server setting."),
+			mcp.Enum(rag.SelectionTopN, rag.SelectionMMR),
+		),
+		mcp.WithNumber("mmr_lambda",
+			mcp.Description("Trade-off of the 'mmr' selection between relevance (1) and diversity (0). Defaults to the server setting."),
+			mcp.Min(0),
+			mcp.Max(1),
+		),
+		mcp.WithBoolean("rerank",
+			mcp.Description("Rerank the search results with the reranker of the server (more precise, slower). Defaults to true when a reranker is configured."),
+		),
+		mcp.WithString("query_expansion",
+			mcp.Description("Also search with rewrites of the topic: 'none', 'multi-query' (paraphrases) or 'hyde' (a hypothetical answer). Requires a query expansion model on the server. Defaults to the server setting."),
+			mcp.Enum(rag.QueryExpansionNone, rag.QueryExpansionMultiQuery, rag.QueryExpansionHyDE),
+		),
+		mcp.WithString("language",
+			mcp.Description("Only return the snippets written in this programming language, ex: 'go', 'rust', 'swift'"),
+		),
+		mcp.WithString("filter",
+			mcp.Description("Filter on the metadata of the snippets: conditions separated by AND, ex: 'language=rust AND source^=snippets/'. Keys: source, language, tags, header_level. Operators: = != ^= (starts with) ~= (tag) <= >="),
+		),
 	)
 	s.AddTool(searchInDoc, searchInDocHandler)
 
+	addSnippet := mcp.NewTool("add_snippet",
+		mcp.WithDescription(`Add a code snippet to the snippets library: it is written to the snippets file of its language and can be searched right away.`),
+		mcp.WithString("title",
+			mcp.Required(),
+			mcp.Description("Title of the snippet, ex: 'Read a file line by line'. Unique in its language."),
+		),
+		mcp.WithString("description",
+			mcp.Required(),
+			mcp.Description("One line saying what the snippet does."),
+		),
+		mcp.WithString("language",
+			mcp.Required(),
+			mcp.Description("Programming language of the code, ex: 'go', 'rust', 'swift'"),
+		),
+		mcp.WithString("code",
+			mcp.Required(),
+			mcp.Description("Code of the snippet."),
+		),
+	)
+	s.AddTool(addSnippet, addSnippetHandler)
+
+	listSnippets := mcp.NewTool("list_snippets",
+		mcp.WithDescription(`List the snippets of the library (title, description, language and source file). Returns JSON.`),
+		mcp.WithString("language",
+			mcp.Description("Only list the snippets of this programming language, ex: 'go', 'rust', 'swift'"),
+		),
+	)
+	s.AddTool(listSnippets, listSnippetsHandler)
+
+	deleteSnippet := mcp.NewTool("delete_snippet",
+		mcp.WithDescription(`Remove a snippet from the snippets library (and from its snippets file).`),
+		mcp.WithString("title",
+			mcp.Required(),
+			mcp.Description("Title of the snippet, as returned by list_snippets."),
+		),
+		mcp.WithString("language",
+			mcp.Description("Programming language of the snippet, when several snippets have this title."),
+		),
+	)
+	s.AddTool(deleteSnippet, deleteSnippetHandler)
+
+	// -------------------------------------------------
+	// Resources: the snippets files, to read the snippets around a search result
+	// -------------------------------------------------
+	s.AddResourceTemplate(mcp.NewResourceTemplate(rag.SourceURIPrefix+"{+path}", "Snippets file",
+		mcp.WithTemplateDescription("A snippets file of the library, by its path (the source of the snippets)"),
+	), readSourceHandler)
+	sources, err := rag.ListSources(store)
+	if err != nil {
+		log.Fatalln("😡 Error reading the vector store:", err)
+	}
+	published := 0
+	for _, source := range sources {
+		if source.Source != "" {
+			s.AddResource(sourceResource(source.Source), readSourceHandler)
+			published++
+		}
+	}
+	log.Println("📚 Snippets files published as resources:", published)
+
+	// -------------------------------------------------
+	// Prompts: for the clients without tool calling
+	// -------------------------------------------------
+	answerWithCitations := mcp.NewPrompt("answer_with_citations",
+		mcp.WithPromptDescription("Answer a question with the snippets of the library, citing them. The prompt contains the snippets found for the topic."),
+		mcp.WithArgument("topic",
+			mcp.RequiredArgument(),
+			mcp.ArgumentDescription("Question or topic to answer"),
+		),
+		mcp.WithArgument("language",
+			mcp.ArgumentDescription("Only use the snippets of this programming language, ex: 'go', 'rust', 'swift'"),
+		),
+		mcp.WithArgument("max_results",
+			mcp.ArgumentDescription("Maximum number of snippets in the prompt. Defaults to the server setting."),
+		),
+	)
+	s.AddPrompt(answerWithCitations, answerWithCitationsPromptHandler)
+
 	// Start the HTTP server
 	httpPort := os.Getenv("MCP_HTTP_PORT")
 	fmt.Println("🌍 MCP HTTP Port:", httpPort)
@@ -188,12 +699,29 @@ func searchInDocHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.
 	args := request.GetArguments()
 	topicArg, exists := args["topic"]
 	if !exists || topicArg == nil {
-		return nil, fmt.Errorf("missing required parameter 'topic'")
+		return mcp.NewToolResultError("Missing required parameter 'topic'"), nil
 	}
 	userQuestion, ok := topicArg.(string)
 	if !ok {
-		return nil, fmt.Errorf("parameter 'topic' must be a string")
+		return mcp.NewToolResultError("Parameter 'topic' must be a string"), nil
+	}
+
+	// Retrieval parameters: the server defaults, within the server bounds
+	maxResults := defaultMaxResults
+	if maxArg, ok := args["max_results"].(float64); ok {
+		if maxArg < 1 || maxArg != math.Trunc(maxArg) {
+			return mcp.NewToolResultError("max_results must be a positive integer"), nil
+		}
+		maxResults = min(int(maxArg), maxResultsCeiling)
+	}
+	limit := defaultLimit
+	if similarityArg, ok := args["min_similarity"].(float64); ok {
+		if similarityArg > 1 {
+			return mcp.NewToolResultError("min_similarity must be between -1 and 1"), nil
+		}
+		limit = max(similarityArg, minSimilarityFloor)
 	}
+	includeScores, _ := args["include_scores"].(bool)
 
 	fmt.Println("🔍 Searching for question:", userQuestion)
 
@@ -203,64 +731,740 @@ func searchInDocHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.
 
 	fmt.Println("⏳ Searching for similarities...")
 
+	var err error
+
+	searchMode := defaultSearchMode
+	if modeArg, exists := args["search_mode"]; exists && modeArg != nil {
+		if mode, ok := modeArg.(string); ok && mode != "" {
+			searchMode = mode
+		}
+	}
+	if searchMode != rag.SearchModeVector && searchMode != rag.SearchModeKeyword && searchMode != rag.SearchModeHybrid {
+		return mcp.NewToolResultError(fmt.Sprintf("Unknown search mode %q (expected %s, %s or %s)", searchMode, rag.SearchModeVector, rag.SearchModeKeyword, rag.SearchModeHybrid)), nil
+	}
+
+	filter := rag.Filter{}
+	if filterArg, ok := args["filter"].(string); ok {
+		filter, err = rag.ParseFilter(filterArg)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Invalid filter: %v", err)), nil
+		}
+	}
+	if language, ok := args["language"].(string); ok && language != "" {
+		filter = append(filter, rag.Condition{Key: rag.MetadataLanguage, Operator: rag.OperatorEquals, Value: language})
+	}
+
+	selection := defaultSelection
+	if selectionArg, ok := args["selection"].(string); ok && selectionArg != "" {
+		if selectionArg != rag.SelectionTopN && selectionArg != rag.SelectionMMR {
+			return mcp.NewToolResultError(fmt.Sprintf("Unknown selection %q (expected %s or %s)", selectionArg, rag.SelectionTopN, rag.SelectionMMR)), nil
+		}
+		selection = selectionArg
+	}
+	mmrLambda := defaultMMRLambda
+	if lambdaArg, ok := args["mmr_lambda"].(float64); ok {
+		if lambdaArg < 0 || lambdaArg > 1 {
+			return mcp.NewToolResultError("mmr_lambda must be between 0 and 1"), nil
+		}
+		mmrLambda = lambdaArg
+	}
+
+	rerank := reranker != nil
+	if rerankArg, ok := args["rerank"].(bool); ok {
+		if rerankArg && reranker == nil {
+			return mcp.NewToolResultError("No reranker is configured on the server (see RERANKER)"), nil
+		}
+		rerank = rerankArg
+	}
+	// The reranker picks the best results among more candidates
+	searchMaxResults := maxResults
+	if rerank {
+		searchMaxResults = max(rerankCandidates, maxResults)
+	}
+
+	queryExpansion := defaultQueryExpansion
+	if expansionArg, ok := args["query_expansion"].(string); ok && expansionArg != "" {
+		switch {
+		case expansionArg != rag.QueryExpansionNone && expansionArg != rag.QueryExpansionMultiQuery && expansionArg != rag.QueryExpansionHyDE:
+			return mcp.NewToolResultError(fmt.Sprintf("Unknown query expansion %q (expected %s, %s or %s)", expansionArg, rag.QueryExpansionNone, rag.QueryExpansionMultiQuery, rag.QueryExpansionHyDE)), nil
+		case expansionArg != rag.QueryExpansionNone && queryRewriter == nil:
+			return mcp.NewToolResultError("No query expansion model is configured on the server (see QUERY_EXPANSION_MODEL)"), nil
+		}
+		queryExpansion = expansionArg
+	}
+
 	// -------------------------------------------------
 	// Create embedding from the user question
 	// -------------------------------------------------
-	embeddingsResponse, err := client.Embeddings.New(ctx, openai.EmbeddingNewParams{
-		Input: openai.EmbeddingNewParamsInputUnion{
-			OfString: openai.String(userQuestion),
-		},
-		Model: embeddingsModel,
-	})
-	if err != nil {
-		log.Fatal("😡:", err)
+	// The keyword mode only searches the text of the question: it does not call the embeddings model
+	var questionEmbedding []float64
+	if searchMode != rag.SearchModeKeyword {
+		questionEmbeddings, report := rag.CreateEmbeddings(ctx, embedder, []string{userQuestion}, embeddingOptions)
+		if report.Failed > 0 {
+			// The model runner may be back at the next question: report the error, do not stop the server
+			log.Println("😡 Error creating the embedding of the question:", report.Errors[0])
+			return mcp.NewToolResultError(fmt.Sprintf("The question could not be embedded, try again later: %v", report.Errors[0])), nil
+		}
+		questionEmbedding = questionEmbeddings[0]
 	}
 
 	// -------------------------------------------------
 	// Create a vector record from the user embedding
 	// -------------------------------------------------
 	embeddingFromUserQuestion := rag.VectorRecord{
-		Embedding: embeddingsResponse.Data[0].Embedding,
+		Embedding: questionEmbedding,
 	}
 
-	strLimit := os.Getenv("LIMIT")
-	if strLimit == "" {
-		strLimit = "0.6"
-	}
-	strMax := os.Getenv("MAX_RESULTS")
-	if strMax == "" {
-		strMax = "2"
+	// -------------------------------------------------
+	// Rewrite the question (the question is always the first sub-query)
+	// -------------------------------------------------
+	subQueries := []rag.SubQuery{{Kind: "question", Query: userQuestion}}
+	subQueryEmbeddings := [][]float64{embeddingFromUserQuestion.Embedding}
+	if queryExpansion != rag.QueryExpansionNone {
+		subQueries, err = queryRewriter.Expand(ctx, queryExpansion, userQuestion)
+		if err != nil {
+			// The question alone still gives results
+			log.Println("⚠️ Query expansion failed, searching with the question only:", err)
+		}
+		rewrites := make([]string, 0, len(subQueries)-1)
+		for _, subQuery := range subQueries[1:] {
+			rewrites = append(rewrites, subQuery.Query)
+		}
+		switch {
+		case len(rewrites) > 0 && searchMode == rag.SearchModeKeyword:
+			subQueryEmbeddings = append(subQueryEmbeddings, make([][]float64, len(rewrites))...)
+		case len(rewrites) > 0:
+			rewriteEmbeddings, report := rag.CreateEmbeddings(ctx, embedder, rewrites, embeddingOptions)
+			if report.Failed > 0 {
+				log.Println("⚠️", report.Failed, "sub-queries could not be embedded and are skipped:", report.Errors)
+			}
+			subQueryEmbeddings = append(subQueryEmbeddings, rewriteEmbeddings...)
+		}
 	}
-	// Convert string to float64 and int
-	var limit float64
-	fmt.Sscanf(strLimit, "%f", &limit)
-	var maxResults int
-	fmt.Sscanf(strMax, "%d", &maxResults)
 
-	similarities, _ := store.SearchTopNSimilarities(embeddingFromUserQuestion, limit, maxResults)
+	// -------------------------------------------------
+	// Search with every sub-query and merge the results
+	// -------------------------------------------------
+	var subQueryResults [][]rag.VectorRecord
+	var subQueryHits map[string][]int
+	// The chunks found are returned as their whole snippets
+	similarities, err := searchWholeSnippets(searchMaxResults, func(maxChunks int) ([]rag.VectorRecord, error) {
+		subQueryResults = make([][]rag.VectorRecord, len(subQueries))
+		storeMutex.RLock()
+		defer storeMutex.RUnlock()
+		for idx, subQuery := range subQueries {
+			// A sub-query that could not be embedded is skipped (the keyword mode does not use the embeddings)
+			if subQueryEmbeddings[idx] == nil && searchMode != rag.SearchModeKeyword {
+				continue
+			}
+			subQueryResults[idx], err = rag.HybridSearch(store, keywordIndex, subQuery.Query, rag.VectorRecord{Embedding: subQueryEmbeddings[idx]}, rag.SearchOptions{
+				Mode:         searchMode,
+				Limit:        limit,
+				MaxResults:   maxChunks,
+				VectorWeight: hybridVectorWeight,
+				Filter:       filter,
+				Selection:    selection,
+				MMRLambda:    mmrLambda,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(subQueries) == 1 {
+			return subQueryResults[0], nil
+		}
+		var merged []rag.VectorRecord
+		merged, subQueryHits = rag.MergeSubQueryResults(subQueryResults, maxChunks)
+		return merged, nil
+	})
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Error searching the snippets: %v", err)), nil
+	}
+	if len(subQueries) > 1 {
+		for idx, subQuery := range subQueries {
+			fmt.Printf("🔀 Sub-query %d (%s): %d results: %s\n", idx+1, subQuery.Kind, len(subQueryResults[idx]), subQuery.Query)
+		}
+	}
 
-	documentsContent := "Documents:\n"
+	if rerank {
+		reranked, err := rag.Rerank(ctx, reranker, userQuestion, similarities, maxResults)
+		if err != nil {
+			// Better results without reranking than no result at all
+			log.Println("⚠️ Reranking failed, the search results are not reranked:", err)
+			similarities = similarities[:min(len(similarities), maxResults)]
+		} else {
+			similarities = reranked
+		}
+	}
 
+	// The snippets are returned as JSON, so the code can be used as is
+	response := searchSnippetResponse{Snippets: []snippetResult{}}
 	for _, similarity := range similarities {
-		fmt.Println("✅ CosineSimilarity:", similarity.CosineSimilarity, "Chunk:", similarity.Prompt)
-		documentsContent += similarity.Prompt
+		fmt.Println("✅ Score:", similarity.Score, "CosineSimilarity:", similarity.CosineSimilarity, "Chunk:", similarity.Prompt)
+		result := snippetResult{Snippet: rag.SnippetFromRecord(similarity)}
+		if includeScores {
+			result.Score = similarity.Score
+			result.CosineSimilarity = similarity.CosineSimilarity
+			for _, hit := range subQueryHits[similarity.Id] {
+				result.SubQueries = append(result.SubQueries, hit+1)
+			}
+		}
+		response.Snippets = append(response.Snippets, result)
+	}
+	if includeScores && subQueryHits != nil {
+		// Which rewrites of the question found something, to debug the retrieval
+		for idx, subQuery := range subQueries {
+			response.SubQueries = append(response.SubQueries, subQueryInfo{Kind: subQuery.Kind, Query: subQuery.Query, Results: len(subQueryResults[idx])})
+		}
 	}
-	documentsContent += "\n"
 	fmt.Println("✋", "Similarities found, total of records", len(similarities))
 	fmt.Println()
 
-	// -------------------------------------------------
-	// Generate embeddings from user question
-	// -------------------------------------------------
-	// EMBEDDINGS...
-	return mcp.NewToolResultText(documentsContent), nil
+	content, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Error encoding the snippets: %v", err)), nil
+	}
+	return mcp.NewToolResultText(string(content)), nil
+}
+
+// searchSnippetResponse is the JSON response of search_snippet (and of list_snippets, without the code).
+type searchSnippetResponse struct {
+	Snippets   []snippetResult `json:"snippets"`
+	SubQueries []subQueryInfo  `json:"sub_queries,omitempty"` // with include_scores and query expansion
+}
+
+// snippetResult is a snippet found by search_snippet; the scores are only set with include_scores.
+type snippetResult struct {
+	rag.Snippet
+	Score            float64 `json:"score,omitempty"`
+	CosineSimilarity float64 `json:"cosine_similarity,omitempty"`
+	SubQueries       []int   `json:"sub_queries,omitempty"` // numbers of the sub-queries that found the snippet
+}
+
+// subQueryInfo describes a sub-query of the search: the question or one of its rewrites.
+type subQueryInfo struct {
+	Kind    string `json:"kind"`
+	Query   string `json:"query"`
+	Results int    `json:"results"`
+}
+
+func addSnippetHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	args := request.GetArguments()
+	values := make(map[string]string)
+	for _, name := range []string{"title", "description", "language", "code"} {
+		value, ok := args[name].(string)
+		if !ok || strings.TrimSpace(value) == "" {
+			return mcp.NewToolResultError(fmt.Sprintf("Missing required parameter '%s'", name)), nil
+		}
+		values[name] = value
+	}
+	// The title and the description are one line each in the snippets files
+	snippet := rag.Snippet{
+		Title:       strings.Join(strings.Fields(values["title"]), " "),
+		Description: strings.Join(strings.Fields(values["description"]), " "),
+		Language:    rag.NormalizeLanguage(values["language"]),
+		Code:        values["code"],
+	}
+	if strings.ContainsAny(snippet.Language, " `~") {
+		return mcp.NewToolResultError(fmt.Sprintf("Invalid language %q", values["language"])), nil
+	}
+	text := snippet.Markdown()
+
+	fmt.Println("📥 Adding the snippet", snippet.Title, "("+snippet.Language+")...")
+	snippetChunks := rag.ChunkSnippet(text, chunkSize, chunkOverlap)
+	texts := make([]string, len(snippetChunks))
+	for idx, chunk := range snippetChunks {
+		texts[idx] = chunk.EmbeddingText
+	}
+	embeddings, report := rag.CreateEmbeddings(ctx, embedder, texts, embeddingOptions)
+	if report.Failed > 0 {
+		return mcp.NewToolResultError(fmt.Sprintf("The snippet could not be embedded, it is not added: %v", report.Errors[0])), nil
+	}
+
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	records, err := store.GetAll()
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Error reading the vector store: %v", err)), nil
+	}
+	if len(findSnippets(records, snippet.Title, snippet.Language)) > 0 {
+		return mcp.NewToolResultError(fmt.Sprintf("A %s snippet titled %q already exists (see list_snippets)", snippet.Language, snippet.Title)), nil
+	}
+
+	snippetsFilePath := snippetsFileForLanguage(records, snippet.Language)
+	content, err := os.ReadFile(snippetsFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return mcp.NewToolResultError(fmt.Sprintf("Error reading %s: %v", snippetsFilePath, err)), nil
+	}
+
+	saved := []rag.VectorRecord{}
+	// rollback removes the chunks saved so far from the vector store and from the keyword index
+	rollback := func() {
+		for _, savedRecord := range saved {
+			store.Delete(savedRecord.Id)
+			keywordIndex.Remove(savedRecord.Id)
+		}
+	}
+	for idx, record := range snippetRecords(text, snippetChunks, snippetsFilePath, nextChunkPosition(records, snippetsFilePath)) {
+		record.Embedding = embeddings[idx]
+		savedRecord, err := store.Save(record)
+		if err != nil {
+			rollback()
+			return mcp.NewToolResultError(fmt.Sprintf("Error saving the snippet: %v", err)), nil
+		}
+		keywordIndex.Add(savedRecord.Id, savedRecord.Prompt)
+		saved = append(saved, savedRecord)
+	}
+	// The snippets files are the library: the snippet is indexed again when the vector store is re-created
+	errWrite := os.MkdirAll(filepath.Dir(snippetsFilePath), 0755)
+	if errWrite == nil {
+		errWrite = os.WriteFile(snippetsFilePath, []byte(rag.AppendSnippet(string(content), snippetDelimiter, text)), 0644)
+	}
+	if errWrite != nil {
+		rollback()
+		return mcp.NewToolResultError(fmt.Sprintf("Error writing %s: %v", snippetsFilePath, errWrite)), nil
+	}
+	if err := store.Persist(storeFilePath); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("The snippet is added but the vector store could not be saved: %v", err)), nil
+	}
+	persistEmbeddingCache()
+	flushEmbeddingFixtures()
+
+	mcpServer.AddResource(sourceResource(snippetsFilePath), readSourceHandler)
+
+	message := fmt.Sprintf("Snippet %q added to %s.", snippet.Title, snippetsFilePath)
+	fmt.Println("✅", message)
+	return mcp.NewToolResultText(message), nil
+}
+
+func listSnippetsHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	args := request.GetArguments()
+	language, _ := args["language"].(string)
+	language = rag.NormalizeLanguage(language)
+
+	storeMutex.RLock()
+	records, err := store.GetAll()
+	storeMutex.RUnlock()
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Error reading the vector store: %v", err)), nil
+	}
+
+	response := searchSnippetResponse{Snippets: []snippetResult{}}
+	for _, chunks := range rag.GroupSnippetChunks(records) {
+		if language != "" && chunks[0].Metadata[rag.MetadataLanguage] != language {
+			continue
+		}
+		snippet := rag.ParseSnippet(rag.SnippetText(chunks))
+		snippet.Source = chunks[0].Metadata[rag.MetadataSource]
+		// The code is returned by search_snippet
+		snippet.Code = ""
+		response.Snippets = append(response.Snippets, snippetResult{Snippet: snippet})
+	}
+	sort.Slice(response.Snippets, func(i, j int) bool {
+		if response.Snippets[i].Source != response.Snippets[j].Source {
+			return response.Snippets[i].Source < response.Snippets[j].Source
+		}
+		return response.Snippets[i].Title < response.Snippets[j].Title
+	})
+
+	content, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Error encoding the snippets: %v", err)), nil
+	}
+	return mcp.NewToolResultText(string(content)), nil
+}
+
+func deleteSnippetHandler(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	args := request.GetArguments()
+	title, ok := args["title"].(string)
+	if !ok || strings.TrimSpace(title) == "" {
+		return mcp.NewToolResultError("Missing required parameter 'title'"), nil
+	}
+	title = strings.Join(strings.Fields(title), " ")
+	language, _ := args["language"].(string)
+	language = rag.NormalizeLanguage(language)
+
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+
+	records, err := store.GetAll()
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Error reading the vector store: %v", err)), nil
+	}
+	found := findSnippets(records, title, language)
+	switch {
+	case len(found) == 0:
+		return mcp.NewToolResultError(fmt.Sprintf("No snippet titled %q (see list_snippets)", title)), nil
+	case len(found) > 1:
+		languages := []string{}
+		for _, chunks := range found {
+			languages = append(languages, chunks[0].Metadata[rag.MetadataLanguage])
+		}
+		return mcp.NewToolResultError(fmt.Sprintf("%d snippets are titled %q, set the language (%s)", len(found), title, strings.Join(languages, ", "))), nil
+	}
+	chunks := found[0]
+
+	// The snippets file without the snippet, written once the vector store is saved
+	source := chunks[0].Metadata[rag.MetadataSource]
+	remaining, removed := "", false
+	if source != "" {
+		content, err := os.ReadFile(source)
+		if err != nil && !os.IsNotExist(err) {
+			return mcp.NewToolResultError(fmt.Sprintf("Error reading %s: %v", source, err)), nil
+		}
+		if remaining, removed = rag.RemoveSnippet(string(content), snippetDelimiter, rag.SnippetText(chunks)); !removed {
+			log.Println("⚠️ The snippet", title, "is not in", source, "anymore")
+		}
+	}
+
+	// restore saves the chunks of the snippet again, when it cannot be deleted everywhere
+	restore := func() {
+		for _, chunk := range chunks {
+			if _, err := store.Save(chunk); err != nil {
+				log.Println("😡 Error restoring the chunk", chunk.Id, "of the snippet", title, ":", err)
+				continue
+			}
+			keywordIndex.Add(chunk.Id, chunk.Prompt)
+		}
+	}
+	for _, chunk := range chunks {
+		if err := store.Delete(chunk.Id); err != nil {
+			restore()
+			return mcp.NewToolResultError(fmt.Sprintf("Error deleting the snippet: %v", err)), nil
+		}
+		keywordIndex.Remove(chunk.Id)
+	}
+	if err := store.Persist(storeFilePath); err != nil {
+		restore()
+		return mcp.NewToolResultError(fmt.Sprintf("The vector store could not be saved, the snippet is not deleted: %v", err)), nil
+	}
+	// Remove the snippet from its file too: otherwise it would come back when the vector store is re-created
+	if removed {
+		if err := os.WriteFile(source, []byte(remaining), 0644); err != nil {
+			restore()
+			if errPersist := store.Persist(storeFilePath); errPersist != nil {
+				log.Println("😡 Error saving the restored snippet", title, ":", errPersist)
+			}
+			return mcp.NewToolResultError(fmt.Sprintf("Error writing %s, the snippet is not deleted: %v", source, err)), nil
+		}
+	}
+
+	// The snippets file is not a resource anymore when its last snippet is deleted
+	if ids, err := rag.SourceRecordIDs(store, source); source != "" && err == nil && len(ids) == 0 {
+		mcpServer.RemoveResource(rag.SourceURI(source))
+	}
+
+	message := fmt.Sprintf("Snippet %q deleted from %s.", title, source)
+	fmt.Println("🗑️", message)
+	return mcp.NewToolResultText(message), nil
+}
+
+// sourceResource returns the MCP resource of a snippets file (see readSourceHandler).
+func sourceResource(source string) mcp.Resource {
+	return mcp.NewResource(rag.SourceURI(source), source,
+		mcp.WithResourceDescription(fmt.Sprintf("Snippets file %s", source)),
+		mcp.WithMIMEType("text/markdown"),
+	)
+}
+
+// readSourceHandler returns the whole content of a snippets file: the file itself,
+// or its snippets in the vector store when the file cannot be read.
+func readSourceHandler(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+	source, ok := rag.SourceFromURI(request.Params.URI)
+	if !ok {
+		return nil, fmt.Errorf("invalid snippets file URI %s", request.Params.URI)
+	}
+
+	storeMutex.RLock()
+	records, err := store.GetAll()
+	storeMutex.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("reading the vector store: %w", err)
+	}
+	snippets := []string{}
+	for _, chunks := range rag.GroupSnippetChunks(records) {
+		if chunks[0].Metadata[rag.MetadataSource] == source {
+			snippets = append(snippets, strings.TrimSpace(rag.SnippetText(chunks)))
+		}
+	}
+	if len(snippets) == 0 {
+		return nil, fmt.Errorf("no snippet in %s", source)
+	}
+	text := strings.Join(snippets, "\n\n"+snippetDelimiter+"\n\n")
+	// Only the files of the snippets of the store are read
+	if content, err := os.ReadFile(source); err == nil {
+		text = string(content)
+	}
+
+	return []mcp.ResourceContents{
+		mcp.TextResourceContents{
+			URI:      request.Params.URI,
+			MIMEType: "text/markdown",
+			Text:     text,
+		},
+	}, nil
+}
+
+func answerWithCitationsPromptHandler(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+	topic := strings.TrimSpace(request.Params.Arguments["topic"])
+	if topic == "" {
+		return nil, fmt.Errorf("missing required parameter 'topic'")
+	}
+	maxResults := defaultMaxResults
+	if maxArg := request.Params.Arguments["max_results"]; maxArg != "" {
+		number, err := strconv.Atoi(maxArg)
+		if err != nil || number < 1 {
+			return nil, fmt.Errorf("parameter 'max_results' must be a positive integer")
+		}
+		maxResults = min(number, maxResultsCeiling)
+	}
+	filter := rag.Filter{}
+	if language := rag.NormalizeLanguage(request.Params.Arguments["language"]); language != "" {
+		filter = append(filter, rag.Condition{Key: rag.MetadataLanguage, Operator: rag.OperatorEquals, Value: language})
+	}
+
+	fmt.Println("💬 Prompt with citations for topic:", topic)
+	similarities, err := searchSnippets(ctx, topic, maxResults, filter)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("✋", "Snippets in the prompt:", len(similarities))
+
+	return mcp.NewGetPromptResult(
+		fmt.Sprintf("Answer with citations of %d snippets of the library", len(similarities)),
+		[]mcp.PromptMessage{
+			mcp.NewPromptMessage(mcp.RoleUser, mcp.NewTextContent(rag.AnswerWithCitationsPrompt(topic, similarities))),
+		},
+	), nil
+}
+
+// searchSnippets searches the snippets of a topic with the server settings (without query expansion),
+// reranked when a reranker is configured.
+func searchSnippets(ctx context.Context, topic string, maxResults int, filter rag.Filter) ([]rag.VectorRecord, error) {
+	// The keyword mode does not call the embeddings model
+	var topicEmbedding []float64
+	if defaultSearchMode != rag.SearchModeKeyword {
+		topicEmbeddings, report := rag.CreateEmbeddings(ctx, embedder, []string{topic}, embeddingOptions)
+		if report.Failed > 0 {
+			return nil, fmt.Errorf("the topic could not be embedded, try again later: %w", report.Errors[0])
+		}
+		topicEmbedding = topicEmbeddings[0]
+	}
+
+	searchMaxResults := maxResults
+	if reranker != nil {
+		searchMaxResults = max(rerankCandidates, maxResults)
+	}
+	similarities, err := searchWholeSnippets(searchMaxResults, func(maxChunks int) ([]rag.VectorRecord, error) {
+		storeMutex.RLock()
+		defer storeMutex.RUnlock()
+		return rag.HybridSearch(store, keywordIndex, topic, rag.VectorRecord{Embedding: topicEmbedding}, rag.SearchOptions{
+			Mode:         defaultSearchMode,
+			Limit:        defaultLimit,
+			MaxResults:   maxChunks,
+			VectorWeight: hybridVectorWeight,
+			Filter:       filter,
+			Selection:    defaultSelection,
+			MMRLambda:    defaultMMRLambda,
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("searching the snippets: %w", err)
+	}
+
+	if reranker != nil {
+		reranked, err := rag.Rerank(ctx, reranker, topic, similarities, maxResults)
+		if err == nil {
+			return reranked, nil
+		}
+		// Better results without reranking than no result at all
+		log.Println("⚠️ Reranking failed, the search results are not reranked:", err)
+	}
+	return similarities[:min(len(similarities), maxResults)], nil
+}
+
+// findSnippets returns the records of the chunks of the snippets with this title (case insensitive)
+// and language ("" for any language), by snippet (see rag.GroupSnippetChunks).
+func findSnippets(records []rag.VectorRecord, title string, language string) [][]rag.VectorRecord {
+	found := [][]rag.VectorRecord{}
+	for _, chunks := range rag.GroupSnippetChunks(records) {
+		if language != "" && chunks[0].Metadata[rag.MetadataLanguage] != language {
+			continue
+		}
+		if strings.EqualFold(rag.ParseSnippet(rag.SnippetText(chunks)).Title, title) {
+			found = append(found, chunks)
+		}
+	}
+	return found
+}
+
+// snippetRecords returns the records of the chunks of a snippet of a snippets file (see rag.ChunkSnippet), without embeddings.
+// The position is the one of the first chunk in the file: it identifies the snippet.
+func snippetRecords(text string, snippetChunks []rag.SnippetChunk, source string, position int) []rag.VectorRecord {
+	records := make([]rag.VectorRecord, len(snippetChunks))
+	for idx, chunk := range snippetChunks {
+		// Every chunk has the metadata of the whole snippet (ex: the language of its code)
+		metadata := rag.ExtractMetadata(text)
+		metadata[rag.MetadataSource] = source
+		metadata[rag.MetadataChunk] = strconv.Itoa(position + idx)
+		metadata[rag.MetadataSnippet] = fmt.Sprintf("%s#%d", source, position)
+		metadata[rag.MetadataEmbedding] = rag.SnippetEmbeddingScheme
+		records[idx] = rag.VectorRecord{Prompt: chunk.Text, Metadata: metadata}
+	}
+	return records
+}
+
+// nextChunkPosition returns the position after the last chunk of the snippets file.
+func nextChunkPosition(records []rag.VectorRecord, source string) int {
+	position := 0
+	for _, record := range records {
+		if record.Metadata[rag.MetadataSource] != source {
+			continue
+		}
+		if chunk, err := strconv.Atoi(record.Metadata[rag.MetadataChunk]); err == nil {
+			position = max(position, chunk+1)
+		}
+	}
+	return position
+}
+
+// snippetChunksFactor is the number of chunks searched per expected snippet: the chunks of a split snippet
+// take several results of the search.
+const snippetChunksFactor = 4
+
+// searchWholeSnippets returns the (at most count) whole snippets of the chunks found by the search (see wholeSnippets).
+// The search is called with more and more chunks until it finds count snippets, or every matching chunk.
+func searchWholeSnippets(count int, search func(maxChunks int) ([]rag.VectorRecord, error)) ([]rag.VectorRecord, error) {
+	for maxChunks := count * snippetChunksFactor; ; maxChunks *= 2 {
+		chunks, err := search(maxChunks)
+		if err != nil {
+			return nil, err
+		}
+		snippets, err := wholeSnippets(chunks)
+		if err != nil {
+			return nil, fmt.Errorf("reading the vector store: %w", err)
+		}
+		if len(snippets) >= count || len(chunks) < maxChunks {
+			return snippets[:min(len(snippets), count)], nil
+		}
+	}
+}
+
+// wholeSnippets replaces the chunks found by a search with their whole snippets, once per snippet
+// (with the scores of its best chunk).
+func wholeSnippets(similarities []rag.VectorRecord) ([]rag.VectorRecord, error) {
+	storeMutex.RLock()
+	records, err := store.GetAll()
+	storeMutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	snippets := make(map[string][]rag.VectorRecord)
+	for _, chunks := range rag.GroupSnippetChunks(records) {
+		snippets[rag.SnippetIDOf(chunks[0])] = chunks
+	}
+
+	whole := []rag.VectorRecord{}
+	seen := make(map[string]bool)
+	for _, similarity := range similarities {
+		snippetID := rag.SnippetIDOf(similarity)
+		if seen[snippetID] {
+			continue
+		}
+		seen[snippetID] = true
+		if chunks, exists := snippets[snippetID]; exists {
+			similarity.Prompt = rag.SnippetText(chunks)
+		}
+		whole = append(whole, similarity)
+	}
+	return whole, nil
+}
+
+// snippetsFileForLanguage returns the snippets file of the language: the file of the snippets directory
+// with the most snippets in this language (ex: snippets/snippets-golang.md for go), or snippets/snippets-<language>.md.
+func snippetsFileForLanguage(records []rag.VectorRecord, language string) string {
+	directory := filepath.ToSlash(filepath.Clean(snippetsPath)) + "/"
+	counts := make(map[string]int)
+	for _, record := range records {
+		source := record.Metadata[rag.MetadataSource]
+		if record.Metadata[rag.MetadataLanguage] == language && strings.HasPrefix(source, directory) {
+			counts[source]++
+		}
+	}
+	snippetsFilePath := ""
+	for source, count := range counts {
+		if snippetsFilePath == "" || count > counts[snippetsFilePath] || (count == counts[snippetsFilePath] && source < snippetsFilePath) {
+			snippetsFilePath = source
+		}
+	}
+	if snippetsFilePath == "" {
+		snippetsFilePath = directory + "snippets-" + language + ".md"
+	}
+	return snippetsFilePath
+}
+
+// embeddingCachePersistInterval is the delay between two saves of the embedding cache (when it changed).
+const embeddingCachePersistInterval = time.Minute
+
+// persistEmbeddingCache saves the embedding cache if it changed; a failure only costs embeddings to compute again.
+func persistEmbeddingCache() {
+	if embeddingCache == nil {
+		return
+	}
+	if err := embeddingCache.Persist(embeddingCacheFilePath); err != nil {
+		log.Println("⚠️ Error saving the embedding cache:", err)
+	}
+}
+
+// flushEmbeddingFixtures writes the embeddings recorded with EMBEDDER=record to EMBEDDING_FIXTURES_FILE.
+func flushEmbeddingFixtures() {
+	if err := rag.FlushEmbedder(embedder); err != nil {
+		log.Println("⚠️ Error saving the recorded embeddings:", err)
+	}
+}
+
+// splitPatterns returns the comma-separated patterns of a setting.
+func splitPatterns(setting string) []string {
+	patterns := []string{}
+	for _, pattern := range strings.Split(setting, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+func getIntEnv(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	intValue, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalln("😡 Error converting", name, "to int:", err)
+	}
+	return intValue
+}
+
+// getFloatEnv returns the float value of an environment variable, or defaultValue when it is not set.
+func getFloatEnv(name string, defaultValue float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	floatValue, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalln("😡 Error converting", name, "to float:", err)
+	}
+	return floatValue
 }
 
 func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	// Check if vector store is initialized and has records
-	if len(store.Records) == 0 {
+	if store.Count() == 0 {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		response := map[string]interface{}{
 			"status": "unhealthy",
@@ -270,11 +1474,22 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The server keeps running when the model runner fails: it is degraded until the embeddings work again
+	status := "healthy"
+	embeddingsStatus := embeddingBreaker.Status()
+	if embeddingsStatus.State != rag.CircuitClosed {
+		status = "degraded"
+	}
+
 	w.WriteHeader(http.StatusOK)
 	response := map[string]interface{}{
-		"status":           "healthy",
-		"records":          len(store.Records),
+		"status":           status,
+		"embeddings":       embeddingsStatus,
+		"records":          store.Count(),
 		"embeddings_model": embeddingsModel,
 	}
+	if embeddingCache != nil {
+		response["embedding_cache"] = embeddingCache.Stats()
+	}
 	json.NewEncoder(w).Encode(response)
 }
@@ -0,0 +1,51 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/openai/openai-go/v2"
+)
+
+// Response modes of a question
+const (
+	ResponseModeDocuments = "documents" // the chunks found for the question
+	ResponseModeAnswer    = "answer"    // an answer of a chat model citing the chunks found, see Answerer
+)
+
+// NotFoundAnswer is the answer of Answerer when no document matches the question.
+const NotFoundAnswer = "Not found: no document of the knowledge base matches the question."
+
+const answerSystemPrompt = `You answer questions with the documents of a knowledge base, for another assistant.
+Write a short and precise answer. ` + citationsInstructions
+
+// Answerer asks a chat model for an answer grounded in the records found for a question, with inline citations:
+// small client models struggle to synthesize long lists of chunks.
+type Answerer struct {
+	Client openai.Client
+	Model  string
+}
+
+// Answer returns the answer of the chat model to the question, citing the records by their number ([1] is the first record,
+// see CitedRecords). Without records, it returns NotFoundAnswer without calling the chat model.
+func (a *Answerer) Answer(ctx context.Context, question string, records []VectorRecord) (string, error) {
+	if len(records) == 0 {
+		return NotFoundAnswer, nil
+	}
+	completion, err := a.Client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
+		Model: a.Model,
+		Messages: []openai.ChatCompletionMessageParamUnion{
+			openai.SystemMessage(answerSystemPrompt),
+			openai.UserMessage("Documents:\n\n" + CitationContext(records) + "\n\nQuestion: " + question),
+		},
+		Temperature: openai.Float(0),
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(completion.Choices) == 0 {
+		return "", fmt.Errorf("the chat model returned no answer")
+	}
+	return strings.TrimSpace(completion.Choices[0].Message.Content), nil
+}
@@ -0,0 +1,167 @@
+package rag
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+)
+
+// EmbeddingCache keeps the embeddings of the texts already embedded, keyed by (model, sha256 of the text),
+// so an unchanged chunk or a repeated question is not sent to the model again.
+// It is bounded by a number of entries and by a size in bytes: the least recently used entries are evicted first.
+// It is safe for concurrent use.
+type EmbeddingCache struct {
+	MaxEntries int // 0: no limit
+	MaxBytes   int // approximate size of the embeddings in memory, 0: no limit
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // most recently used first
+	bytes   int
+	hits    int
+	misses  int
+	changed bool
+}
+
+// EmbeddingCacheStats are the counters of an EmbeddingCache.
+type EmbeddingCacheStats struct {
+	Entries int `json:"entries"`
+	Bytes   int `json:"bytes"`
+	Hits    int `json:"hits"`
+	Misses  int `json:"misses"`
+}
+
+type cacheEntry struct {
+	Key       string
+	Embedding []float64
+}
+
+// NewEmbeddingCache creates an empty cache with the given bounds.
+func NewEmbeddingCache(maxEntries int, maxBytes int) *EmbeddingCache {
+	return &EmbeddingCache{
+		MaxEntries: maxEntries,
+		MaxBytes:   maxBytes,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// embeddingCacheKey returns the key of a text for a model: the text itself is not kept in the cache.
+func embeddingCacheKey(model string, text string) string {
+	hash := sha256.Sum256([]byte(text))
+	return model + ":" + hex.EncodeToString(hash[:])
+}
+
+// Get returns the cached embedding of the text for the model, and counts a hit or a miss.
+func (ec *EmbeddingCache) Get(model string, text string) ([]float64, bool) {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	element, exists := ec.entries[embeddingCacheKey(model, text)]
+	if !exists {
+		ec.misses++
+		return nil, false
+	}
+	ec.hits++
+	ec.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).Embedding, true
+}
+
+// Put adds the embedding of the text for the model, and evicts the least recently used entries beyond the bounds.
+func (ec *EmbeddingCache) Put(model string, text string, embedding []float64) {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	ec.add(embeddingCacheKey(model, text), embedding)
+	ec.changed = true
+}
+
+// add inserts or replaces an entry at the front of the list (the caller holds the mutex).
+func (ec *EmbeddingCache) add(key string, embedding []float64) {
+	if element, exists := ec.entries[key]; exists {
+		ec.remove(element)
+	}
+	entry := &cacheEntry{Key: key, Embedding: embedding}
+	ec.entries[key] = ec.order.PushFront(entry)
+	ec.bytes += entrySize(entry)
+
+	for ec.order.Len() > 0 && ((ec.MaxEntries > 0 && ec.order.Len() > ec.MaxEntries) || (ec.MaxBytes > 0 && ec.bytes > ec.MaxBytes)) {
+		ec.remove(ec.order.Back())
+	}
+}
+
+func (ec *EmbeddingCache) remove(element *list.Element) {
+	entry := ec.order.Remove(element).(*cacheEntry)
+	delete(ec.entries, entry.Key)
+	ec.bytes -= entrySize(entry)
+}
+
+// entrySize is the approximate memory size of an entry: 8 bytes per dimension and the key.
+func entrySize(entry *cacheEntry) int {
+	return len(entry.Key) + 8*len(entry.Embedding)
+}
+
+// Stats returns the number of entries, their size, and the hits and misses since the cache was created.
+func (ec *EmbeddingCache) Stats() EmbeddingCacheStats {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	return EmbeddingCacheStats{
+		Entries: ec.order.Len(),
+		Bytes:   ec.bytes,
+		Hits:    ec.hits,
+		Misses:  ec.misses,
+	}
+}
+
+// Load adds the entries of a cache file written by Persist (within the bounds of the cache).
+func (ec *EmbeddingCache) Load(cacheFilePath string) error {
+	file, err := os.Open(cacheFilePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	entries := []cacheEntry{}
+	if err := gob.NewDecoder(file).Decode(&entries); err != nil {
+		return err
+	}
+
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	// The file lists the most recently used entries first: add them from the last one
+	for idx := len(entries) - 1; idx >= 0; idx-- {
+		ec.add(entries[idx].Key, entries[idx].Embedding)
+	}
+	return nil
+}
+
+// Persist writes the entries to a file (most recently used first) if they changed since the last Persist or Load.
+// The file is written next to its final path and renamed, so a crash never leaves a truncated cache.
+func (ec *EmbeddingCache) Persist(cacheFilePath string) error {
+	ec.mutex.Lock()
+	if !ec.changed {
+		ec.mutex.Unlock()
+		return nil
+	}
+	entries := make([]cacheEntry, 0, ec.order.Len())
+	for element := ec.order.Front(); element != nil; element = element.Next() {
+		entries = append(entries, *element.Value.(*cacheEntry))
+	}
+	ec.changed = false
+	ec.mutex.Unlock()
+
+	if err := writeCacheFile(cacheFilePath, entries); err != nil {
+		ec.mutex.Lock()
+		ec.changed = true
+		ec.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+func writeCacheFile(cacheFilePath string, entries []cacheEntry) error {
+	return writeFileAtomically(cacheFilePath, func(writer io.Writer) error {
+		return gob.NewEncoder(writer).Encode(entries)
+	})
+}
@@ -0,0 +1,178 @@
+package rag
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// cacheKeys returns the keys of the cache, most recently used first.
+func cacheKeys(cache *EmbeddingCache) []string {
+	keys := []string{}
+	for element := cache.order.Front(); element != nil; element = element.Next() {
+		keys = append(keys, element.Value.(*cacheEntry).Key)
+	}
+	return keys
+}
+
+func TestEmbeddingCacheKey(t *testing.T) {
+	// sha256 of "hello"
+	want := "model-a:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if got := embeddingCacheKey("model-a", "hello"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// The same text embedded by two models: two entries
+	cache := NewEmbeddingCache(0, 0)
+	cache.Put("model-a", "hello", []float64{1, 0})
+	cache.Put("model-b", "hello", []float64{0, 1})
+	for model, want := range map[string][]float64{"model-a": {1, 0}, "model-b": {0, 1}} {
+		if got, found := cache.Get(model, "hello"); !found || !slices.Equal(got, want) {
+			t.Errorf("%s: got %v (%v), want %v", model, got, found, want)
+		}
+	}
+	if _, found := cache.Get("model-c", "hello"); found {
+		t.Error("found the embedding of another model")
+	}
+	if stats := cache.Stats(); stats.Entries != 2 || stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestEmbeddingCacheEvictsTheLeastRecentlyUsed(t *testing.T) {
+	cases := []struct {
+		name       string
+		maxEntries int
+		maxBytes   int
+		wantTexts  []string // the cached texts, most recently used first
+	}{
+		// "a" is read after "b" and "c" are added: "b" is the least recently used
+		{name: "max entries", maxEntries: 3, wantTexts: []string{"d", "a", "c"}},
+		// An entry of 2 dimensions takes 6 + 64 + 16 bytes with the "model:" key
+		{name: "max bytes", maxBytes: 3*86 + 85, wantTexts: []string{"d", "a", "c"}},
+		{name: "no limit", wantTexts: []string{"d", "a", "c", "b"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cache := NewEmbeddingCache(tc.maxEntries, tc.maxBytes)
+			for _, text := range []string{"a", "b", "c"} {
+				cache.Put("model", text, []float64{1, 2})
+			}
+			cache.Get("model", "a")
+			cache.Put("model", "d", []float64{3, 4})
+
+			want := []string{}
+			for _, text := range tc.wantTexts {
+				want = append(want, embeddingCacheKey("model", text))
+			}
+			if got := cacheKeys(cache); !slices.Equal(got, want) {
+				t.Errorf("got %v, want the keys of %v", got, tc.wantTexts)
+			}
+			if stats := cache.Stats(); stats.Bytes != 86*len(tc.wantTexts) {
+				t.Errorf("got %d bytes, want %d", stats.Bytes, 86*len(tc.wantTexts))
+			}
+		})
+	}
+}
+
+func TestEmbeddingCachePutReplaces(t *testing.T) {
+	cache := NewEmbeddingCache(0, 0)
+	cache.Put("model", "a", []float64{1, 2})
+	cache.Put("model", "b", []float64{1, 2})
+	cache.Put("model", "a", []float64{5, 6, 7})
+	if got, _ := cache.Get("model", "a"); !slices.Equal(got, []float64{5, 6, 7}) {
+		t.Errorf("got %v, want the new embedding", got)
+	}
+	if stats := cache.Stats(); stats.Entries != 2 || stats.Bytes != 86+94 {
+		t.Errorf("got %+v, want 2 entries of 86 and 94 bytes", stats)
+	}
+}
+
+func TestEmbeddingCachePersistAndLoad(t *testing.T) {
+	cacheFilePath := filepath.Join(t.TempDir(), "store.embeddings-cache")
+	cache := NewEmbeddingCache(0, 0)
+	for idx, text := range []string{"a", "b", "c", "d"} {
+		cache.Put("model", text, []float64{float64(idx), 1})
+	}
+	cache.Get("model", "a")
+	if err := cache.Persist(cacheFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(cacheFilePath + ".*.tmp"); len(files) > 0 {
+		t.Errorf("temporary files left: %v", files)
+	}
+
+	// Nothing changed: the file is not written again
+	if err := os.Remove(cacheFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Persist(cacheFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cacheFilePath); !os.IsNotExist(err) {
+		t.Fatalf("the unchanged cache was written again (%v)", err)
+	}
+	cache.Put("model", "e", []float64{4, 1})
+	if err := cache.Persist(cacheFilePath); err != nil {
+		t.Fatal(err)
+	}
+
+	// A smaller cache keeps the most recently used entries, in the same order
+	loaded := NewEmbeddingCache(3, 0)
+	if err := loaded.Load(cacheFilePath); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{embeddingCacheKey("model", "e"), embeddingCacheKey("model", "a"), embeddingCacheKey("model", "d")}
+	if got := cacheKeys(loaded); !slices.Equal(got, want) {
+		t.Errorf("got %v, want the keys of e, a and d", got)
+	}
+	if got, found := loaded.Get("model", "a"); !found || !slices.Equal(got, []float64{0, 1}) {
+		t.Errorf("got %v (%v), want [0 1]", got, found)
+	}
+	if loaded.changed {
+		t.Error("the loaded cache is marked as changed")
+	}
+}
+
+// A failed write keeps the previous file, and the entries are written by the next Persist.
+func TestEmbeddingCacheFailedPersist(t *testing.T) {
+	directory := t.TempDir()
+	cacheFilePath := filepath.Join(directory, "store.embeddings-cache")
+	cache := NewEmbeddingCache(0, 0)
+	cache.Put("model", "a", []float64{1, 2})
+	if err := cache.Persist(cacheFilePath); err != nil {
+		t.Fatal(err)
+	}
+	previous, err := os.ReadFile(cacheFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory cannot be replaced by the renamed file
+	cache.Put("model", "b", []float64{3, 4})
+	blocked := filepath.Join(directory, "blocked")
+	if err := os.MkdirAll(filepath.Join(blocked, "not-empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Persist(blocked); err == nil {
+		t.Fatal("got no error")
+	}
+	if files, _ := filepath.Glob(filepath.Join(directory, "*.tmp")); len(files) > 0 {
+		t.Errorf("temporary files left: %v", files)
+	}
+	if content, _ := os.ReadFile(cacheFilePath); string(content) != string(previous) {
+		t.Error("the previous cache file was modified")
+	}
+
+	if err := cache.Persist(cacheFilePath); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewEmbeddingCache(0, 0)
+	if err := loaded.Load(cacheFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Stats().Entries != 2 {
+		t.Errorf("got %d entries, want 2", loaded.Stats().Entries)
+	}
+}
@@ -0,0 +1,278 @@
+package rag
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	markdownHeader = regexp.MustCompile(`^\s{0,3}#{1,6}\s+`)
+	fenceOpening   = regexp.MustCompile("^\\s{0,3}(`{3,}|~{3,})")
+)
+
+// markdownBlock is a paragraph, a heading or a whole fenced code block of a markdown document.
+type markdownBlock struct {
+	text   string
+	isCode bool
+}
+
+// ChunkMarkdownWithCode splits markdown content into chunks of at most maxTokens estimated tokens
+// (see EstimateTokens) without ever splitting a fenced code block (``` or ~~~).
+// The document is first split by headers (headers inside code blocks are ignored), then:
+//   - a section that fits the budget is kept as one chunk,
+//   - otherwise the section header is repeated at the top of every chunk of the section,
+//     and each code block stays in the same chunk as the paragraph right before it (its description).
+//
+// A code block bigger than the budget is kept whole in its own chunk (with its header and description).
+// A maxTokens value <= 0 returns one chunk per section.
+func ChunkMarkdownWithCode(markdown string, maxTokens int) []string {
+	chunks := []string{}
+	pendingHeaders := ""
+	for _, section := range splitMarkdownSectionsOutsideCode(markdown) {
+		// A header without content (## Basic Syntax followed by ### Hello World) is kept with the next section
+		if !strings.Contains(section, "\n") && markdownHeader.MatchString(section) {
+			pendingHeaders += section + "\n"
+			continue
+		}
+		section = pendingHeaders + section
+		pendingHeaders = ""
+		if maxTokens <= 0 || EstimateTokens(section) <= maxTokens {
+			chunks = append(chunks, section)
+			continue
+		}
+		chunks = append(chunks, chunkMarkdownSection(section, maxTokens)...)
+	}
+	if pendingHeaders != "" {
+		chunks = append(chunks, strings.TrimSpace(pendingHeaders))
+	}
+	return chunks
+}
+
+// splitMarkdownSectionsOutsideCode works like SplitMarkdownBySections,
+// but the lines of fenced code blocks are never considered as headers
+// (`# comment` in a shell snippet, for example).
+func splitMarkdownSectionsOutsideCode(markdown string) []string {
+	sections := []string{}
+	current := []string{}
+	flush := func() {
+		section := strings.TrimSpace(strings.Join(current, "\n"))
+		if section != "" {
+			sections = append(sections, section)
+		}
+		current = []string{}
+	}
+
+	fence := ""
+	for _, line := range strings.Split(markdown, "\n") {
+		if fence == "" && markdownHeader.MatchString(line) {
+			flush()
+		}
+		fence = updateFence(fence, line)
+		current = append(current, line)
+	}
+	flush()
+	return sections
+}
+
+// updateFence returns the fence marker that is open after reading the line ("" when outside a code block).
+func updateFence(openFence, line string) string {
+	matches := fenceOpening.FindStringSubmatch(line)
+	if matches == nil {
+		return openFence
+	}
+	marker := matches[1]
+	if openFence == "" {
+		return marker
+	}
+	// A closing fence uses the same character, is at least as long, and has no info string
+	if marker[0] == openFence[0] && len(marker) >= len(openFence) && strings.TrimSpace(line[len(matches[0]):]) == "" {
+		return ""
+	}
+	return openFence
+}
+
+// splitMarkdownBlocks splits a markdown section into paragraphs and fenced code blocks.
+func splitMarkdownBlocks(section string) []markdownBlock {
+	blocks := []markdownBlock{}
+	current := []string{}
+	flush := func(isCode bool) {
+		text := strings.Trim(strings.Join(current, "\n"), "\n")
+		if strings.TrimSpace(text) != "" {
+			blocks = append(blocks, markdownBlock{text: text, isCode: isCode})
+		}
+		current = []string{}
+	}
+
+	fence := ""
+	for _, line := range strings.Split(section, "\n") {
+		newFence := updateFence(fence, line)
+		switch {
+		case fence == "" && newFence != "":
+			// Opening a code block
+			flush(false)
+			current = append(current, line)
+		case fence != "" && newFence == "":
+			// Closing a code block
+			current = append(current, line)
+			flush(true)
+		case fence == "" && strings.TrimSpace(line) == "":
+			flush(false)
+		default:
+			current = append(current, line)
+		}
+		fence = newFence
+	}
+	// An unclosed code block runs until the end of the section
+	flush(fence != "")
+	return blocks
+}
+
+// chunkMarkdownSection packs the blocks of a section bigger than maxTokens into several chunks.
+func chunkMarkdownSection(section string, maxTokens int) []string {
+	blocks := splitMarkdownBlocks(section)
+
+	header := ""
+	if len(blocks) > 0 && !blocks[0].isCode && markdownHeader.MatchString(blocks[0].text) {
+		header = blocks[0].text
+		blocks = blocks[1:]
+	}
+	budget := maxTokens - EstimateTokens(header)
+
+	// Glue each code block to the description that precedes it
+	groups := []string{}
+	for idx := 0; idx < len(blocks); idx++ {
+		block := blocks[idx]
+		if !block.isCode && idx+1 < len(blocks) && blocks[idx+1].isCode {
+			groups = append(groups, block.text+"\n"+blocks[idx+1].text)
+			idx++
+			continue
+		}
+		if !block.isCode && EstimateTokens(block.text) > budget {
+			// Long prose: it is safe to split it (there is no code inside)
+			groups = append(groups, ChunkTextByTokens(block.text, budget, 0)...)
+			continue
+		}
+		groups = append(groups, block.text)
+	}
+
+	chunks := []string{}
+	current := []string{}
+	currentTokens := 0
+	flush := func() {
+		if len(current) == 0 {
+			return
+		}
+		body := strings.Join(current, "\n\n")
+		if header != "" {
+			body = header + "\n\n" + body
+		}
+		chunks = append(chunks, body)
+		current = []string{}
+		currentTokens = 0
+	}
+	for _, group := range groups {
+		tokens := EstimateTokens(group)
+		if currentTokens+tokens > budget && len(current) > 0 {
+			flush()
+		}
+		current = append(current, group)
+		currentTokens += tokens
+	}
+	flush()
+	return chunks
+}
+
+// --- Source code ---
+
+// declarationPatterns matches the lines starting a top-level declaration, per language.
+var declarationPatterns = map[string]*regexp.Regexp{
+	"go":    regexp.MustCompile(`^(func|type|var|const)\b`),
+	"rust":  regexp.MustCompile(`^(pub(\([^)]*\))?\s+)?((async|const|unsafe|extern(\s+"[^"]*")?)\s+)*(fn|struct|enum|union|trait|impl|mod|type|const|static|macro_rules!)\W`),
+	"swift": regexp.MustCompile(`^((public|private|fileprivate|internal|open|final|static|indirect|nonisolated)\s+)*(func|class|struct|enum|protocol|extension|actor|typealias|let|var)\b`),
+}
+
+// leadingDecorations matches the lines that belong to the next declaration (doc comments, attributes).
+var leadingDecorations = regexp.MustCompile(`^(//|/\*|\*|#\[|#!\[|@)`)
+
+// LanguageFromExtension returns the language name used by ChunkSourceCode for a file path or extension
+// (".go" -> "go", ".rs" -> "rust", ".swift" -> "swift"), or "" when the language is not supported.
+func LanguageFromExtension(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".go":
+		return "go"
+	case ".rs":
+		return "rust"
+	case ".swift":
+		return "swift"
+	}
+	return ""
+}
+
+// ChunkSourceCode splits a source file at its top-level function and type boundaries.
+// Each declaration keeps its doc comments and attributes; small consecutive declarations
+// are merged up to maxTokens estimated tokens, and a declaration bigger than the budget
+// is split with ChunkTextByTokens (at its blank lines, then at its lines).
+//
+// Parameters:
+//   - source: The content of the source file.
+//   - language: "go", "rust" or "swift" (see LanguageFromExtension). Other values fall back to ChunkTextByTokens.
+//   - maxTokens: The token budget of a chunk. A value <= 0 returns one chunk per declaration.
+//
+// Returns:
+//   - []string: The chunks of the source file.
+func ChunkSourceCode(source, language string, maxTokens int) []string {
+	pattern, ok := declarationPatterns[language]
+	if !ok {
+		return ChunkTextByTokens(source, maxTokens, 0)
+	}
+
+	lines := strings.Split(source, "\n")
+	declarations := []string{}
+	start := 0
+	for idx, line := range lines {
+		if idx == 0 || !pattern.MatchString(line) {
+			continue
+		}
+		// Attach the comments and attributes right above the declaration
+		boundary := idx
+		for boundary > start && leadingDecorations.MatchString(strings.TrimSpace(lines[boundary-1])) {
+			boundary--
+		}
+		if boundary == start {
+			continue
+		}
+		declarations = append(declarations, strings.Join(lines[start:boundary], "\n"))
+		start = boundary
+	}
+	declarations = append(declarations, strings.Join(lines[start:], "\n"))
+
+	chunks := []string{}
+	current := ""
+	currentTokens := 0
+	for _, declaration := range declarations {
+		declaration = strings.Trim(declaration, "\n")
+		if strings.TrimSpace(declaration) == "" {
+			continue
+		}
+		tokens := EstimateTokens(declaration)
+		if current != "" && (maxTokens <= 0 || currentTokens+tokens > maxTokens) {
+			chunks = append(chunks, current)
+			current = ""
+			currentTokens = 0
+		}
+		if maxTokens > 0 && tokens > maxTokens {
+			chunks = append(chunks, ChunkTextByTokens(declaration, maxTokens, 0)...)
+			continue
+		}
+		if current != "" {
+			current += "\n\n"
+		}
+		current += declaration
+		currentTokens += tokens
+	}
+	if current != "" {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
@@ -0,0 +1,48 @@
+package rag
+
+import (
+	"maps"
+	"strconv"
+)
+
+// Chunk methods of ChunkDocument
+const (
+	ChunkMethodText   = "text"   // fixed size in runes, with overlap
+	ChunkMethodTokens = "tokens" // token budget, paragraph and sentence aware
+	ChunkMethodCode   = "code"   // token budget, never splits a fenced code block
+)
+
+// ChunkOptions configures ChunkDocument.
+type ChunkOptions struct {
+	Method        string // ChunkMethodText (default), ChunkMethodTokens or ChunkMethodCode
+	Size          int    // chunk size in runes (text method)
+	Overlap       int    // overlap in runes (text method)
+	MaxTokens     int    // token budget (tokens and code methods, and source code)
+	OverlapTokens int    // overlap in tokens (tokens method)
+}
+
+// ChunkDocument splits a document with the chunk method of the options (source code at function and type boundaries)
+// and returns the chunks with their metadata (the metadata of the document win), without embeddings.
+func ChunkDocument(source string, document Document, options ChunkOptions) []VectorRecord {
+	var texts []string
+	switch {
+	case document.Language != "":
+		texts = ChunkSourceCode(document.Text, document.Language, options.MaxTokens)
+	case options.Method == ChunkMethodTokens:
+		texts = ChunkTextByTokens(document.Text, options.MaxTokens, options.OverlapTokens)
+	case options.Method == ChunkMethodCode:
+		texts = ChunkMarkdownWithCode(document.Text, options.MaxTokens)
+	default:
+		texts = ChunkText(document.Text, options.Size, options.Overlap)
+	}
+
+	chunks := make([]VectorRecord, 0, len(texts))
+	for idx, text := range texts {
+		metadata := ExtractMetadata(text)
+		maps.Copy(metadata, document.Metadata)
+		metadata[MetadataSource] = source
+		metadata[MetadataChunk] = strconv.Itoa(idx)
+		chunks = append(chunks, VectorRecord{Prompt: text, Metadata: metadata})
+	}
+	return chunks
+}
@@ -7,22 +7,37 @@ import (
 
 // ChunkText takes a text string and divides it into chunks of a specified size with a given overlap.
 // It returns a slice of strings, where each string represents a chunk of the original text.
+// Sizes are expressed in runes (not bytes), so multi-byte characters are never split.
 //
 // Parameters:
 //   - text: The input text to be chunked.
-//   - chunkSize: The size of each chunk.
-//   - overlap: The amount of overlap between consecutive chunks.
+//   - chunkSize: The size of each chunk (in runes). A value <= 0 returns the whole text as one chunk.
+//   - overlap: The amount of overlap between consecutive chunks (in runes).
+//     It is ignored (set to 0) when it is negative or not smaller than chunkSize.
 //
 // Returns:
 //   - []string: A slice of strings representing the chunks of the original text.
 func ChunkText(text string, chunkSize, overlap int) []string {
 	chunks := []string{}
-	for start := 0; start < len(text); start += chunkSize - overlap {
+	runes := []rune(text)
+	if chunkSize <= 0 {
+		if len(runes) > 0 {
+			chunks = append(chunks, text)
+		}
+		return chunks
+	}
+	if overlap < 0 || overlap >= chunkSize {
+		overlap = 0
+	}
+	for start := 0; start < len(runes); start += chunkSize - overlap {
 		end := start + chunkSize
-		if end > len(text) {
-			end = len(text)
+		if end > len(runes) {
+			end = len(runes)
+		}
+		chunks = append(chunks, string(runes[start:end]))
+		if end == len(runes) {
+			break
 		}
-		chunks = append(chunks, text[start:end])
 	}
 	return chunks
 }
@@ -0,0 +1,223 @@
+package rag
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// charsPerToken is the average number of letters per token used by EstimateTokens.
+// BPE tokenizers used by embedding models average around 4 characters per token
+// for English prose, a bit less for French or code.
+const charsPerToken = 4
+
+var (
+	paragraphBoundary = regexp.MustCompile(`\n[ \t]*\n\s*`)
+	sentenceBoundary  = regexp.MustCompile(`[.!?…;:][)"'»]*\s+|\n\s*`)
+	wordBoundary      = regexp.MustCompile(`\s+`)
+)
+
+// EstimateTokens returns an approximation of the number of tokens an embedding model
+// will see for the given text.
+// Every run of letters or digits counts for one token per charsPerToken runes (at least one),
+// and every other non-space rune (punctuation, symbols, emojis) counts for one token.
+func EstimateTokens(text string) int {
+	tokens := 0
+	wordLength := 0
+	flushWord := func() {
+		if wordLength > 0 {
+			tokens += (wordLength + charsPerToken - 1) / charsPerToken
+			wordLength = 0
+		}
+	}
+	for _, r := range text {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r):
+			wordLength++
+		case unicode.IsSpace(r):
+			flushWord()
+		default:
+			flushWord()
+			tokens++
+		}
+	}
+	flushWord()
+	return tokens
+}
+
+// ChunkTextByTokens splits the text into chunks of at most maxTokens estimated tokens
+// (see EstimateTokens), never splitting a multi-byte rune.
+// Chunks are built from whole paragraphs whenever possible. A paragraph larger than the
+// budget is split into sentences, a sentence into words, and a single oversized word into runes.
+// Consecutive chunks share up to overlapTokens tokens of trailing content.
+//
+// Parameters:
+//   - text: The input text to be chunked.
+//   - maxTokens: The maximum token budget of a chunk. A value <= 0 returns the whole text as one chunk.
+//   - overlapTokens: The token budget repeated at the beginning of the next chunk.
+//     It is ignored (set to 0) when it is negative or not smaller than maxTokens.
+//
+// Returns:
+//   - []string: A slice of trimmed, non-empty chunks.
+func ChunkTextByTokens(text string, maxTokens, overlapTokens int) []string {
+	if strings.TrimSpace(text) == "" {
+		return []string{}
+	}
+	if maxTokens <= 0 {
+		return []string{strings.TrimSpace(text)}
+	}
+	if overlapTokens < 0 || overlapTokens >= maxTokens {
+		overlapTokens = 0
+	}
+
+	units := splitIntoUnits(text, maxTokens)
+
+	chunks := []string{}
+	var current []textUnit
+	currentTokens := 0
+
+	flush := func() {
+		chunk := strings.TrimSpace(joinUnits(current))
+		if chunk != "" {
+			chunks = append(chunks, chunk)
+		}
+	}
+
+	for _, unit := range units {
+		if currentTokens+unit.tokens > maxTokens && len(current) > 0 {
+			flush()
+			// Keep the tail of the previous chunk as overlap, as long as it leaves room for the unit
+			current = overlapTail(current, overlapTokens, maxTokens-unit.tokens)
+			currentTokens = sumTokens(current)
+		}
+		current = append(current, unit)
+		currentTokens += unit.tokens
+	}
+	if len(current) > 0 {
+		flush()
+	}
+	return chunks
+}
+
+// textUnit is a piece of the original text (with its trailing separator)
+// that fits in a token budget.
+type textUnit struct {
+	text   string
+	tokens int
+}
+
+// splitIntoUnits cuts the text into units of at most maxTokens estimated tokens,
+// from the coarsest boundary (paragraphs) to the finest one (runes).
+func splitIntoUnits(text string, maxTokens int) []textUnit {
+	splitters := []func(string) []string{
+		func(s string) []string { return splitKeepingSeparator(s, paragraphBoundary) },
+		func(s string) []string { return splitKeepingSeparator(s, sentenceBoundary) },
+		func(s string) []string { return splitKeepingSeparator(s, wordBoundary) },
+	}
+
+	var split func(piece string, level int) []textUnit
+	split = func(piece string, level int) []textUnit {
+		tokens := EstimateTokens(piece)
+		if tokens <= maxTokens {
+			return []textUnit{{text: piece, tokens: tokens}}
+		}
+		if level >= len(splitters) {
+			return splitRunes(piece, maxTokens)
+		}
+		parts := splitters[level](piece)
+		if len(parts) == 1 {
+			return split(piece, level+1)
+		}
+		units := []textUnit{}
+		for _, part := range parts {
+			units = append(units, split(part, level+1)...)
+		}
+		return units
+	}
+	return split(text, 0)
+}
+
+// splitKeepingSeparator splits the text after each match of the separator,
+// keeping the separator at the end of the preceding part so no character is lost.
+func splitKeepingSeparator(text string, separator *regexp.Regexp) []string {
+	parts := []string{}
+	start := 0
+	for _, match := range separator.FindAllStringIndex(text, -1) {
+		if match[1] <= start {
+			continue
+		}
+		parts = append(parts, text[start:match[1]])
+		start = match[1]
+	}
+	if start < len(text) {
+		parts = append(parts, text[start:])
+	}
+	return parts
+}
+
+// splitRunes is the last resort for a single "word" bigger than the budget (a long URL, a base64 blob...):
+// it cuts it, in a single pass, before the rune that would take a piece over maxTokens
+// (every maxTokens*charsPerToken runes for letters and digits, sooner with symbols).
+func splitRunes(text string, maxTokens int) []textUnit {
+	units := []textUnit{}
+	start, tokens, wordLength := 0, 0, 0
+	// cost is the number of tokens the rune adds to the piece (see EstimateTokens)
+	cost := func(r rune) int {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r):
+			if wordLength%charsPerToken == 0 {
+				return 1
+			}
+			return 0
+		case unicode.IsSpace(r):
+			return 0
+		default:
+			return 1
+		}
+	}
+	for offset, r := range text {
+		if offset > start && tokens+cost(r) > maxTokens {
+			units = append(units, textUnit{text: text[start:offset], tokens: tokens})
+			start, tokens, wordLength = offset, 0, 0
+		}
+		tokens += cost(r)
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) {
+			wordLength++
+		} else {
+			wordLength = 0
+		}
+	}
+	if start < len(text) {
+		units = append(units, textUnit{text: text[start:], tokens: tokens})
+	}
+	return units
+}
+
+// overlapTail returns the last units of a chunk whose total is at most overlapTokens
+// and at most room tokens.
+func overlapTail(units []textUnit, overlapTokens, room int) []textUnit {
+	budget := min(overlapTokens, room)
+	total := 0
+	start := len(units)
+	for start > 0 && total+units[start-1].tokens <= budget {
+		total += units[start-1].tokens
+		start--
+	}
+	return append([]textUnit{}, units[start:]...)
+}
+
+func joinUnits(units []textUnit) string {
+	var builder strings.Builder
+	for _, unit := range units {
+		builder.WriteString(unit.text)
+	}
+	return builder.String()
+}
+
+func sumTokens(units []textUnit) int {
+	total := 0
+	for _, unit := range units {
+		total += unit.tokens
+	}
+	return total
+}
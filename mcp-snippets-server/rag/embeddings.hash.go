@@ -0,0 +1,81 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// DefaultHashEmbeddingDimension is the dimension of the hash embeddings when none is given.
+const DefaultHashEmbeddingDimension = 256
+
+// HashEmbedding returns a deterministic embedding of the text, computed locally without any model:
+// every word and every trigram of letters of the words is hashed to a dimension of the vector (feature hashing),
+// and the vector is normalized. Texts sharing words or word parts are close, which is enough
+// to evaluate or test the retrieval pipeline offline, but it does not capture the meaning of the text.
+func HashEmbedding(text string, dimension int) []float64 {
+	if dimension <= 0 {
+		dimension = DefaultHashEmbeddingDimension
+	}
+	vector := make([]float64, dimension)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	for _, word := range words {
+		addHashedFeature(vector, "w:"+word, 1)
+		runes := []rune("<" + word + ">")
+		for idx := 0; idx+3 <= len(runes); idx++ {
+			addHashedFeature(vector, "t:"+string(runes[idx:idx+3]), 0.5)
+		}
+	}
+
+	norm := 0.0
+	for _, value := range vector {
+		norm += value * value
+	}
+	if norm > 0 {
+		norm = math.Sqrt(norm)
+		for idx := range vector {
+			vector[idx] /= norm
+		}
+	}
+	return vector
+}
+
+// addHashedFeature adds the weight to the dimension of the feature, with a sign also taken from the hash
+// (so that the collisions cancel out instead of adding up).
+func addHashedFeature(vector []float64, feature string, weight float64) {
+	hash := fnv.New64a()
+	hash.Write([]byte(feature))
+	sum := hash.Sum64()
+	if sum&(1<<63) != 0 {
+		weight = -weight
+	}
+	vector[sum%uint64(len(vector))] += weight
+}
+
+// HashEmbedder computes the embeddings with HashEmbedding: deterministic and offline, to test or evaluate without a model.
+type HashEmbedder struct {
+	Dimension int // DefaultHashEmbeddingDimension when 0
+}
+
+// EmbedBatch returns the hash embeddings of the texts.
+func (he *HashEmbedder) EmbedBatch(ctx context.Context, texts []string) ([][]float64, error) {
+	vectors := make([][]float64, len(texts))
+	for idx, text := range texts {
+		vectors[idx] = HashEmbedding(text, he.Dimension)
+	}
+	return vectors, nil
+}
+
+// ModelName returns "hash-<dimension>": hash embeddings of different dimensions cannot be compared.
+func (he *HashEmbedder) ModelName() string {
+	dimension := he.Dimension
+	if dimension <= 0 {
+		dimension = DefaultHashEmbeddingDimension
+	}
+	return fmt.Sprintf("hash-%d", dimension)
+}
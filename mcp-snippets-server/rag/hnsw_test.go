@@ -0,0 +1,97 @@
+package rag
+
+import (
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// randomVectors returns count vectors of the given dimension, always the same for a seed.
+func randomVectors(seed uint64, count, dimension int) [][]float64 {
+	random := rand.New(rand.NewPCG(seed, seed))
+	vectors := make([][]float64, count)
+	for idx := range vectors {
+		vectors[idx] = make([]float64, dimension)
+		for dim := range vectors[idx] {
+			vectors[idx][dim] = random.NormFloat64()
+		}
+	}
+	return vectors
+}
+
+func TestHNSWIndexRemoveKeepsATombstone(t *testing.T) {
+	index := NewHNSWIndex(DefaultHNSWOptions())
+	vectors := randomVectors(1, 3, 8)
+	for idx, id := range []string{"a", "b", "c"} {
+		index.Add(id, vectors[idx])
+	}
+
+	index.Remove("b")
+	index.Remove("unknown")
+	if index.Count() != 2 {
+		t.Errorf("got %d vectors, want 2", index.Count())
+	}
+	if ratio := index.DeletedRatio(); ratio != 1.0/3 {
+		t.Errorf("got a deleted ratio of %f, want 1/3", ratio)
+	}
+	// The deleted node keeps its (normalized) vector: it is still used to walk the graph
+	node := index.nodes[1]
+	if !node.Deleted || !slices.Equal(node.DeletedVector, normalize(vectors[1])) {
+		t.Errorf("got node %+v, want a tombstone with its vector", node)
+	}
+	for _, match := range index.Search(vectors[1], 3, 0) {
+		if match.Id == "b" {
+			t.Errorf("the deleted vector is found: %v", match)
+		}
+	}
+
+	// Adding it again creates a new node, the tombstone stays
+	index.Add("b", vectors[1])
+	if index.Count() != 3 || index.DeletedRatio() != 0.25 {
+		t.Errorf("got %d vectors and a deleted ratio of %f, want 3 and 0.25", index.Count(), index.DeletedRatio())
+	}
+	if matches := index.Search(vectors[1], 1, 0); len(matches) != 1 || matches[0].Id != "b" {
+		t.Errorf("got %v, want b", matches)
+	}
+}
+
+func TestHNSWIndexPersistAndLoad(t *testing.T) {
+	index := NewHNSWIndex(HNSWOptions{M: 8, EfConstruction: 50, EfSearch: 20})
+	vectors := randomVectors(2, 100, 16)
+	byId := make(map[string][]float64)
+	for idx, vector := range vectors {
+		id := testRecord(idx).Id
+		index.Add(id, vector)
+		byId[id] = vector
+	}
+	index.Remove(testRecord(3).Id)
+	delete(byId, testRecord(3).Id)
+
+	indexFilePath := filepath.Join(t.TempDir(), "store.bin.hnsw")
+	if err := index.Persist(indexFilePath); err != nil {
+		t.Fatal(err)
+	}
+	getVector := func(id string) ([]float64, bool) {
+		vector, exists := byId[id]
+		return vector, exists
+	}
+	loaded, inSync, err := LoadHNSWIndex(indexFilePath, getVector)
+	if err != nil || !inSync {
+		t.Fatalf("got in sync %v and error %v", inSync, err)
+	}
+	if loaded.Count() != 99 || loaded.DeletedRatio() != index.DeletedRatio() || loaded.Options != index.Options {
+		t.Errorf("got %d vectors, a deleted ratio of %f and %+v", loaded.Count(), loaded.DeletedRatio(), loaded.Options)
+	}
+	for _, query := range vectors[:10] {
+		if got, want := loaded.Search(query, 5, 0), index.Search(query, 5, 0); !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	// A vector missing from the store: the graph is out of sync
+	delete(byId, testRecord(4).Id)
+	if _, inSync, err := LoadHNSWIndex(indexFilePath, getVector); err != nil || inSync {
+		t.Errorf("got in sync %v and error %v, want out of sync", inSync, err)
+	}
+}
@@ -0,0 +1,104 @@
+package rag
+
+import (
+	"maps"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadDocument(t *testing.T) {
+	cases := []struct {
+		file         string
+		wantMetadata map[string]string
+		wantText     string
+	}{
+		{
+			// The invisible elements are removed, the headings and the code blocks are converted to markdown
+			file:         "page.html",
+			wantMetadata: map[string]string{MetadataFormat: "html", MetadataTitle: "Getting started & more"},
+			wantText: "# Install the CLI\n\nDownload the binary, then run:\n\n" +
+				"```\ndevtools --version\nif a < b {\n    run()\n}\n```\n\n" +
+				"## Features\n\n- Fast\n\n- Small > big",
+		},
+		{
+			// The levels follow the order of the adornment styles; a short underline is not a title
+			file:         "guide.rst",
+			wantMetadata: map[string]string{MetadataFormat: "rst", MetadataTitle: "User guide"},
+			wantText: "# User guide\n\n## Introduction\n\nSome text.\n\n### Details\n\nMore text.\n\n" +
+				"## Other section\n\nNot a title\n--\n",
+		},
+		{
+			file:         "config.json",
+			wantMetadata: map[string]string{MetadataFormat: "json"},
+			wantText: "debug: false\nname: devtools\nratio: 0.75\n" +
+				"server.hosts[0]: a.local\nserver.hosts[1]: b.local\nserver.port: 8080\nserver.tls: null",
+		},
+		{
+			// A stream of two documents
+			file:         "config.yaml",
+			wantMetadata: map[string]string{MetadataFormat: "yaml"},
+			wantText: "name: devtools\nserver.hosts[0]: a.local\nserver.hosts[1]: b.local\nserver.port: 8080\n\n" +
+				"1: one\nlist[0].key: value",
+		},
+		{
+			// The empty values are skipped, the columns without a header are numbered
+			file:         "users.csv",
+			wantMetadata: map[string]string{MetadataFormat: "csv"},
+			wantText: "name: mcp-devtools, language: go, column 3: x, stars: 42\n" +
+				"name: snippets, language: rust\nstars: 7",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.file, func(t *testing.T) {
+			document, err := LoadDocument(filepath.Join("testdata", "loaders", tc.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if document.Text != tc.wantText {
+				t.Errorf("got text\n%s\nwant\n%s", document.Text, tc.wantText)
+			}
+			if !maps.Equal(document.Metadata, tc.wantMetadata) {
+				t.Errorf("got metadata %v, want %v", document.Metadata, tc.wantMetadata)
+			}
+			if document.Language != "" {
+				t.Errorf("got language %q, want none", document.Language)
+			}
+		})
+	}
+}
+
+func TestParseDocument(t *testing.T) {
+	cases := []struct {
+		path         string
+		content      string
+		wantMetadata map[string]string
+		wantLanguage string
+		wantErr      bool
+	}{
+		{path: "README.MD", content: "# Title", wantMetadata: map[string]string{MetadataFormat: "markdown"}},
+		{path: "notes.adoc", content: "= Title", wantMetadata: map[string]string{MetadataFormat: "text"}},
+		{path: "main.go", content: "package main", wantMetadata: map[string]string{MetadataFormat: "code", MetadataLanguage: "go"}, wantLanguage: "go"},
+		{path: "empty.csv", content: "", wantMetadata: map[string]string{MetadataFormat: "csv"}},
+		{path: "invalid.json", content: `{"name": `, wantErr: true},
+		{path: "invalid.yaml", content: "key: [value", wantErr: true},
+		{path: "invalid.csv", content: "name\n\"unterminated", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.path, func(t *testing.T) {
+			document, err := ParseDocument(tc.path, []byte(tc.content))
+			if tc.wantErr {
+				if err == nil || !strings.HasPrefix(err.Error(), tc.path+": ") {
+					t.Fatalf("got %v, want an error about %s", err, tc.path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(document.Metadata, tc.wantMetadata) || document.Language != tc.wantLanguage {
+				t.Errorf("got metadata %v and language %q, want %v and %q", document.Metadata, document.Language, tc.wantMetadata, tc.wantLanguage)
+			}
+		})
+	}
+}
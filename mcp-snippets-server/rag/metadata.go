@@ -0,0 +1,188 @@
+package rag
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Metadata keys of the vector records
+const (
+	MetadataSource      = "source"       // path of the source document
+	MetadataLanguage    = "language"     // programming language of the (first) code block, see NormalizeLanguage
+	MetadataTags        = "tags"         // comma-separated tags
+	MetadataHeaderLevel = "header_level" // level of the first markdown header of the chunk (1 for #, 2 for ##...)
+	MetadataChunk       = "chunk"        // position of the chunk in its source document (0 for the first chunk)
+	MetadataEmbedding   = "embedding"    // what was embedded for the record, ex: SnippetEmbeddingScheme
+	MetadataSnippet     = "snippet"      // ID of the snippet of the chunk: the chunks of a split snippet share it (see ChunkSnippet)
+)
+
+var (
+	firstFenceInfo = regexp.MustCompile("(?m)^\\s{0,3}(?:`{3,}|~{3,})\\s*([\\w+#-]+)")
+	firstHeader    = regexp.MustCompile(`(?m)^\s{0,3}(#{1,6})\s+`)
+)
+
+// NormalizeLanguage returns the canonical name of a programming language
+// ("golang" -> "go", "rs" -> "rust"...), in lower case.
+func NormalizeLanguage(language string) string {
+	language = strings.ToLower(strings.TrimSpace(language))
+	switch language {
+	case "golang":
+		return "go"
+	case "rs":
+		return "rust"
+	case "js":
+		return "javascript"
+	case "ts":
+		return "typescript"
+	case "py":
+		return "python"
+	case "sh", "shell", "zsh":
+		return "bash"
+	}
+	return language
+}
+
+// ExtractMetadata returns the metadata that can be read from the text of a chunk:
+// the language of its first fenced code block and the level of its first header.
+func ExtractMetadata(chunk string) map[string]string {
+	metadata := make(map[string]string)
+	if matches := firstFenceInfo.FindStringSubmatch(chunk); matches != nil {
+		metadata[MetadataLanguage] = NormalizeLanguage(matches[1])
+	}
+	if matches := firstHeader.FindStringSubmatch(chunk); matches != nil {
+		metadata[MetadataHeaderLevel] = strconv.Itoa(len(matches[1]))
+	}
+	return metadata
+}
+
+// BackfillMetadata adds the metadata extracted from the prompt (see ExtractMetadata)
+// to the records saved without metadata, and returns the number of updated records.
+func BackfillMetadata(store VectorStore) (int, error) {
+	records, err := store.GetAll()
+	if err != nil {
+		return 0, err
+	}
+	updated := 0
+	for _, record := range records {
+		if record.Metadata != nil {
+			continue
+		}
+		record.Metadata = ExtractMetadata(record.Prompt)
+		if _, err := store.Save(record); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+// --- Filters ---
+
+// Filter operators
+const (
+	OperatorEquals       = "="
+	OperatorNotEquals    = "!="
+	OperatorPrefix       = "^=" // the value starts with
+	OperatorContains     = "~=" // the comma-separated list contains (tags)
+	OperatorLessOrEqual  = "<=" // numeric comparison
+	OperatorGreaterEqual = ">=" // numeric comparison
+)
+
+// Condition is a test on a metadata value of a record.
+type Condition struct {
+	Key      string
+	Operator string
+	Value    string
+}
+
+// Filter is a list of conditions on the metadata of the records: a record matches when all the conditions match.
+// An empty filter matches every record.
+type Filter []Condition
+
+var (
+	// filterCondition matches "key<operator>value" (operators with two characters first)
+	filterCondition = regexp.MustCompile(`^\s*([\w.-]+)\s*(!=|\^=|~=|<=|>=|=)\s*(.*?)\s*$`)
+	// filterSeparator matches the separator of the conditions of a filter expression
+	filterSeparator = regexp.MustCompile(`\s+(?i:and)\s+|\s*&&\s*`)
+)
+
+// ParseFilter parses a filter expression: conditions separated by "AND" (or "&&"),
+// each condition being key=value, key!=value, key^=prefix, key~=tag, key<=number or key>=number.
+//
+// Example: `language=rust AND source^=markdown/ AND header_level<=2`
+func ParseFilter(expression string) (Filter, error) {
+	filter := Filter{}
+	if strings.TrimSpace(expression) == "" {
+		return filter, nil
+	}
+	parts := filterSeparator.Split(expression, -1)
+	for _, part := range parts {
+		matches := filterCondition.FindStringSubmatch(part)
+		if matches == nil {
+			return nil, fmt.Errorf("invalid filter condition %q (expected key=value, key!=value, key^=prefix, key~=tag, key<=number or key>=number)", part)
+		}
+		condition := Condition{Key: matches[1], Operator: matches[2], Value: strings.Trim(matches[3], `"'`)}
+		if condition.Operator == OperatorLessOrEqual || condition.Operator == OperatorGreaterEqual {
+			if _, err := strconv.ParseFloat(condition.Value, 64); err != nil {
+				return nil, fmt.Errorf("invalid filter condition %q: %s expects a number", part, condition.Operator)
+			}
+		}
+		filter = append(filter, condition)
+	}
+	return filter, nil
+}
+
+// Match returns true if the record matches all the conditions of the filter.
+func (filter Filter) Match(record VectorRecord) bool {
+	for _, condition := range filter {
+		if !condition.Match(record.Metadata) {
+			return false
+		}
+	}
+	return true
+}
+
+// Match returns true if the metadata satisfies the condition.
+// Languages are compared after NormalizeLanguage; a missing key only satisfies the != operator.
+func (condition Condition) Match(metadata map[string]string) bool {
+	value, exists := metadata[condition.Key]
+	expected := condition.Value
+	if condition.Key == MetadataLanguage {
+		value, expected = NormalizeLanguage(value), NormalizeLanguage(expected)
+	}
+	if !exists {
+		return condition.Operator == OperatorNotEquals
+	}
+
+	switch condition.Operator {
+	case OperatorEquals:
+		return value == expected
+	case OperatorNotEquals:
+		return value != expected
+	case OperatorPrefix:
+		return strings.HasPrefix(value, expected)
+	case OperatorContains:
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), expected) {
+				return true
+			}
+		}
+		return false
+	case OperatorLessOrEqual, OperatorGreaterEqual:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		limit, err := strconv.ParseFloat(expected, 64)
+		if err != nil {
+			return false
+		}
+		if condition.Operator == OperatorLessOrEqual {
+			return number <= limit
+		}
+		return number >= limit
+	}
+	return false
+}
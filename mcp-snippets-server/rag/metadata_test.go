@@ -0,0 +1,189 @@
+package rag
+
+import (
+	"maps"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	cases := []struct {
+		name       string
+		expression string
+		want       Filter
+		wantErr    string
+	}{
+		{name: "empty", expression: "  ", want: Filter{}},
+		{name: "equals", expression: "language=rust", want: Filter{{Key: "language", Operator: OperatorEquals, Value: "rust"}}},
+		{
+			name:       "every operator",
+			expression: "a=1 AND b!=2 and c^=x/ && d~=tag AND e<=2 AND f>=-1.5",
+			want: Filter{
+				{Key: "a", Operator: OperatorEquals, Value: "1"},
+				{Key: "b", Operator: OperatorNotEquals, Value: "2"},
+				{Key: "c", Operator: OperatorPrefix, Value: "x/"},
+				{Key: "d", Operator: OperatorContains, Value: "tag"},
+				{Key: "e", Operator: OperatorLessOrEqual, Value: "2"},
+				{Key: "f", Operator: OperatorGreaterEqual, Value: "-1.5"},
+			},
+		},
+		{
+			name:       "spaces and quotes",
+			expression: ` source ^= "markdown/go files/"  AND tags ~= 'web' `,
+			want: Filter{
+				{Key: "source", Operator: OperatorPrefix, Value: "markdown/go files/"},
+				{Key: "tags", Operator: OperatorContains, Value: "web"},
+			},
+		},
+		{
+			name:       "and inside a value",
+			expression: "source=brand AND tags~=android",
+			want: Filter{
+				{Key: "source", Operator: OperatorEquals, Value: "brand"},
+				{Key: "tags", Operator: OperatorContains, Value: "android"},
+			},
+		},
+		{name: "empty value", expression: "tags=", want: Filter{{Key: "tags", Operator: OperatorEquals, Value: ""}}},
+		{name: "no operator", expression: "language rust", wantErr: `invalid filter condition "language rust"`},
+		{name: "no key", expression: "=rust", wantErr: `invalid filter condition "=rust"`},
+		{name: "empty condition", expression: "language=rust AND ", wantErr: "invalid filter condition"},
+		{name: "unknown operator", expression: "header_level<2", wantErr: `invalid filter condition "header_level<2"`},
+		{name: "not a number", expression: "header_level>=two", wantErr: ">= expects a number"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			filter, err := ParseFilter(tc.expression)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got %v, want an error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(filter, tc.want) {
+				t.Errorf("got %+v, want %+v", filter, tc.want)
+			}
+		})
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	metadata := map[string]string{
+		MetadataSource:      "markdown/rust/hello.md",
+		MetadataLanguage:    "rust",
+		MetadataTags:        "Web, cli",
+		MetadataHeaderLevel: "2",
+	}
+	cases := []struct {
+		expression string
+		want       bool
+	}{
+		{expression: "", want: true},
+		{expression: "language=rust", want: true},
+		{expression: "language=rs", want: true},
+		{expression: "language=go", want: false},
+		{expression: "language!=go", want: true},
+		{expression: "source^=markdown/", want: true},
+		{expression: "source^=rust/", want: false},
+		{expression: "tags~=web", want: true},
+		{expression: "tags~=we", want: false},
+		{expression: "header_level<=2", want: true},
+		{expression: "header_level>=3", want: false},
+		{expression: "language=rust AND header_level>=2 AND tags~=cli", want: true},
+		{expression: "language=rust AND tags~=api", want: false},
+		// Missing keys only satisfy !=
+		{expression: "snippet=1", want: false},
+		{expression: "snippet!=1", want: true},
+		{expression: "snippet^=", want: false},
+		{expression: "snippet<=10", want: false},
+		{expression: "language=rust AND snippet!=1", want: true},
+		// A value that is not a number
+		{expression: "source>=1", want: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.expression, func(t *testing.T) {
+			filter, err := ParseFilter(tc.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filter.Match(VectorRecord{Metadata: metadata}); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+			// A record without metadata has no keys: only the != conditions match
+			want := true
+			for _, condition := range filter {
+				want = want && condition.Operator == OperatorNotEquals
+			}
+			if got := filter.Match(VectorRecord{}); got != want {
+				t.Errorf("without metadata: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestExtractMetadata(t *testing.T) {
+	cases := []struct {
+		name  string
+		chunk string
+		want  map[string]string
+	}{
+		{name: "plain text", chunk: "Hello world", want: map[string]string{}},
+		{
+			name:  "header and code blocks",
+			chunk: "intro\n## Hello\n```golang\nfunc main() {}\n```\n# Other\n```rust\nfn main() {}\n```",
+			want:  map[string]string{MetadataLanguage: "go", MetadataHeaderLevel: "2"},
+		},
+		{name: "tilde fence", chunk: "~~~ Py\nprint()\n~~~", want: map[string]string{MetadataLanguage: "python"}},
+		{name: "not a header", chunk: "#hashtag\n    # indented code", want: map[string]string{}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ExtractMetadata(tc.chunk); !maps.Equal(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBackfillMetadata(t *testing.T) {
+	for _, tc := range testStores {
+		t.Run(tc.name, func(t *testing.T) {
+			store := tc.newStore()
+			defer closeStore(t, store)
+			withMetadata := testRecord(1)
+			withMetadata.Prompt = "# Title\n```go\n```"
+			withoutMetadata := testRecord(2)
+			withoutMetadata.Prompt = "## Title\n```js\n```"
+			withoutMetadata.Metadata = nil
+			for _, record := range []VectorRecord{withMetadata, withoutMetadata} {
+				if _, err := store.Save(record); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			updated, err := BackfillMetadata(store)
+			if err != nil || updated != 1 {
+				t.Fatalf("got %d updated records (%v), want 1", updated, err)
+			}
+			record, err := store.GetByID(withoutMetadata.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := map[string]string{MetadataLanguage: "javascript", MetadataHeaderLevel: "2"}; !maps.Equal(record.Metadata, want) {
+				t.Errorf("got %v, want %v", record.Metadata, want)
+			}
+			// The existing metadata is kept
+			if record, _ := store.GetByID(withMetadata.Id); !maps.Equal(record.Metadata, withMetadata.Metadata) {
+				t.Errorf("got %v, want %v", record.Metadata, withMetadata.Metadata)
+			}
+
+			// Every record has metadata now
+			if updated, err := BackfillMetadata(store); err != nil || updated != 0 {
+				t.Errorf("got %d updated records (%v) the second time, want 0", updated, err)
+			}
+		})
+	}
+}
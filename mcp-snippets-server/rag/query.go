@@ -0,0 +1,116 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/openai/openai-go/v2"
+)
+
+// Query expansion modes
+const (
+	QueryExpansionNone       = "none"        // search with the question only
+	QueryExpansionMultiQuery = "multi-query" // search with the question and paraphrases of it
+	QueryExpansionHyDE       = "hyde"        // search with the question and a hypothetical answer (Hypothetical Document Embeddings)
+)
+
+const paraphrasesSystemPrompt = `You rewrite questions into search queries for a documentation search engine.
+Write %d different search queries for the question: use synonyms, the technical terms
+and the names of the functions or tools it is probably about. One query per line,
+without numbering, quotes or explanation.`
+
+const hypotheticalAnswerSystemPrompt = `You write documentation.
+Write a short passage (3 to 5 sentences) of technical documentation that answers the question,
+as it would appear in the documentation. If you do not know the answer, write a plausible one:
+it is only used to search the documentation. Do not add any introduction.`
+
+// listMarker matches the numbering or the bullet that a chat model may add before a query anyway.
+var listMarker = regexp.MustCompile(`^\s*(?:[-*•]|\d+[.)])\s*`)
+
+// QueryRewriter asks a chat model for alternative versions of a question, to search with more than its few words.
+type QueryRewriter struct {
+	Client      openai.Client
+	Model       string
+	Paraphrases int // number of paraphrases of the multi-query mode
+}
+
+// SubQuery is a query searched for a question: the question itself or one of its rewrites.
+type SubQuery struct {
+	Kind  string // "question", "paraphrase" or "hypothetical answer"
+	Query string
+}
+
+// Expand returns the sub-queries of the question for the mode (see QueryExpansionMultiQuery and QueryExpansionHyDE).
+// The question is always the first sub-query.
+func (qr *QueryRewriter) Expand(ctx context.Context, mode string, question string) ([]SubQuery, error) {
+	subQueries := []SubQuery{{Kind: "question", Query: question}}
+	switch mode {
+	case QueryExpansionNone, "":
+		return subQueries, nil
+
+	case QueryExpansionMultiQuery:
+		content, err := qr.complete(ctx, fmt.Sprintf(paraphrasesSystemPrompt, max(qr.Paraphrases, 1)), question)
+		if err != nil {
+			return subQueries, err
+		}
+		seen := map[string]bool{strings.ToLower(question): true}
+		for _, line := range strings.Split(content, "\n") {
+			paraphrase := strings.Trim(listMarker.ReplaceAllString(line, ""), " \t\"'")
+			if paraphrase == "" || seen[strings.ToLower(paraphrase)] {
+				continue
+			}
+			seen[strings.ToLower(paraphrase)] = true
+			subQueries = append(subQueries, SubQuery{Kind: "paraphrase", Query: paraphrase})
+			if len(subQueries) > qr.Paraphrases {
+				break
+			}
+		}
+		return subQueries, nil
+
+	case QueryExpansionHyDE:
+		answer, err := qr.complete(ctx, hypotheticalAnswerSystemPrompt, question)
+		if err != nil {
+			return subQueries, err
+		}
+		if answer = strings.TrimSpace(answer); answer != "" {
+			subQueries = append(subQueries, SubQuery{Kind: "hypothetical answer", Query: answer})
+		}
+		return subQueries, nil
+	}
+	return subQueries, fmt.Errorf("unknown query expansion mode %q (expected %s, %s or %s)", mode, QueryExpansionNone, QueryExpansionMultiQuery, QueryExpansionHyDE)
+}
+
+func (qr *QueryRewriter) complete(ctx context.Context, systemPrompt string, question string) (string, error) {
+	completion, err := qr.Client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
+		Model: qr.Model,
+		Messages: []openai.ChatCompletionMessageParamUnion{
+			openai.SystemMessage(systemPrompt),
+			openai.UserMessage(question),
+		},
+		Temperature: openai.Float(0.3),
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(completion.Choices) == 0 {
+		return "", fmt.Errorf("the chat model returned no answer")
+	}
+	return completion.Choices[0].Message.Content, nil
+}
+
+// MergeSubQueryResults merges the results of the sub-queries (one ranking per sub-query, in the order of the sub-queries)
+// with the reciprocal rank fusion: the records found by several sub-queries come first.
+// It returns the (at most max) best records, without duplicates, and for each record ID the indexes of the sub-queries that found it.
+func MergeSubQueryResults(results [][]VectorRecord, max int) ([]VectorRecord, map[string][]int) {
+	hits := make(map[string][]int)
+	weights := make([]float64, len(results))
+	for idx, records := range results {
+		weights[idx] = 1
+		for _, record := range records {
+			hits[record.Id] = append(hits[record.Id], idx)
+		}
+	}
+	return fuseRankings(results, weights, max), hits
+}
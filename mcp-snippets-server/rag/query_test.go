@@ -0,0 +1,175 @@
+package rag
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/openai/openai-go/v2"
+	"github.com/openai/openai-go/v2/option"
+)
+
+// newFakeChatClient returns a client of a chat completion server that answers with the answer function
+// (called with the system and user messages); an empty answer is a completion without choices.
+func newFakeChatClient(t *testing.T, answer func(system, user string) string) openai.Client {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Messages []struct {
+				Role    string `json:"role"`
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Messages) != 2 {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		choices := []any{}
+		if content := answer(request.Messages[0].Content, request.Messages[1].Content); content != "" {
+			choices = append(choices, map[string]any{
+				"index":         0,
+				"finish_reason": "stop",
+				"message":       map[string]any{"role": "assistant", "content": content},
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"id": "test", "object": "chat.completion", "model": "test", "choices": choices})
+	}))
+	t.Cleanup(server.Close)
+	return openai.NewClient(option.WithBaseURL(server.URL), option.WithAPIKey(""), option.WithMaxRetries(0))
+}
+
+func TestExpand(t *testing.T) {
+	const question = "How do I handle errors in Go?"
+	cases := []struct {
+		name        string
+		mode        string
+		paraphrases int
+		answer      string
+		want        []SubQuery
+	}{
+		{name: "no expansion", mode: QueryExpansionNone, answer: "unused", want: []SubQuery{{"question", question}}},
+		{name: "default mode", mode: "", answer: "unused", want: []SubQuery{{"question", question}}},
+		{
+			name:        "paraphrases",
+			mode:        QueryExpansionMultiQuery,
+			paraphrases: 3,
+			// Numbering, bullets, quotes, empty lines and the question itself are removed
+			answer: "1. go error handling\n- Go Error Handling\n\n* \"wrap errors with %w\"\n2) errors.Is\nhow do i handle errors in go?\nextra query",
+			want: []SubQuery{
+				{"question", question},
+				{"paraphrase", "go error handling"},
+				{"paraphrase", "wrap errors with %w"},
+				{"paraphrase", "errors.Is"},
+			},
+		},
+		{
+			name:   "at least one paraphrase",
+			mode:   QueryExpansionMultiQuery,
+			answer: "go error handling\nerrors.Is",
+			want:   []SubQuery{{"question", question}, {"paraphrase", "go error handling"}},
+		},
+		{
+			name:   "hypothetical answer",
+			mode:   QueryExpansionHyDE,
+			answer: "\n  Return an error value and check it with if err != nil.  \n",
+			want:   []SubQuery{{"question", question}, {"hypothetical answer", "Return an error value and check it with if err != nil."}},
+		},
+		{name: "blank hypothetical answer", mode: QueryExpansionHyDE, answer: " \n ", want: []SubQuery{{"question", question}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeChatClient(t, func(system, user string) string {
+				if user != question {
+					t.Errorf("got question %q, want %q", user, question)
+				}
+				return tc.answer
+			})
+			rewriter := &QueryRewriter{Client: client, Model: "test", Paraphrases: tc.paraphrases}
+			subQueries, err := rewriter.Expand(context.Background(), tc.mode, question)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(subQueries, tc.want) {
+				t.Errorf("got %q, want %q", subQueries, tc.want)
+			}
+		})
+	}
+}
+
+// When the chat model fails, the question is still searched.
+func TestExpandErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		mode    string
+		wantErr string
+	}{
+		{name: "unknown mode", mode: "paraphrase", wantErr: `unknown query expansion mode "paraphrase"`},
+		{name: "no paraphrases", mode: QueryExpansionMultiQuery, wantErr: "no answer"},
+		{name: "no hypothetical answer", mode: QueryExpansionHyDE, wantErr: "no answer"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newFakeChatClient(t, func(system, user string) string { return "" })
+			rewriter := &QueryRewriter{Client: client, Model: "test", Paraphrases: 3}
+			subQueries, err := rewriter.Expand(context.Background(), tc.mode, "question")
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("got %v, want an error containing %q", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(subQueries, []SubQuery{{"question", "question"}}) {
+				t.Errorf("got %q, want the question only", subQueries)
+			}
+		})
+	}
+}
+
+func TestMergeSubQueryResults(t *testing.T) {
+	a, b, c := VectorRecord{Id: "a"}, VectorRecord{Id: "b"}, VectorRecord{Id: "c"}
+	cases := []struct {
+		name     string
+		results  [][]VectorRecord
+		max      int
+		wantIds  []string
+		wantHits map[string][]int
+	}{
+		{
+			// b is found by both sub-queries
+			name:     "found twice first",
+			results:  [][]VectorRecord{{a, b}, {b, c}, {}},
+			max:      3,
+			wantIds:  []string{"b", "a", "c"},
+			wantHits: map[string][]int{"a": {0}, "b": {0, 1}, "c": {1}},
+		},
+		{
+			name:     "max",
+			results:  [][]VectorRecord{{a, b}, {b, c}},
+			max:      2,
+			wantIds:  []string{"b", "a"},
+			wantHits: map[string][]int{"a": {0}, "b": {0, 1}, "c": {1}},
+		},
+		{name: "no results", results: [][]VectorRecord{{}, {}}, max: 3, wantIds: []string{}, wantHits: map[string][]int{}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			records, hits := MergeSubQueryResults(tc.results, tc.max)
+			if got := recordIds(records); !slices.Equal(got, tc.wantIds) {
+				t.Errorf("got %v, want %v", got, tc.wantIds)
+			}
+			if !reflect.DeepEqual(hits, tc.wantHits) {
+				t.Errorf("got hits %v, want %v", hits, tc.wantHits)
+			}
+			if len(records) > 0 && records[0].Id == "b" {
+				// Reciprocal rank fusion with k = 60: rank 2 of the first sub-query and rank 1 of the second
+				if want := 1.0/62 + 1.0/61; math.Abs(records[0].Score-want) > 1e-12 {
+					t.Errorf("got score %f, want %f", records[0].Score, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package rag
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Store file formats
+const (
+	StoreFormatJSON    = "json"        // indented JSON, float64 embeddings (debugging, see ExportJSON)
+	StoreFormatFloat32 = "binary"      // binary, float32 embeddings
+	StoreFormatInt8    = "binary-int8" // binary, int8 scalar quantized embeddings (4 times smaller than float32)
+)
+
+// binaryStoreMagic starts every binary store file.
+var binaryStoreMagic = []byte("RAGV")
+
+// binaryStoreVersion is the version of the binary layout written by encodeBinaryStore.
+const binaryStoreVersion uint16 = 1
+
+const (
+	binaryEncodingFloat32 uint8 = 1
+	binaryEncodingInt8    uint8 = 2
+)
+
+// Binary store layout (little endian):
+//
+//	magic "RAGV" | version uint16 | encoding uint8 | model length uint16 | model | dimension uint32 | count uint32
+//	then count times:
+//	  record length uint32 | record (JSON of the record without its embedding)
+//	  float32 encoding: dimension * float32
+//	  int8 encoding:    minimum float32 | scale float32 | dimension * uint8
+//	  (value = minimum + scale * byte)
+
+// isBinaryStore returns true if the content is a binary store file.
+func isBinaryStore(content []byte) bool {
+	return bytes.HasPrefix(content, binaryStoreMagic)
+}
+
+// encodeBinaryStore writes the records (sorted by ID, for reproducible files) in the binary format.
+// Every record must have the given dimension.
+func encodeBinaryStore(writer io.Writer, model string, dimension int, records map[string]VectorRecord, format string) error {
+	encoding := binaryEncodingFloat32
+	if format == StoreFormatInt8 {
+		encoding = binaryEncodingInt8
+	}
+
+	ids := make([]string, 0, len(records))
+	for id, record := range records {
+		ids = append(ids, id)
+		if len(record.Embedding) != dimension {
+			return fmt.Errorf("vector record %s has %d dimensions, expected %d", id, len(record.Embedding), dimension)
+		}
+	}
+	sort.Strings(ids)
+	if len(model) > math.MaxUint16 {
+		return errors.New("model name too long")
+	}
+
+	buffered := bufio.NewWriter(writer)
+	write := func(data any) error {
+		return binary.Write(buffered, binary.LittleEndian, data)
+	}
+
+	buffered.Write(binaryStoreMagic)
+	write(binaryStoreVersion)
+	write(encoding)
+	write(uint16(len(model)))
+	buffered.WriteString(model)
+	write(uint32(dimension))
+	if err := write(uint32(len(ids))); err != nil {
+		return err
+	}
+
+	vector32 := make([]float32, dimension)
+	quantized := make([]uint8, dimension)
+	for _, id := range ids {
+		record := records[id]
+		embedding := record.Embedding
+		record.Embedding = nil
+		record.CosineSimilarity = 0
+		recordJSON, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		write(uint32(len(recordJSON)))
+		buffered.Write(recordJSON)
+
+		switch encoding {
+		case binaryEncodingFloat32:
+			for i, value := range embedding {
+				vector32[i] = float32(value)
+			}
+			err = write(vector32)
+		case binaryEncodingInt8:
+			minimum, scale := quantize(embedding, quantized)
+			write(minimum)
+			write(scale)
+			err = write(quantized)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
+
+// decodeBinaryStore reads a binary store file and returns its model name, its dimension and its records.
+func decodeBinaryStore(content []byte) (string, int, map[string]VectorRecord, error) {
+	reader := bytes.NewReader(content)
+	read := func(data any) error {
+		return binary.Read(reader, binary.LittleEndian, data)
+	}
+
+	magic := make([]byte, len(binaryStoreMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || !bytes.Equal(magic, binaryStoreMagic) {
+		return "", 0, nil, errors.New("not a binary vector store file")
+	}
+	var version uint16
+	var encoding uint8
+	var modelLength uint16
+	if err := errors.Join(read(&version), read(&encoding), read(&modelLength)); err != nil {
+		return "", 0, nil, err
+	}
+	if version > binaryStoreVersion {
+		return "", 0, nil, fmt.Errorf("unsupported binary vector store version %d", version)
+	}
+	if encoding != binaryEncodingFloat32 && encoding != binaryEncodingInt8 {
+		return "", 0, nil, fmt.Errorf("unsupported binary vector store encoding %d", encoding)
+	}
+	model := make([]byte, modelLength)
+	if _, err := io.ReadFull(reader, model); err != nil {
+		return "", 0, nil, err
+	}
+	var dimension, count uint32
+	if err := errors.Join(read(&dimension), read(&count)); err != nil {
+		return "", 0, nil, err
+	}
+	// A corrupt header must not allocate more than the file holds: every record takes at least
+	// its length (4 bytes) and its vector (4 bytes, or 1 byte and 8 for the quantization, per dimension)
+	vectorSize := 4 * int64(dimension)
+	if encoding == binaryEncodingInt8 {
+		vectorSize = 8 + int64(dimension)
+	}
+	if count > 0 && (vectorSize > int64(reader.Len()) || int64(count)*(4+vectorSize) > int64(reader.Len())) {
+		return "", 0, nil, fmt.Errorf("%w: corrupt binary vector store header (dimension %d, %d records, %d bytes)", io.ErrUnexpectedEOF, dimension, count, reader.Len())
+	}
+
+	records := make(map[string]VectorRecord, count)
+	vector32 := make([]float32, dimension)
+	quantized := make([]uint8, dimension)
+	for range count {
+		var recordLength uint32
+		if err := read(&recordLength); err != nil {
+			return "", 0, nil, err
+		}
+		if int64(recordLength) > int64(reader.Len()) {
+			return "", 0, nil, io.ErrUnexpectedEOF
+		}
+		recordJSON := make([]byte, recordLength)
+		if _, err := io.ReadFull(reader, recordJSON); err != nil {
+			return "", 0, nil, err
+		}
+		var record VectorRecord
+		if err := json.Unmarshal(recordJSON, &record); err != nil {
+			return "", 0, nil, err
+		}
+
+		record.Embedding = make([]float64, dimension)
+		switch encoding {
+		case binaryEncodingFloat32:
+			if err := read(vector32); err != nil {
+				return "", 0, nil, err
+			}
+			for i, value := range vector32 {
+				record.Embedding[i] = float64(value)
+			}
+		case binaryEncodingInt8:
+			var minimum, scale float32
+			if err := errors.Join(read(&minimum), read(&scale), read(quantized)); err != nil {
+				return "", 0, nil, err
+			}
+			for i, value := range quantized {
+				record.Embedding[i] = float64(minimum) + float64(scale)*float64(value)
+			}
+		}
+		records[record.Id] = record
+	}
+	return string(model), int(dimension), records, nil
+}
+
+// quantize maps the values of the vector on 256 levels between its minimum and its maximum.
+// It fills quantized and returns the minimum and the scale (value = minimum + scale * byte).
+func quantize(vector []float64, quantized []uint8) (float32, float32) {
+	if len(vector) == 0 {
+		return 0, 0
+	}
+	minimum, maximum := vector[0], vector[0]
+	for _, value := range vector {
+		minimum = math.Min(minimum, value)
+		maximum = math.Max(maximum, value)
+	}
+	scale := (maximum - minimum) / 255
+	for i, value := range vector {
+		if scale == 0 {
+			quantized[i] = 0
+			continue
+		}
+		quantized[i] = uint8(math.Round((value - minimum) / scale))
+	}
+	return float32(minimum), float32(scale)
+}
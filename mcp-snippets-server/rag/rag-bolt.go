@@ -0,0 +1,287 @@
+package rag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltRecordsBucket = []byte("records")
+	boltMetaBucket    = []byte("meta")
+	boltModelKey      = []byte("model")
+	boltDimensionKey  = []byte("dimension")
+)
+
+// BoltVectorStore is a MemoryVectorStore persisted record by record in a bbolt database (an embedded key/value store):
+// Persist only writes the records saved or deleted since the last Persist, in one transaction,
+// and Load reads the records one by one instead of parsing a whole store file.
+// The searches still run on the records in memory.
+//
+// Database layout: a "records" bucket (record ID -> record, see encodeBoltRecord)
+// and a "meta" bucket with the model and the dimension of the embeddings.
+type BoltVectorStore struct {
+	MemoryVectorStore
+	db      *bolt.DB        // protected by the mutex of the MemoryVectorStore, like the fields below
+	changed map[string]bool // IDs of the records to write (or to delete when they are not in Records anymore)
+	reset   bool            // remove all the records of the database at the next Persist
+}
+
+// NewBoltVectorStore creates an empty store that expects embeddings of the model.
+// The database is opened by Load (or by the first Persist).
+func NewBoltVectorStore(model string) *BoltVectorStore {
+	return &BoltVectorStore{
+		MemoryVectorStore: MemoryVectorStore{
+			Model:   model,
+			Records: make(map[string]VectorRecord),
+		},
+		changed: make(map[string]bool),
+	}
+}
+
+// Save saves the vector record in memory; it is written to the database by the next Persist.
+func (bvs *BoltVectorStore) Save(vectorRecord VectorRecord) (VectorRecord, error) {
+	bvs.mutex.Lock()
+	defer bvs.mutex.Unlock()
+	vectorRecord, err := bvs.save(vectorRecord)
+	if err != nil {
+		return vectorRecord, err
+	}
+	bvs.changed[vectorRecord.Id] = true
+	return vectorRecord, nil
+}
+
+// Delete removes the vector record from memory; it is removed from the database by the next Persist.
+func (bvs *BoltVectorStore) Delete(id string) error {
+	bvs.mutex.Lock()
+	defer bvs.mutex.Unlock()
+	if err := bvs.delete(id); err != nil {
+		return err
+	}
+	bvs.changed[id] = true
+	return nil
+}
+
+// Load opens the database and reads its records.
+// An empty (or new) database returns an error for which os.IsNotExist is true, like a missing store file.
+// The model is checked like MemoryVectorStore.Load does (see ModelMismatchError).
+// Load is called once, before the records are saved.
+func (bvs *BoltVectorStore) Load(storeFilePath string) error {
+	bvs.mutex.Lock()
+	defer bvs.mutex.Unlock()
+	if err := bvs.open(storeFilePath); err != nil {
+		return err
+	}
+
+	model := ""
+	dimension := 0
+	records := make(map[string]VectorRecord)
+	err := bvs.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(boltMetaBucket)
+		model = string(meta.Get(boltModelKey))
+		if value := meta.Get(boltDimensionKey); len(value) == 4 {
+			dimension = int(binary.LittleEndian.Uint32(value))
+		}
+		return tx.Bucket(boltRecordsBucket).ForEach(func(key, value []byte) error {
+			record, err := decodeBoltRecord(value, dimension)
+			if err != nil {
+				return fmt.Errorf("vector record %s: %w", key, err)
+			}
+			records[record.Id] = record
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return &os.PathError{Op: "load", Path: storeFilePath, Err: os.ErrNotExist}
+	}
+
+	switch {
+	case bvs.Model != "" && model != "" && model != bvs.Model:
+		// The records are not loaded; if the store is re-created, the next Persist replaces them
+		bvs.reset = true
+		return &ModelMismatchError{StoredModel: model, StoredDimension: dimension, ExpectedModel: bvs.Model}
+	case bvs.Model == "":
+		bvs.Model = model
+	}
+	bvs.Dimension = dimension
+	bvs.Records = records
+	bvs.changed = make(map[string]bool)
+	bvs.reset = false
+	return nil
+}
+
+// ImportStoreFile adds the records of a store file written by MemoryVectorStore.Persist (binary or JSON),
+// to move a store to the database. They are written by the next Persist.
+func (bvs *BoltVectorStore) ImportStoreFile(storeFilePath string) error {
+	loaded, _, err := readStoreFile(storeFilePath)
+	if err != nil {
+		return err
+	}
+
+	bvs.mutex.Lock()
+	defer bvs.mutex.Unlock()
+	if bvs.Model != "" && loaded.Model != "" && loaded.Model != bvs.Model {
+		return &ModelMismatchError{StoredModel: loaded.Model, StoredDimension: loaded.Dimension, ExpectedModel: bvs.Model}
+	}
+	for _, record := range loaded.Records {
+		if _, err := bvs.save(record); err != nil {
+			return err
+		}
+		bvs.changed[record.Id] = true
+	}
+	return nil
+}
+
+// Persist writes the records saved and deleted since the last Persist (and the model and the dimension) to the database.
+func (bvs *BoltVectorStore) Persist(storeFilePath string) error {
+	bvs.mutex.Lock()
+	defer bvs.mutex.Unlock()
+	if err := bvs.open(storeFilePath); err != nil {
+		return err
+	}
+	err := bvs.db.Update(func(tx *bolt.Tx) error {
+		if bvs.reset {
+			if err := tx.DeleteBucket(boltRecordsBucket); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(boltRecordsBucket); err != nil {
+				return err
+			}
+		}
+
+		meta := tx.Bucket(boltMetaBucket)
+		dimension := make([]byte, 4)
+		binary.LittleEndian.PutUint32(dimension, uint32(bvs.Dimension))
+		if err := errors.Join(meta.Put(boltModelKey, []byte(bvs.Model)), meta.Put(boltDimensionKey, dimension)); err != nil {
+			return err
+		}
+
+		records := tx.Bucket(boltRecordsBucket)
+		for id := range bvs.changed {
+			record, exists := bvs.Records[id]
+			if !exists {
+				if err := records.Delete([]byte(id)); err != nil {
+					return err
+				}
+				continue
+			}
+			value, err := encodeBoltRecord(record)
+			if err != nil {
+				return err
+			}
+			if err := records.Put([]byte(id), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	bvs.changed = make(map[string]bool)
+	bvs.reset = false
+	return nil
+}
+
+// ResetMemory removes all the records; they are removed from the database by the next Persist.
+func (bvs *BoltVectorStore) ResetMemory() error {
+	bvs.mutex.Lock()
+	defer bvs.mutex.Unlock()
+	bvs.changed = make(map[string]bool)
+	bvs.reset = true
+	bvs.resetMemory()
+	return nil
+}
+
+// Close closes the database.
+func (bvs *BoltVectorStore) Close() error {
+	bvs.mutex.Lock()
+	defer bvs.mutex.Unlock()
+	if bvs.db == nil {
+		return nil
+	}
+	err := bvs.db.Close()
+	bvs.db = nil
+	return err
+}
+
+// open opens (or creates) the database and its buckets, once (the caller holds the mutex for writing).
+func (bvs *BoltVectorStore) open(storeFilePath string) error {
+	if bvs.db != nil {
+		if bvs.db.Path() != storeFilePath {
+			return fmt.Errorf("the vector store database %s is already open", bvs.db.Path())
+		}
+		return nil
+	}
+	// The timeout avoids waiting forever for a database locked by another server
+	db, err := bolt.Open(storeFilePath, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("opening the vector store database %s: %w", storeFilePath, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, errRecords := tx.CreateBucketIfNotExists(boltRecordsBucket)
+		_, errMeta := tx.CreateBucketIfNotExists(boltMetaBucket)
+		return errors.Join(errRecords, errMeta)
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	log.Println("🗄️ Vector store database:", storeFilePath)
+	bvs.db = db
+	return nil
+}
+
+// Record value layout (little endian):
+//
+//	record length uint32 | record (JSON of the record without its embedding) | dimension * float32
+
+func encodeBoltRecord(record VectorRecord) ([]byte, error) {
+	embedding := record.Embedding
+	record.Embedding = nil
+	record.CosineSimilarity = 0
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, 4+len(recordJSON)+4*len(embedding))
+	binary.LittleEndian.PutUint32(value, uint32(len(recordJSON)))
+	copy(value[4:], recordJSON)
+	offset := 4 + len(recordJSON)
+	for idx, number := range embedding {
+		binary.LittleEndian.PutUint32(value[offset+4*idx:], math.Float32bits(float32(number)))
+	}
+	return value, nil
+}
+
+func decodeBoltRecord(value []byte, dimension int) (VectorRecord, error) {
+	var record VectorRecord
+	if len(value) < 4 {
+		return record, io.ErrUnexpectedEOF
+	}
+	recordLength := int(binary.LittleEndian.Uint32(value))
+	if len(value) != 4+recordLength+4*dimension {
+		return record, fmt.Errorf("%w: %d bytes, expected %d", ErrDimensionMismatch, len(value), 4+recordLength+4*dimension)
+	}
+	if err := json.NewDecoder(bytes.NewReader(value[4 : 4+recordLength])).Decode(&record); err != nil {
+		return record, err
+	}
+	record.Embedding = make([]float64, dimension)
+	offset := 4 + recordLength
+	for idx := range record.Embedding {
+		record.Embedding[idx] = float64(math.Float32frombits(binary.LittleEndian.Uint32(value[offset+4*idx:])))
+	}
+	return record, nil
+}
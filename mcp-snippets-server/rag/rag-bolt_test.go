@@ -0,0 +1,251 @@
+package rag
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltRecordIds returns the IDs of the records written in the database, sorted.
+func boltRecordIds(t *testing.T, store *BoltVectorStore) []string {
+	t.Helper()
+	ids := []string{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRecordsBucket).ForEach(func(key, _ []byte) error {
+			ids = append(ids, string(key))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+// openBoltTestStore loads the database of the path in a new store, closed at the end of the test.
+func openBoltTestStore(t *testing.T, storeFilePath string, model string) (*BoltVectorStore, error) {
+	t.Helper()
+	store := NewBoltVectorStore(model)
+	t.Cleanup(func() { closeStore(t, store) })
+	return store, store.Load(storeFilePath)
+}
+
+func TestBoltEmptyDatabaseDoesNotExist(t *testing.T) {
+	storeFilePath := filepath.Join(t.TempDir(), "store.db")
+	store, err := openBoltTestStore(t, storeFilePath, "model")
+	if !os.IsNotExist(err) {
+		t.Fatalf("got %v, want an error for which os.IsNotExist is true", err)
+	}
+	// The database is created: the store can be indexed and persisted
+	if _, err := store.Save(testRecord(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Persist(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Persist(filepath.Join(t.TempDir(), "other.db")); err == nil {
+		t.Error("got no error persisting to another database")
+	}
+}
+
+// Persist only writes the records saved or deleted since the previous Persist.
+func TestBoltIncrementalPersist(t *testing.T) {
+	storeFilePath := filepath.Join(t.TempDir(), "store.db")
+	store := NewBoltVectorStore("model")
+	defer closeStore(t, store)
+	for idx := range 3 {
+		if _, err := store.Save(testRecord(idx)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Persist(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.changed) != 0 {
+		t.Fatalf("got %d changed records after Persist, want 0", len(store.changed))
+	}
+
+	// A marker written behind the back of the store: it stays as long as record-000 does not change
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRecordsBucket).Put([]byte(testRecord(0).Id), []byte("marker"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete(testRecord(1).Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Save(testRecord(3)); err != nil {
+		t.Fatal(err)
+	}
+	updated := testRecord(2)
+	updated.Prompt = "updated"
+	if _, err := store.Save(updated); err != nil {
+		t.Fatal(err)
+	}
+	changed := []string{}
+	for id := range store.changed {
+		changed = append(changed, id)
+	}
+	slices.Sort(changed)
+	if want := []string{"record-001", "record-002", "record-003"}; !slices.Equal(changed, want) {
+		t.Fatalf("got changed records %v, want %v", changed, want)
+	}
+	if err := store.Persist(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := boltRecordIds(t, store), []string{"record-000", "record-002", "record-003"}; !slices.Equal(got, want) {
+		t.Errorf("got %v in the database, want %v", got, want)
+	}
+	err = store.db.View(func(tx *bolt.Tx) error {
+		records := tx.Bucket(boltRecordsBucket)
+		if value := records.Get([]byte(testRecord(0).Id)); string(value) != "marker" {
+			t.Errorf("the unchanged record-000 was written again")
+		}
+		record, err := decodeBoltRecord(records.Get([]byte(updated.Id)), 32)
+		if err != nil || record.Prompt != "updated" {
+			t.Errorf("got %+v (%v), want the updated record", record, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltPersistAndReopen(t *testing.T) {
+	storeFilePath := filepath.Join(t.TempDir(), "store.db")
+	store := NewBoltVectorStore("model")
+	for idx := range 5 {
+		if _, err := store.Save(testRecord(idx)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete(testRecord(2).Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Persist(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+	closeStore(t, store)
+
+	reopened, err := openBoltTestStore(t, storeFilePath, "model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Model != "model" || reopened.Dimension != 32 || reopened.Count() != 4 {
+		t.Fatalf("got model %q, dimension %d and %d records", reopened.Model, reopened.Dimension, reopened.Count())
+	}
+	if _, err := reopened.GetByID(testRecord(2).Id); err == nil {
+		t.Error("the deleted record is loaded")
+	}
+	for _, idx := range []int{0, 1, 3, 4} {
+		want := testRecord(idx)
+		got, err := reopened.GetByID(want.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Prompt != want.Prompt || got.Metadata["group"] != want.Metadata["group"] {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+		// The embeddings are stored as float32
+		if similarity := cosineSimilarity(got.Embedding, want.Embedding); similarity < 0.9999 {
+			t.Errorf("record %s: the loaded vector has a cosine similarity of %f with the saved one", want.Id, similarity)
+		}
+	}
+}
+
+func TestBoltResetMemoryAndPersist(t *testing.T) {
+	storeFilePath := filepath.Join(t.TempDir(), "store.db")
+	store := NewBoltVectorStore("model")
+	defer closeStore(t, store)
+	for idx := range 3 {
+		if _, err := store.Save(testRecord(idx)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Persist(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-indexing: the records of the database are replaced by the new ones
+	if err := store.ResetMemory(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Save(testRecord(10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Persist(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if got := boltRecordIds(t, store); !slices.Equal(got, []string{"record-010"}) {
+		t.Errorf("got %v in the database, want [record-010]", got)
+	}
+	if store.reset {
+		t.Error("the reset is still pending after Persist")
+	}
+
+	// Without new records, the database is emptied
+	if err := store.ResetMemory(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Persist(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+	closeStore(t, store)
+	if _, err := openBoltTestStore(t, storeFilePath, "model"); !os.IsNotExist(err) {
+		t.Errorf("got %v, want an empty database", err)
+	}
+}
+
+// A database of another model is not loaded, and the next Persist replaces its records.
+func TestBoltModelMismatch(t *testing.T) {
+	storeFilePath := filepath.Join(t.TempDir(), "store.db")
+	store := NewBoltVectorStore("model-a")
+	for idx := range 3 {
+		if _, err := store.Save(testRecord(idx)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Persist(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+	closeStore(t, store)
+
+	other, err := openBoltTestStore(t, storeFilePath, "model-b")
+	var modelMismatch *ModelMismatchError
+	if !errors.As(err, &modelMismatch) || modelMismatch.StoredModel != "model-a" || modelMismatch.StoredDimension != 32 {
+		t.Fatalf("got %v, want a mismatch with model-a", err)
+	}
+	if other.Count() != 0 {
+		t.Fatalf("got %d records loaded, want none", other.Count())
+	}
+	if _, err := other.Save(testRecord(5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Persist(storeFilePath); err != nil {
+		t.Fatal(err)
+	}
+	if got := boltRecordIds(t, other); !slices.Equal(got, []string{"record-005"}) {
+		t.Errorf("got %v in the database, want [record-005]", got)
+	}
+}
+
+func TestDecodeBoltRecordChecksTheDimension(t *testing.T) {
+	value, err := encodeBoltRecord(testRecord(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeBoltRecord(value, 16); !errors.Is(err, ErrDimensionMismatch) {
+		t.Errorf("got %v, want ErrDimensionMismatch", err)
+	}
+	if _, err := decodeBoltRecord(value[:2], 32); err == nil {
+		t.Error("got no error for a truncated value")
+	}
+}
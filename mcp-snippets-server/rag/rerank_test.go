@@ -0,0 +1,170 @@
+package rag
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fixedReranker returns its scores, whatever the records.
+type fixedReranker []float64
+
+func (fr fixedReranker) Score(ctx context.Context, question string, records []VectorRecord) ([]float64, error) {
+	return fr, nil
+}
+
+func TestRerank(t *testing.T) {
+	records := []VectorRecord{
+		{Id: "a", CosineSimilarity: 0.9},
+		{Id: "b", CosineSimilarity: 0.8},
+		{Id: "c", CosineSimilarity: 0.7},
+	}
+	cases := []struct {
+		name    string
+		records []VectorRecord
+		scores  fixedReranker
+		topK    int
+		wantIds []string
+		wantErr bool
+	}{
+		{name: "sorted by score", records: records, scores: fixedReranker{0.1, 0.9, 0.5}, topK: 3, wantIds: []string{"b", "c", "a"}},
+		{name: "top k", records: records, scores: fixedReranker{0.1, 0.9, 0.5}, topK: 2, wantIds: []string{"b", "c"}},
+		{name: "ties keep the order", records: records, scores: fixedReranker{0.5, 0.5, 0.9}, topK: 3, wantIds: []string{"c", "a", "b"}},
+		{name: "no records", records: []VectorRecord{}, topK: 3, wantIds: []string{}},
+		{name: "missing scores", records: records, scores: fixedReranker{0.1}, topK: 3, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			reranked, err := Rerank(context.Background(), tc.scores, "question", tc.records, tc.topK)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := recordIds(reranked); !slices.Equal(got, tc.wantIds) {
+				t.Errorf("got %v, want %v", got, tc.wantIds)
+			}
+			for _, record := range reranked {
+				idx := slices.IndexFunc(records, func(r VectorRecord) bool { return r.Id == record.Id })
+				if record.Score != tc.scores[idx] || record.CosineSimilarity != records[idx].CosineSimilarity {
+					t.Errorf("got %+v, want the score %f and the similarity %f", record, tc.scores[idx], records[idx].CosineSimilarity)
+				}
+			}
+		})
+	}
+	if records[0].Score != 0 {
+		t.Error("the records of the caller were modified")
+	}
+}
+
+func TestEndpointRerankerScore(t *testing.T) {
+	records := []VectorRecord{{Id: "a", Prompt: "first"}, {Id: "b", Prompt: "second"}}
+	cases := []struct {
+		name        string
+		format      string
+		status      int
+		response    string
+		wantPayload string // a field of the request, with its value
+		wantScores  []float64
+		wantErr     string
+	}{
+		{
+			name:        "openai format",
+			status:      http.StatusOK,
+			response:    `{"results": [{"index": 1, "relevance_score": 0.9}, {"index": 0, "relevance_score": -2.5}]}`,
+			wantPayload: `"documents":["first","second"]`,
+			wantScores:  []float64{-2.5, 0.9},
+		},
+		{
+			name:        "tei format",
+			format:      RerankFormatTEI,
+			status:      http.StatusOK,
+			response:    ` [{"index": 0, "score": 0.25}, {"index": 1, "score": 0.75}]`,
+			wantPayload: `"texts":["first","second"]`,
+			wantScores:  []float64{0.25, 0.75},
+		},
+		{name: "missing document", status: http.StatusOK, response: `{"results": [{"index": 0, "relevance_score": 0.9}]}`, wantErr: "no score for document 1"},
+		{name: "no score", status: http.StatusOK, response: `[{"index": 0}, {"index": 1, "score": 1}]`, wantErr: "no score for document 0"},
+		{name: "invalid index", status: http.StatusOK, response: `[{"index": 2, "score": 1}]`, wantErr: "invalid document index 2"},
+		{name: "invalid response", status: http.StatusOK, response: `{"results": "none"}`, wantErr: "invalid response"},
+		{name: "error status", status: http.StatusServiceUnavailable, response: "loading model\n", wantErr: "503 Service Unavailable: loading model"},
+		{name: "unknown format", format: "cohere", wantErr: `unknown rerank format "cohere"`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var payload map[string]any
+				if r.URL.Path != "/v1/rerank" || json.NewDecoder(r.Body).Decode(&payload) != nil || payload["query"] != "question" {
+					t.Errorf("got an invalid request to %s", r.URL.Path)
+				}
+				if content, _ := json.Marshal(payload); !strings.Contains(string(content), tc.wantPayload) {
+					t.Errorf("got payload %s, want %s", content, tc.wantPayload)
+				}
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.response))
+			}))
+			defer server.Close()
+
+			reranker := &EndpointReranker{BaseURL: server.URL + "/v1/", Model: "reranker", Format: tc.format}
+			scores, err := reranker.Score(context.Background(), "question", records)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got %v, want an error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(scores, tc.wantScores) {
+				t.Errorf("got %v, want %v", scores, tc.wantScores)
+			}
+		})
+	}
+}
+
+func TestLLMRerankerScore(t *testing.T) {
+	cases := []struct {
+		answer    string
+		wantScore float64
+		wantErr   bool
+	}{
+		{answer: "8", wantScore: 0.8},
+		{answer: "Grade: 7.5/10", wantScore: 0.75},
+		{answer: "0", wantScore: 0},
+		{answer: "12", wantScore: 1},
+		{answer: "relevant", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.answer, func(t *testing.T) {
+			client := newFakeChatClient(t, func(system, user string) string {
+				if want := "Question: question\n\nDocument:\nfirst"; user != want {
+					t.Errorf("got %q, want %q", user, want)
+				}
+				return tc.answer
+			})
+			reranker := &LLMReranker{Client: client, Model: "test"}
+			scores, err := reranker.Score(context.Background(), "question", []VectorRecord{{Id: "a", Prompt: "first"}})
+			if tc.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "invalid grade for record a") {
+					t.Fatalf("got %v, want an invalid grade", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if scores[0] != tc.wantScore {
+				t.Errorf("got %f, want %f", scores[0], tc.wantScore)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package rag
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestChunkSnippet(t *testing.T) {
+	snippet := "\n\n## Channels\nSending and receiving values with a channel\n```go\n" +
+		strings.Repeat("ch <- value\nfmt.Println(<-ch)\n", 20) + "```\n"
+
+	cases := []struct {
+		name      string
+		chunkSize int
+		overlap   int
+		chunks    int
+	}{
+		{name: "whole snippet", chunkSize: 0, overlap: 256, chunks: 1},
+		{name: "shorter than a chunk", chunkSize: 1024, overlap: 256, chunks: 1},
+		{name: "without overlap", chunkSize: 200, overlap: 0, chunks: 4},
+		{name: "with overlap", chunkSize: 200, overlap: 50, chunks: 5},
+		{name: "overlap too large", chunkSize: 200, overlap: 200, chunks: 4},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			chunks := ChunkSnippet(snippet, tc.chunkSize, tc.overlap)
+			if len(chunks) != tc.chunks {
+				t.Fatalf("got %d chunks, want %d", len(chunks), tc.chunks)
+			}
+			if chunks[0].EmbeddingText != "Channels\nSending and receiving values with a channel" {
+				t.Errorf("the first chunk embeds %q, want the title and the description", chunks[0].EmbeddingText)
+			}
+
+			// The records of the chunks, in any order, give the snippet back
+			records := []VectorRecord{}
+			for idx := len(chunks) - 1; idx >= 0; idx-- {
+				records = append(records, VectorRecord{
+					Id:     "chunk-" + strconv.Itoa(idx),
+					Prompt: chunks[idx].Text,
+					Metadata: map[string]string{
+						MetadataSource:  "snippets.md",
+						MetadataChunk:   strconv.Itoa(idx),
+						MetadataSnippet: "snippets.md#0",
+					},
+				})
+			}
+			records = append(records, VectorRecord{Id: "other", Prompt: "## Other", Metadata: map[string]string{MetadataSource: "snippets.md", MetadataChunk: strconv.Itoa(len(chunks))}})
+			snippets := GroupSnippetChunks(records)
+			if len(snippets) != 2 {
+				t.Fatalf("got %d snippets, want 2", len(snippets))
+			}
+			if text := SnippetText(snippets[0]); text != snippet {
+				t.Errorf("got the snippet %q, want %q", text, snippet)
+			}
+			for _, chunk := range chunks[1:] {
+				if !strings.HasPrefix(chunk.EmbeddingText, "Channels\n") || len([]rune(chunk.EmbeddingText)) > tc.chunkSize+len("Channels\n") {
+					t.Errorf("a chunk embeds %q", chunk.EmbeddingText)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package rag
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SourceURIPrefix is the prefix of the URIs of the source documents, ex: rag://source/notes/deployment.md
+const SourceURIPrefix = "rag://source/"
+
+// SourceURI returns the URI of a source document (the MCP resource of the document).
+func SourceURI(source string) string {
+	return SourceURIPrefix + (&url.URL{Path: source}).EscapedPath()
+}
+
+// SourceFromURI returns the source of a URI returned by SourceURI, and false when it is not a source URI.
+func SourceFromURI(uri string) (string, bool) {
+	if !strings.HasPrefix(uri, SourceURIPrefix) {
+		return "", false
+	}
+	source, err := url.PathUnescape(strings.TrimPrefix(uri, SourceURIPrefix))
+	if err != nil || source == "" {
+		return "", false
+	}
+	return source, true
+}
+
+// SourceInfo is a document of the store: its source (see MetadataSource) and its number of chunks.
+type SourceInfo struct {
+	Source string
+	Chunks int
+}
+
+// ListSources returns the sources of the records of the store, sorted by source.
+// The records without source are counted under an empty source.
+func ListSources(store VectorStore) ([]SourceInfo, error) {
+	records, err := store.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, record := range records {
+		counts[record.Metadata[MetadataSource]]++
+	}
+
+	sources := make([]SourceInfo, 0, len(counts))
+	for source, chunks := range counts {
+		sources = append(sources, SourceInfo{Source: source, Chunks: chunks})
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Source < sources[j].Source
+	})
+	return sources, nil
+}
+
+// SourceRecordIDs returns the IDs of the records of a source.
+func SourceRecordIDs(store VectorStore, source string) ([]string, error) {
+	records, err := store.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, record := range records {
+		if record.Metadata[MetadataSource] == source {
+			ids = append(ids, record.Id)
+		}
+	}
+	return ids, nil
+}
+
+// DeleteSource removes all the records of a source from the store and returns their IDs.
+func DeleteSource(store VectorStore, source string) ([]string, error) {
+	ids, err := SourceRecordIDs(store, source)
+	if err != nil {
+		return nil, err
+	}
+	for idx, id := range ids {
+		if err := store.Delete(id); err != nil {
+			return ids[:idx], err
+		}
+	}
+	return ids, nil
+}
+
+// SourceText returns the text of a source rebuilt from its chunks, in the order of the document (see MetadataChunk),
+// separated by the separator. The overlaps of the chunks are repeated.
+// It returns false when the store has no record of the source.
+func SourceText(store VectorStore, source string, separator string) (string, bool, error) {
+	records, err := store.GetAll()
+	if err != nil {
+		return "", false, err
+	}
+	chunks := []VectorRecord{}
+	for _, record := range records {
+		if record.Metadata[MetadataSource] == source {
+			chunks = append(chunks, record)
+		}
+	}
+	if len(chunks) == 0 {
+		return "", false, nil
+	}
+
+	// The chunks saved before their position was recorded come last
+	position := func(record VectorRecord) int {
+		if chunk, err := strconv.Atoi(record.Metadata[MetadataChunk]); err == nil {
+			return chunk
+		}
+		return len(records)
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		if position(chunks[i]) != position(chunks[j]) {
+			return position(chunks[i]) < position(chunks[j])
+		}
+		return chunks[i].Id < chunks[j].Id
+	})
+	texts := make([]string, len(chunks))
+	for idx, chunk := range chunks {
+		texts[idx] = strings.TrimSpace(chunk.Prompt)
+	}
+	return strings.Join(texts, separator), true, nil
+}